@@ -0,0 +1,500 @@
+package main
+
+import "fmt"
+import "sync/atomic"
+import "unsafe"
+
+// AHCI SATA driver. each port with a disk attached is a blockdev_t served by
+// a daemon that keeps up to 32 commands outstanding using native command
+// queuing when the disk supports it. trapstub clears the HBA's interrupt
+// status so that the level-triggered interrupt line is deasserted; the port
+// daemons then find finished commands by comparing the commands they issued
+// with those the HBA still considers outstanding.
+
+const(
+	// generic host control registers
+	ahci_cap = 0x00
+	ahci_ghc = 0x04
+	ahci_is = 0x08
+	ahci_pi = 0x0c
+
+	ahci_cap_sncq = 1 << 30
+	ahci_ghc_ie = 1 << 1
+	ahci_ghc_ae = 1 << 31
+
+	// port registers, relative to the port's registers
+	ahci_pbase = 0x100
+	ahci_psize = 0x80
+	ahci_pclb = 0x00
+	ahci_pclbu = 0x04
+	ahci_pfb = 0x08
+	ahci_pfbu = 0x0c
+	ahci_pis = 0x10
+	ahci_pie = 0x14
+	ahci_pcmd = 0x18
+	ahci_ptfd = 0x20
+	ahci_psig = 0x24
+	ahci_pssts = 0x28
+	ahci_pserr = 0x30
+	ahci_psact = 0x34
+	ahci_pci = 0x38
+	// size of the HBA's registers with 32 ports
+	ahci_regsz = ahci_pbase + 32*ahci_psize
+
+	ahci_pcmd_st = 1 << 0
+	ahci_pcmd_fre = 1 << 4
+	ahci_pcmd_fr = 1 << 14
+	ahci_pcmd_cr = 1 << 15
+	// interrupts for received FISes, processed PRD entries, and errors
+	ahci_pie_all = 0x7d00002f
+	ahci_tfd_err = 0x01
+	ahci_tfd_drq = 0x08
+	ahci_tfd_bsy = 0x80
+	// the device detection field of PxSSTS when a device is present
+	ahci_det_present = 3
+	ahci_sig_ata = 0x00000101
+
+	ata_cmd_read_dma_ext = 0x25
+	ata_cmd_write_dma_ext = 0x35
+	ata_cmd_write_dma_fua_ext = 0x3d
+	ata_cmd_read_fpdma = 0x60
+	ata_cmd_write_fpdma = 0x61
+	ata_cmd_identify = 0xec
+	ata_cmd_flush_ext = 0xea
+
+	// a command table is a page: the command FIS, followed by the PRD
+	// table at offset 0x80 with 16 byte entries. each sector takes at most
+	// two PRD entries since a sector may straddle two pages.
+	ahci_prdoff = 0x80
+	ahci_maxsect = 64
+	ahci_nslots = 32
+	// the received FIS area follows the command list
+	ahci_fisoff = 1024
+)
+
+// the vector of the HBA's interrupt, or -1 if there is no HBA
+var ahci_int = -1
+// the registers of the HBA; read by trapstub
+var ahci_regs *[ahci_regsz/4]uint32
+
+type ahci_t struct {
+	regs	*[ahci_regsz/4]uint32
+	ports	[]*ahci_port_t
+}
+
+var ahci_hba *ahci_t
+
+func (a *ahci_t) rd(reg int) int {
+	return int(atomic.LoadUint32(&a.regs[reg/4]))
+}
+
+func (a *ahci_t) wr(reg int, v int) {
+	a.regs[reg/4] = uint32(v)
+}
+
+// a port with an ATA disk attached
+type ahci_port_t struct {
+	hba	*ahci_t
+	num	int
+	nsect	int
+	ncq	bool
+	// the disk supports WRITE DMA FUA EXT
+	fuaext	bool
+	nslots	int
+	// the command list followed by the received FIS area
+	clist	*[PGSIZE]uint8
+	ctabs	[ahci_nslots]*[PGSIZE]uint8
+	ctabpa	[ahci_nslots]int
+	req	chan *bdevreq_t
+	intr	chan bool
+}
+
+func (p *ahci_port_t) rd(reg int) int {
+	return p.hba.rd(ahci_pbase + p.num*ahci_psize + reg)
+}
+
+func (p *ahci_port_t) wr(reg int, v int) {
+	p.hba.wr(ahci_pbase + p.num*ahci_psize + reg, v)
+}
+
+func (p *ahci_port_t) start(req *bdevreq_t) {
+	p.req <- req
+}
+
+func (p *ahci_port_t) capacity() int {
+	return p.nsect
+}
+
+func (p *ahci_port_t) sectsize() int {
+	return 512
+}
+
+// queued writes always support forced unit access
+func (p *ahci_port_t) fua() bool {
+	return p.ncq || p.fuaext
+}
+
+// clears the HBA's interrupt status from trapstub so that the interrupt line
+// is deasserted before interrupts are enabled again. port status must be
+// cleared before the HBA's.
+//go:nosplit
+func ahci_intr_clear() {
+	regs := ahci_regs
+	is := regs[ahci_is/4]
+	for i := 0; i < 32; i++ {
+		if is & (1 << uint(i)) != 0 {
+			// writing the set bits back clears them
+			pis := (ahci_pbase + i*ahci_psize + ahci_pis)/4
+			st := regs[pis]
+			regs[pis] = st
+		}
+	}
+	regs[ahci_is/4] = is
+}
+
+func trap_ahci(ts *trapstore_t) {
+	for _, p := range ahci_hba.ports {
+		select {
+		case p.intr <- true:
+		default:
+		}
+	}
+}
+
+// spins until the bits of mask in a port register equal want, giving up
+// after a while
+func (p *ahci_port_t) waitreg(reg int, mask int, want int) bool {
+	for i := 0; i < 1000000; i++ {
+		if p.rd(reg) & mask == want {
+			return true
+		}
+	}
+	return false
+}
+
+// stops the port's command and FIS processing
+func (p *ahci_port_t) stop() bool {
+	p.wr(ahci_pcmd, p.rd(ahci_pcmd) &^ ahci_pcmd_st)
+	if !p.waitreg(ahci_pcmd, ahci_pcmd_cr, 0) {
+		return false
+	}
+	p.wr(ahci_pcmd, p.rd(ahci_pcmd) &^ ahci_pcmd_fre)
+	return p.waitreg(ahci_pcmd, ahci_pcmd_fr, 0)
+}
+
+// clears the port's errors and starts command processing
+func (p *ahci_port_t) run() bool {
+	p.wr(ahci_pserr, -1)
+	p.wr(ahci_pis, -1)
+	p.wr(ahci_pcmd, p.rd(ahci_pcmd) | ahci_pcmd_fre)
+	if !p.waitreg(ahci_ptfd, ahci_tfd_bsy | ahci_tfd_drq, 0) {
+		return false
+	}
+	p.wr(ahci_pcmd, p.rd(ahci_pcmd) | ahci_pcmd_st)
+	return true
+}
+
+// builds the command in slot s: a register host to device FIS for cmd, which
+// transfers bufs starting at their first block. queued commands carry the
+// sector count in the features field, the slot in the count field, and the
+// forced unit access bit in the device register.
+func (p *ahci_port_t) build(s int, cmd int, bufs []*diskbuf_t, write bool,
+    queued bool, fua bool) {
+	ct := p.ctabs[s]
+	for i := 0; i < ahci_prdoff; i++ {
+		ct[i] = 0
+	}
+	lba := 0
+	if len(bufs) != 0 {
+		lba = int(bufs[0].block)
+	}
+	n := len(bufs)
+	// register FIS, host to device, command
+	ct[0] = 0x27
+	ct[1] = 0x80
+	ct[2] = uint8(cmd)
+	ct[4] = uint8(lba)
+	ct[5] = uint8(lba >> 8)
+	ct[6] = uint8(lba >> 16)
+	// LBA mode
+	ct[7] = 0x40
+	ct[8] = uint8(lba >> 24)
+	ct[9] = uint8(lba >> 32)
+	ct[10] = uint8(lba >> 40)
+	if queued {
+		if fua {
+			ct[7] |= 0x80
+		}
+		ct[3] = uint8(n)
+		ct[11] = uint8(n >> 8)
+		ct[12] = uint8(s << 3)
+	} else {
+		ct[12] = uint8(n)
+		ct[13] = uint8(n >> 8)
+	}
+
+	nprd := 0
+	for _, b := range bufs {
+		dma_regions(b.data[:], func(pa int, l int) {
+			off := ahci_prdoff + nprd*16
+			writen(ct[:], 4, off, pa)
+			writen(ct[:], 4, off + 4, pa >> 32)
+			writen(ct[:], 4, off + 8, 0)
+			writen(ct[:], 4, off + 12, l - 1)
+			nprd++
+		})
+	}
+
+	// command header: FIS length in dwords, direction, and PRD count
+	h := s*32
+	flags := 5
+	if write {
+		flags |= 1 << 6
+	}
+	writen(p.clist[:], 4, h, flags | nprd << 16)
+	writen(p.clist[:], 4, h + 4, 0)
+	writen(p.clist[:], 4, h + 8, p.ctabpa[s])
+	writen(p.clist[:], 4, h + 12, p.ctabpa[s] >> 32)
+}
+
+// issues the command in slot s without waiting for it to finish
+func (p *ahci_port_t) issue(s int, queued bool) {
+	if queued {
+		p.wr(ahci_psact, 1 << uint(s))
+	}
+	p.wr(ahci_pci, 1 << uint(s))
+}
+
+// issues IDENTIFY DEVICE and polls for its completion since interrupts are
+// not yet enabled. returns false on error.
+func (p *ahci_port_t) identify(id *[256]uint16) bool {
+	buf := &diskbuf_t{}
+	p.build(0, ata_cmd_identify, []*diskbuf_t{buf}, false, false, false)
+	p.issue(0, false)
+	if !p.waitreg(ahci_pci, 1, 0) {
+		return false
+	}
+	if p.rd(ahci_ptfd) & ahci_tfd_err != 0 {
+		return false
+	}
+	for i := range id {
+		id[i] = uint16(readn(buf.data[:], 2, 2*i))
+	}
+	return true
+}
+
+// allocates the port's command list and tables, starts the port, and
+// identifies its disk. returns false if the port is unusable.
+func (p *ahci_port_t) init(hbaslots int, hbancq bool) bool {
+	if !p.stop() {
+		return false
+	}
+	pt := make(map[int]*[512]int)
+	pg, pa := pg_new(pt)
+	p.clist = (*[PGSIZE]uint8)(unsafe.Pointer(pg))
+	p.wr(ahci_pclb, pa)
+	p.wr(ahci_pclbu, pa >> 32)
+	p.wr(ahci_pfb, pa + ahci_fisoff)
+	p.wr(ahci_pfbu, (pa + ahci_fisoff) >> 32)
+	for i := range p.ctabs {
+		pg, pa := pg_new(pt)
+		p.ctabs[i] = (*[PGSIZE]uint8)(unsafe.Pointer(pg))
+		p.ctabpa[i] = pa
+	}
+	if !p.run() {
+		return false
+	}
+
+	var id [256]uint16
+	if !p.identify(&id) {
+		return false
+	}
+	// logical sectors larger than 512 bytes?
+	if id[106] & 0xc000 == 0x4000 && id[106] & (1 << 12) != 0 {
+		return false
+	}
+	// 48-bit LBA
+	if id[83] & (1 << 10) == 0 {
+		return false
+	}
+	p.nsect = int(id[100]) | int(id[101]) << 16 | int(id[102]) << 32
+	p.ncq = hbancq && id[76] & (1 << 8) != 0
+	// word 84 is valid if bits 15:14 are 01
+	p.fuaext = id[84] & 0xc040 == 0x4040
+	p.nslots = 1
+	if p.ncq {
+		p.nslots = int(id[75] & 0x1f) + 1
+		if p.nslots > hbaslots {
+			p.nslots = hbaslots
+		}
+	}
+	p.req = make(chan *bdevreq_t)
+	p.intr = make(chan bool, 1)
+	p.wr(ahci_pie, ahci_pie_all)
+	return true
+}
+
+// reads and writes are queued if the disk supports NCQ; everything else must
+// be issued while no other command is outstanding.
+func (p *ahci_port_t) queued(c *bdevcmd_t) bool {
+	return p.ncq && c.cmd() != BDEV_FLUSH
+}
+
+func (p *ahci_port_t) daemon() {
+	var issued [ahci_nslots]*bdevcmd_t
+	nissued := 0
+	// true while a non-queued command is outstanding
+	excl := false
+	queue := make([]*bdevcmd_t, 0)
+	for {
+		select {
+		case req := <- p.req:
+			queue = append(queue, bdev_split(req, ahci_maxsect)...)
+		case <- p.intr:
+			sact := p.rd(ahci_psact)
+			ci := p.rd(ahci_pci)
+			if p.rd(ahci_ptfd) & ahci_tfd_err != 0 {
+				// fail all outstanding commands and restart
+				// the port, which clears PxCI and PxSACT
+				fmt.Printf("ahci%v: error %#x\n", p.num,
+				    p.rd(ahci_pserr))
+				p.stop()
+				p.run()
+				sact, ci = 0, 0
+				for s, c := range issued {
+					if c != nil {
+						c.done(-EIO)
+						issued[s] = nil
+					}
+				}
+				nissued = 0
+				excl = false
+			}
+			for s, c := range issued {
+				bit := 1 << uint(s)
+				if c == nil || sact & bit != 0 || ci & bit != 0 {
+					continue
+				}
+				c.done(0)
+				issued[s] = nil
+				nissued--
+				if !p.queued(c) {
+					excl = false
+				}
+			}
+		}
+
+		for len(queue) != 0 && !excl {
+			c := queue[0]
+			q := p.queued(c)
+			if !q && nissued != 0 || nissued == p.nslots {
+				break
+			}
+			s := 0
+			for issued[s] != nil {
+				s++
+			}
+			write := c.cmd() == BDEV_WRITE
+			fua := write && c.fua()
+			var cmd int
+			switch {
+			case c.cmd() == BDEV_FLUSH:
+				cmd = ata_cmd_flush_ext
+			case q && write:
+				cmd = ata_cmd_write_fpdma
+			case q:
+				cmd = ata_cmd_read_fpdma
+			case fua:
+				cmd = ata_cmd_write_dma_fua_ext
+			case write:
+				cmd = ata_cmd_write_dma_ext
+			default:
+				cmd = ata_cmd_read_dma_ext
+			}
+			p.build(s, cmd, c.bufs, write, q, fua)
+			issued[s] = c
+			nissued++
+			excl = !q
+			p.issue(s, q)
+			queue = queue[1:]
+		}
+	}
+}
+
+var ahci_driver = pci_driver_t{
+	name: "ahci",
+	// mass storage, SATA
+	ids: []pci_id_t{{-1, -1, 0x0106}},
+	attach: ahci_attach,
+}
+
+// enables the HBA and finds its ports that have a disk attached. only one
+// HBA is supported. the HBA's interrupt stays masked until ahci_start().
+func ahci_attach(d *pci_dev_t) bool {
+	// AHCI programming interface
+	if ahci_hba != nil || d.progif != 0x01 {
+		return false
+	}
+	if d.irq == -1 {
+		fmt.Printf("ahci: no legacy IRQ\n")
+		return false
+	}
+	abar := d.bars[5]
+	if abar.io || abar.addr == 0 {
+		return false
+	}
+	d.command(pci_cmd_mem | pci_cmd_bm, pci_cmd_intxdis)
+
+	a := &ahci_t{}
+	a.regs = (*[ahci_regsz/4]uint32)(unsafe.Pointer(&dmap8(abar.addr)[0]))
+	a.wr(ahci_ghc, a.rd(ahci_ghc) | ahci_ghc_ae)
+	hcap := a.rd(ahci_cap)
+	hbaslots := (hcap >> 8) & 0x1f + 1
+	hbancq := hcap & ahci_cap_sncq != 0
+
+	pi := a.rd(ahci_pi)
+	for i := 0; i < 32; i++ {
+		if pi & (1 << uint(i)) == 0 {
+			continue
+		}
+		p := &ahci_port_t{hba: a, num: i}
+		if p.rd(ahci_pssts) & 0xf != ahci_det_present ||
+		    p.rd(ahci_psig) != ahci_sig_ata {
+			continue
+		}
+		if !p.init(hbaslots, hbancq) {
+			fmt.Printf("ahci%v: failed to initialize\n", i)
+			continue
+		}
+		fmt.Printf("ahci%v: %v sectors, %v slots\n", i, p.nsect,
+		    p.nslots)
+		a.ports = append(a.ports, p)
+	}
+	if len(a.ports) == 0 {
+		return false
+	}
+	ahci_hba = a
+	ahci_regs = a.regs
+	ahci_int = IRQ_BASE + d.irq
+	return true
+}
+
+// returns the ports with a disk attached, or nil if there is no HBA
+func ahci_disks() []*ahci_port_t {
+	if ahci_hba == nil {
+		return nil
+	}
+	return ahci_hba.ports
+}
+
+// starts the port daemons and enables the HBA's interrupt once its handler
+// is installed.
+func ahci_start() {
+	a := ahci_hba
+	for _, p := range a.ports {
+		go p.daemon()
+	}
+	a.wr(ahci_is, -1)
+	a.wr(ahci_ghc, a.rd(ahci_ghc) | ahci_ghc_ie)
+	irq_unmask(ahci_int - IRQ_BASE)
+}
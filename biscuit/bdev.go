@@ -0,0 +1,293 @@
+package main
+
+import "runtime"
+import "sync"
+import "unsafe"
+
+// block devices: disks, partitions, and RAM disks all present themselves as a
+// blockdev_t so that any of them can hold a file system.
+
+type diskbuf_t struct {
+	block	int32
+	data	[512]uint8
+}
+
+const(
+	BDEV_READ	= iota
+	BDEV_WRITE
+	BDEV_FLUSH
+)
+
+// a request to read or write a run of consecutive sectors, starting at the
+// block of the first buffer, or to flush the device's write cache. the device
+// sends 0 or a negative errno on ack once the request has finished; ack is
+// buffered so that devices completing requests out of order never wait for
+// the requester.
+type bdevreq_t struct {
+	cmd	int
+	bufs	[]*diskbuf_t
+	ack	chan int
+	// forced unit access: the written sectors are on stable media, not
+	// just in the device's write cache, once the write is acked. only set
+	// for devices whose fua() is true.
+	fua	bool
+}
+
+func bdevreq_new(cmd int, bufs []*diskbuf_t) *bdevreq_t {
+	return &bdevreq_t{cmd: cmd, bufs: bufs, ack: make(chan int, 1)}
+}
+
+type blockdev_t interface {
+	// starts req. devices may serve requests in any order.
+	start(req *bdevreq_t)
+	// the number of sectors on the device
+	capacity() int
+	// the size of a sector in bytes
+	sectsize() int
+	// true if the device honors forced unit access writes
+	fua() bool
+}
+
+// the block devices that may be mounted, by name, and their names in the
+// order they were registered
+var bdevs	= map[string]blockdev_t{}
+var bdevorder	[]string
+var bdevl	= sync.Mutex{}
+
+func bdev_register(name string, d blockdev_t) {
+	bdevl.Lock()
+	defer bdevl.Unlock()
+	if _, ok := bdevs[name]; ok {
+		panic("block device registered twice")
+	}
+	bdevs[name] = d
+	bdevorder = append(bdevorder, name)
+}
+
+// returns the names of the block devices in the order they were registered
+func bdev_names() []string {
+	bdevl.Lock()
+	defer bdevl.Unlock()
+	ret := make([]string, len(bdevorder))
+	copy(ret, bdevorder)
+	return ret
+}
+
+// returns the nth block device registered or nil if there is none
+func bdev_minor(n int) blockdev_t {
+	bdevl.Lock()
+	defer bdevl.Unlock()
+	if n < 0 || n >= len(bdevorder) {
+		return nil
+	}
+	return bdevs[bdevorder[n]]
+}
+
+// returns the block device called name or nil if there is none
+func bdev_lookup(name string) blockdev_t {
+	bdevl.Lock()
+	defer bdevl.Unlock()
+	return bdevs[name]
+}
+
+// returns true if bufs is a run of consecutive sectors that lies on d.
+func bdev_inrange(d blockdev_t, bufs []*diskbuf_t) bool {
+	for i, b := range bufs {
+		if int(b.block) != int(bufs[0].block) + i {
+			panic("sectors not consecutive")
+		}
+	}
+	if len(bufs) == 0 {
+		return true
+	}
+	first := int(bufs[0].block)
+	return first >= 0 && first + len(bufs) <= d.capacity()
+}
+
+// submits req to d and waits for it to finish.
+func bdev_do(d blockdev_t, req *bdevreq_t) int {
+	if !bdev_inrange(d, req.bufs) {
+		return -EINVAL
+	}
+	d.start(req)
+	return <- req.ack
+}
+
+func bdev_read(d blockdev_t, bufs []*diskbuf_t) int {
+	return bdev_do(d, bdevreq_new(BDEV_READ, bufs))
+}
+
+func bdev_write(d blockdev_t, bufs []*diskbuf_t) int {
+	return bdev_do(d, bdevreq_new(BDEV_WRITE, bufs))
+}
+
+func bdev_flush(d blockdev_t) int {
+	return bdev_do(d, bdevreq_new(BDEV_FLUSH, nil))
+}
+
+// writes bufs to stable media, with a forced unit access write if d supports
+// it and otherwise by flushing d's write cache after the write. unlike a
+// flush, a forced unit access write doesn't make earlier writes stable.
+func bdev_writefua(d blockdev_t, bufs []*diskbuf_t) int {
+	if !d.fua() {
+		if err := bdev_write(d, bufs); err != 0 {
+			return err
+		}
+		return bdev_flush(d)
+	}
+	req := bdevreq_new(BDEV_WRITE, bufs)
+	req.fua = true
+	return bdev_do(d, req)
+}
+
+// a request that a driver serves as several commands since a device limits
+// the number of sectors moved by one command
+type bdevsplit_t struct {
+	req	*bdevreq_t
+	left	int
+	err	int
+}
+
+type bdevcmd_t struct {
+	r	*bdevsplit_t
+	bufs	[]*diskbuf_t
+}
+
+func (c *bdevcmd_t) cmd() int {
+	return c.r.req.cmd
+}
+
+func (c *bdevcmd_t) fua() bool {
+	return c.r.req.fua
+}
+
+// finishes the command, acking its request once all of the request's
+// commands are done
+func (c *bdevcmd_t) done(err int) {
+	if err != 0 {
+		c.r.err = err
+	}
+	c.r.left--
+	if c.r.left == 0 {
+		c.r.req.ack <- c.r.err
+	}
+}
+
+// splits req into commands of at most max sectors; a flush is a single
+// command without buffers. requests without any commands are acked
+// immediately.
+func bdev_split(req *bdevreq_t, max int) []*bdevcmd_t {
+	r := &bdevsplit_t{req: req}
+	ret := make([]*bdevcmd_t, 0, 1)
+	if req.cmd == BDEV_FLUSH {
+		ret = append(ret, &bdevcmd_t{r: r})
+	}
+	for bufs := req.bufs; len(bufs) != 0; {
+		n := len(bufs)
+		if n > max {
+			n = max
+		}
+		ret = append(ret, &bdevcmd_t{r: r, bufs: bufs[:n]})
+		bufs = bufs[n:]
+	}
+	r.left = len(ret)
+	if r.left == 0 {
+		req.ack <- 0
+	}
+	return ret
+}
+
+// calls f with the physical address and length of each physically contiguous
+// region of d, for building DMA descriptors. regions end at page boundaries
+// since consecutive virtual pages need not be physically contiguous.
+func dma_regions(d []uint8, f func(int, int)) {
+	for len(d) != 0 {
+		va := int(uintptr(unsafe.Pointer(&d[0])))
+		l := PGSIZE - (va & PGOFFSET)
+		if l > len(d) {
+			l = len(d)
+		}
+		pa := runtime.Vtop((*[512]int)(unsafe.Pointer(&d[0])))
+		if pa == 0 {
+			panic("DMA buffer not mapped")
+		}
+		f(pa, l)
+		d = d[l:]
+	}
+}
+
+// returns a zeroed, page aligned buffer of npg physically contiguous pages and
+// its physical address, for DMA structures that span several pages. the
+// runtime usually hands out physical pages in order, so a few tries suffice.
+func dma_contig(npg int) ([]uint8, int) {
+	for try := 0; try < 16; try++ {
+		b := make([]uint8, (npg + 1)*PGSIZE)
+		va := int(uintptr(unsafe.Pointer(&b[0])))
+		off := roundup(va, PGSIZE) - va
+		b = b[off:off + npg*PGSIZE]
+		first := -1
+		next := -1
+		dma_regions(b, func(pa int, l int) {
+			if first == -1 {
+				first = pa
+			} else if pa != next {
+				first = -2
+			}
+			next = pa + l
+		})
+		if first >= 0 {
+			return b, first
+		}
+	}
+	panic("no physically contiguous memory")
+}
+
+// returns the physical address of d, which must not cross a page boundary
+func dma_pa(d []uint8) int {
+	ret := -1
+	dma_regions(d, func(pa int, l int) {
+		if ret != -1 {
+			panic("buffer crosses a page")
+		}
+		ret = pa
+	})
+	return ret
+}
+
+// splits bufs into runs of consecutive sectors.
+func bdev_runs(bufs []*diskbuf_t) [][]*diskbuf_t {
+	ret := make([][]*diskbuf_t, 0)
+	s := 0
+	for i := 1; i <= len(bufs); i++ {
+		if i == len(bufs) || bufs[i].block != bufs[i - 1].block + 1 {
+			ret = append(ret, bufs[s:i])
+			s = i
+		}
+	}
+	return ret
+}
+
+// writes all bufs, which need not be consecutive, to d, waiting for them all
+// at once instead of one run at a time. returns the first error.
+func bdev_writeall(d blockdev_t, bufs []*diskbuf_t) int {
+	runs := bdev_runs(bufs)
+	reqs := make([]*bdevreq_t, len(runs))
+	for i, r := range runs {
+		if !bdev_inrange(d, r) {
+			return -EINVAL
+		}
+		reqs[i] = bdevreq_new(BDEV_WRITE, r)
+	}
+	go func() {
+		for _, r := range reqs {
+			d.start(r)
+		}
+	}()
+	ret := 0
+	for _, r := range reqs {
+		if err := <- r.ack; err != 0 && ret == 0 {
+			ret = err
+		}
+	}
+	return ret
+}
@@ -0,0 +1,176 @@
+package main
+
+import "runtime"
+
+import "./fs"
+
+// the biscuit file system, which lives in package fs so that it can be tested
+// on the host, as a mountable file system.
+
+// the file types of the file system, which tmpfs shares
+const(
+	I_FILE	= fs.I_FILE
+	I_DIR	= fs.I_DIR
+	I_DEV	= fs.I_DEV
+)
+
+// the block cache uses at most 1/BC_MEMFRAC of the physical memory available
+// at boot
+const BC_MEMFRAC = 8
+
+// the device holding the file system
+var fsdev	blockdev_t
+
+// a block device as seen by the file system
+type bfsdisk_t struct {
+	d	blockdev_t
+}
+
+func (bd *bfsdisk_t) bufs(fbufs []*fs.Diskbuf_t) []*diskbuf_t {
+	ret := make([]*diskbuf_t, len(fbufs))
+	for i, fb := range fbufs {
+		ret[i] = &diskbuf_t{block: fb.Block, data: fb.Data}
+	}
+	return ret
+}
+
+func (bd *bfsdisk_t) Read(fbufs []*fs.Diskbuf_t) int {
+	bufs := bd.bufs(fbufs)
+	err := bdev_read(bd.d, bufs)
+	if err == 0 {
+		for i, b := range bufs {
+			fbufs[i].Data = b.data
+		}
+	}
+	return err
+}
+
+func (bd *bfsdisk_t) Write(fbufs []*fs.Diskbuf_t) int {
+	return bdev_writeall(bd.d, bd.bufs(fbufs))
+}
+
+func (bd *bfsdisk_t) Writefua(fbufs []*fs.Diskbuf_t) int {
+	return bdev_writefua(bd.d, bd.bufs(fbufs))
+}
+
+func (bd *bfsdisk_t) Flush() int {
+	return bdev_flush(bd.d)
+}
+
+func (bd *bfsdisk_t) Capacity() int {
+	return bd.d.capacity()
+}
+
+// returns true if dev holds a file system
+func fs_probe(dev blockdev_t) bool {
+	return dev.sectsize() == 512 && fs.Fs_probe(&bfsdisk_t{dev})
+}
+
+type bfs_t struct {
+}
+
+var bfs_type	= fstype_t{name: "biscuit", needdev: true, mount: bfs_mount}
+
+func bfs_mount(dev blockdev_t, flags int, data string) (fs_t, int) {
+	if fsdev != nil {
+		return nil, -EBUSY
+	}
+	if !fs_probe(dev) {
+		return nil, -EINVAL
+	}
+	fsdev = dev
+	fs.Fs_init(&bfsdisk_t{dev}, runtime.Pgsavail()*PGSIZE/BC_MEMFRAC/512)
+	return &bfs_t{}, 0
+}
+
+func (b *bfs_t) open(path []string, flags int, mode int) (fops_t, int) {
+	f, err := fs.Fs_open(path, flags & O_CREAT != 0)
+	if err != 0 {
+		return nil, err
+	}
+	st := &fs.Stat_t{}
+	if err := f.Stat(st); err != 0 {
+		f.Close()
+		return nil, err
+	}
+	if st.Itype == I_DEV {
+		// the device file itself isn't used anymore
+		f.Close()
+		df, err := devfile_new(st.Major, st.Minor, st.Ino)
+		if err != 0 {
+			return nil, err
+		}
+		return df, 0
+	}
+	return &bfile_t{f}, 0
+}
+
+func (b *bfs_t) mknod(path []string, major int, minor int) int {
+	return fs.Fs_mknod(path, major, minor)
+}
+
+func (b *bfs_t) mkdir(path []string, mode int) int {
+	return fs.Fs_mkdir(path)
+}
+
+func (b *bfs_t) link(oldp []string, newp []string) int {
+	return fs.Fs_link(oldp, newp)
+}
+
+func (b *bfs_t) unlink(path []string) int {
+	return fs.Fs_unlink(path)
+}
+
+func (b *bfs_t) sync() int {
+	return fs.Fs_sync()
+}
+
+// the daemons and caches cannot be torn down
+func (b *bfs_t) unmount() int {
+	return -EBUSY
+}
+
+// an open file of the file system
+type bfile_t struct {
+	f	*fs.Ifile_t
+}
+
+func (bf *bfile_t) read(dsts [][]uint8, offset int) (int, int) {
+	return bf.f.Read(dsts, offset)
+}
+
+func (bf *bfile_t) write(srcs [][]uint8, offset int, append bool) (int, int) {
+	return bf.f.Write(srcs, offset, append)
+}
+
+func (bf *bfile_t) fsync() int {
+	return bf.f.Fsync()
+}
+
+func (bf *bfile_t) truncate(newlen int) int {
+	return bf.f.Truncate(newlen)
+}
+
+func (bf *bfile_t) stat(st *stat_t) int {
+	fst := &fs.Stat_t{}
+	if err := bf.f.Stat(fst); err != 0 {
+		return err
+	}
+	st.ino = fst.Ino
+	switch fst.Itype {
+	case I_DIR:
+		st.mode = S_IFDIR
+	case I_DEV:
+		st.mode = S_IFCHR
+	default:
+		st.mode = S_IFREG
+	}
+	st.nlink = fst.Links
+	st.size = fst.Size
+	st.rdev = mkdev(fst.Major, fst.Minor)
+	return 0
+}
+
+func (bf *bfile_t) close() int {
+	return bf.f.Close()
+}
@@ -0,0 +1,378 @@
+package main
+
+import "runtime"
+
+// character devices. a device file names a driver by its major number and one
+// of the driver's devices by its minor number; devsw maps major numbers to
+// drivers. the numbers follow Linux where it has an equivalent.
+
+const(
+	// memory devices
+	D_MEM		= 1
+	  D_NULL	= 3
+	  D_ZERO	= 5
+	  D_FULL	= 7
+	// terminals. the console is the only terminal and the controlling
+	// terminal of every process.
+	D_TTY		= 5
+	  D_TTYSELF	= 0
+	  D_CONSOLE	= 1
+	// raw block devices; the minor number is the order in which the
+	// device was registered
+	D_DISK		= 8
+	// connections to user file system servers; opening minor 0 makes a
+	// new connection, whose number is the minor of the open device
+	D_UFS		= 240
+)
+
+// poll events
+const(
+	POLLIN		= 0x1
+	POLLOUT		= 0x4
+	POLLERR		= 0x8
+	POLLNVAL	= 0x20
+)
+
+// ioctls of D_DISK devices
+const(
+	// returns the number of sectors
+	DIOC_NSECT	= 1
+	// returns the size of a sector
+	DIOC_SECTSZ	= 2
+)
+
+// the entry points of a driver. every entry gets the minor number of the
+// device; read and write get the file offset, which drivers of streams like
+// terminals ignore.
+type devsw_t struct {
+	name	string
+	read	func(minor int, dsts [][]uint8, offset int) (int, int)
+	write	func(minor int, srcs [][]uint8, offset int) (int, int)
+	ioctl	func(minor int, cmd int, arg int) int
+	// returns the events of events that can happen without blocking
+	poll	func(minor int, events int) int
+	// optional. returns the minor number of the device an open gets,
+	// letting a driver give each open a device of its own.
+	open	func(minor int) (int, int)
+	// optional. called once a file of the device is no longer used.
+	close	func(minor int)
+}
+
+var devsw	= map[int]*devsw_t{}
+
+func devsw_register(major int, d *devsw_t) {
+	if _, ok := devsw[major]; ok {
+		panic("major number registered twice")
+	}
+	devsw[major] = d
+}
+
+// an open device file
+type devfile_t struct {
+	major	int
+	minor	int
+	// the inode number of the device file, for stat
+	ino	int
+}
+
+// returns the device file for major and minor, or -ENXIO if there is no
+// driver for major
+func devfile_new(major int, minor int, ino int) (*devfile_t, int) {
+	d, ok := devsw[major]
+	if !ok {
+		return nil, -ENXIO
+	}
+	if d.open != nil {
+		var err int
+		if minor, err = d.open(minor); err != 0 {
+			return nil, err
+		}
+	}
+	return &devfile_t{major: major, minor: minor, ino: ino}, 0
+}
+
+func (df *devfile_t) read(dsts [][]uint8, offset int) (int, int) {
+	return devsw[df.major].read(df.minor, dsts, offset)
+}
+
+func (df *devfile_t) write(srcs [][]uint8, offset int, append bool) (int,
+    int) {
+	return devsw[df.major].write(df.minor, srcs, offset)
+}
+
+func (df *devfile_t) fsync() int {
+	return -EINVAL
+}
+
+// devices have no size; O_TRUNC is ignored like on Linux
+func (df *devfile_t) truncate(newlen int) int {
+	return 0
+}
+
+func (df *devfile_t) stat(st *stat_t) int {
+	st.ino = df.ino
+	st.mode = S_IFCHR
+	st.nlink = 1
+	st.rdev = mkdev(df.major, df.minor)
+	return 0
+}
+
+func (df *devfile_t) close() int {
+	if d := devsw[df.major]; d.close != nil {
+		d.close(df.minor)
+	}
+	return 0
+}
+
+func (df *devfile_t) ioctl(cmd int, arg int) int {
+	return devsw[df.major].ioctl(df.minor, cmd, arg)
+}
+
+func (df *devfile_t) poll(events int) int {
+	return devsw[df.major].poll(df.minor, events)
+}
+
+func dev_notty(minor int, cmd int, arg int) int {
+	return -ENOTTY
+}
+
+// returns the total length of bufs
+func bufs_len(bufs [][]uint8) int {
+	ret := 0
+	for _, b := range bufs {
+		ret += len(b)
+	}
+	return ret
+}
+
+// copies src to bufs starting at byte off of bufs, returning the number of
+// bytes copied
+func bufs_put(bufs [][]uint8, off int, src []uint8) int {
+	c := 0
+	for _, b := range bufs {
+		if off >= len(b) {
+			off -= len(b)
+			continue
+		}
+		n := copy(b[off:], src[c:])
+		c += n
+		off = 0
+		if c == len(src) {
+			break
+		}
+	}
+	return c
+}
+
+// copies bufs starting at byte off of bufs to dst, returning the number of
+// bytes copied
+func bufs_get(bufs [][]uint8, off int, dst []uint8) int {
+	c := 0
+	for _, b := range bufs {
+		if off >= len(b) {
+			off -= len(b)
+			continue
+		}
+		n := copy(dst[c:], b[off:])
+		c += n
+		off = 0
+		if c == len(dst) {
+			break
+		}
+	}
+	return c
+}
+
+var mem_dev	= devsw_t{name: "mem", read: mem_read, write: mem_write,
+    ioctl: dev_notty, poll: mem_poll}
+
+func mem_read(minor int, dsts [][]uint8, offset int) (int, int) {
+	switch minor {
+	case D_NULL:
+		return 0, 0
+	case D_ZERO, D_FULL:
+		for _, d := range dsts {
+			for i := range d {
+				d[i] = 0
+			}
+		}
+		return bufs_len(dsts), 0
+	}
+	return 0, -ENXIO
+}
+
+func mem_write(minor int, srcs [][]uint8, offset int) (int, int) {
+	switch minor {
+	case D_NULL, D_ZERO:
+		return bufs_len(srcs), 0
+	case D_FULL:
+		return 0, -ENOSPC
+	}
+	return 0, -ENXIO
+}
+
+func mem_poll(minor int, events int) int {
+	return events & (POLLIN | POLLOUT)
+}
+
+var tty_dev	= devsw_t{name: "tty", read: tty_read, write: tty_write,
+    ioctl: dev_notty, poll: tty_poll}
+
+// blocks until a key is pressed
+func tty_read(minor int, dsts [][]uint8, offset int) (int, int) {
+	if minor != D_TTYSELF && minor != D_CONSOLE {
+		return 0, -ENXIO
+	}
+	sz := bufs_len(dsts)
+	if sz == 0 {
+		return 0, 0
+	}
+	return bufs_put(dsts, 0, kbd_get(sz)), 0
+}
+
+func tty_write(minor int, srcs [][]uint8, offset int) (int, int) {
+	if minor != D_TTYSELF && minor != D_CONSOLE {
+		return 0, -ENXIO
+	}
+	utext := int8(0x17)
+	for _, s := range srcs {
+		for _, c := range s {
+			runtime.Putcha(int8(c), utext)
+		}
+	}
+	return bufs_len(srcs), 0
+}
+
+func tty_poll(minor int, events int) int {
+	ret := events & POLLOUT
+	if events & POLLIN != 0 && kbd_ready() {
+		ret |= POLLIN
+	}
+	return ret
+}
+
+// the console, which processes start with as their standard input, output,
+// and error
+var cons_file	*file_t
+
+// opens /dev/console for the standard files of processes. the console device
+// is used directly if there is no /dev/console.
+func cons_init() {
+	f, err := vfs_open([]string{"dev", "console"}, O_RDWR, 0)
+	if err != 0 {
+		df, _ := devfile_new(D_TTY, D_CONSOLE, 0)
+		f = &file_t{fops: df}
+	}
+	cons_file = f
+}
+
+var disk_dev	= devsw_t{name: "disk", read: disk_read, write: disk_write,
+    ioctl: disk_ioctl, poll: mem_poll}
+
+// reads and writes of raw disks may start anywhere and are served one sector
+// at a time; a partial sector is read before it is written.
+func disk_rw(minor int, bufs [][]uint8, offset int, write bool) (int, int) {
+	d := bdev_minor(minor)
+	if d == nil {
+		return 0, -ENXIO
+	}
+	ss := d.sectsize()
+	if ss != 512 {
+		return 0, -EINVAL
+	}
+	end := offset + bufs_len(bufs)
+	if end > d.capacity()*ss {
+		end = d.capacity()*ss
+	}
+	if write && offset >= end && bufs_len(bufs) != 0 {
+		return 0, -ENOSPC
+	}
+	c := 0
+	for offset + c < end {
+		off := offset + c
+		so := off % ss
+		n := ss - so
+		if n > end - off {
+			n = end - off
+		}
+		b := &diskbuf_t{block: int32(off/ss)}
+		if !write || n != ss {
+			if err := bdev_read(d, []*diskbuf_t{b}); err != 0 {
+				return c, err
+			}
+		}
+		if write {
+			bufs_get(bufs, c, b.data[so:so + n])
+			if err := bdev_write(d, []*diskbuf_t{b}); err != 0 {
+				return c, err
+			}
+		} else {
+			bufs_put(bufs, c, b.data[so:so + n])
+		}
+		c += n
+	}
+	return c, 0
+}
+
+func disk_read(minor int, dsts [][]uint8, offset int) (int, int) {
+	return disk_rw(minor, dsts, offset, false)
+}
+
+func disk_write(minor int, srcs [][]uint8, offset int) (int, int) {
+	return disk_rw(minor, srcs, offset, true)
+}
+
+func disk_ioctl(minor int, cmd int, arg int) int {
+	d := bdev_minor(minor)
+	if d == nil {
+		return -ENXIO
+	}
+	switch cmd {
+	case DIOC_NSECT:
+		return d.capacity()
+	case DIOC_SECTSZ:
+		return d.sectsize()
+	}
+	return -ENOTTY
+}
+
+func dev_init() {
+	devsw_register(D_MEM, &mem_dev)
+	devsw_register(D_TTY, &tty_dev)
+	devsw_register(D_DISK, &disk_dev)
+	devsw_register(D_UFS, &ufs_dev)
+}
+
+// devfs is a tmpfs holding a device file for each device. more device files
+// can be made with mknod.
+var devfs_type	= fstype_t{name: "devfs", mount: devfs_mount}
+
+func devfs_mount(dev blockdev_t, flags int, data string) (fs_t, int) {
+	fs, err := tmpfs_mount(nil, flags, data)
+	if err != 0 {
+		return nil, err
+	}
+	nodes := []struct {
+		name	string
+		major	int
+		minor	int
+	}{
+		{"console", D_TTY, D_CONSOLE},
+		{"tty", D_TTY, D_TTYSELF},
+		{"null", D_MEM, D_NULL},
+		{"zero", D_MEM, D_ZERO},
+		{"full", D_MEM, D_FULL},
+		{"ufs", D_UFS, 0},
+	}
+	for _, n := range nodes {
+		if fs.mknod([]string{n.name}, n.major, n.minor) != 0 {
+			panic("devfs mknod")
+		}
+	}
+	for i, name := range bdev_names() {
+		if fs.mknod([]string{name}, D_DISK, i) != 0 {
+			panic("devfs mknod")
+		}
+	}
+	return fs, 0
+}
@@ -0,0 +1,1335 @@
+package main
+
+import "sync"
+import "time"
+
+// a driver for the second extended file system, so that images can be shared
+// with Linux. blocks go straight to the block device without the block cache
+// or the journal; the superblock and group descriptors are kept in memory and
+// written by sync and unmount. like tmpfs, one lock protects the whole file
+// system. directories are linear and read as the names of their entries, one
+// per line.
+
+var ext2_type	= fstype_t{name: "ext2", needdev: true, mount: ext2_mount}
+
+const(
+	// superblock fields. the superblock is at byte 1024 of the device.
+	e2_sbninodes	= 0
+	e2_sbnblocks	= 4
+	e2_sbfreeblks	= 12
+	e2_sbfreeinos	= 16
+	e2_sbfirstdata	= 20
+	e2_sblogbsz	= 24
+	e2_sbbpg	= 32
+	e2_sbipg	= 40
+	e2_sbmagic	= 56
+	e2_sbstate	= 58
+	e2_sbrev	= 76
+	e2_sbfirstino	= 84
+	e2_sbisz	= 88
+	e2_sbincompat	= 96
+	e2_sbrocompat	= 100
+	e2_sbsize	= 1024
+
+	e2_magic	= 0xef53
+	// the file system was unmounted cleanly
+	e2_valid	= 1
+
+	// the incompatible features we know: directory entries with types
+	e2_filetype	= 0x2
+	// the read-only compatible features we know: fewer superblock
+	// backups and files over 2GB
+	e2_sparse	= 0x1
+	e2_largefile	= 0x2
+
+	// group descriptor fields
+	e2_gdbbitmap	= 0
+	e2_gdibitmap	= 4
+	e2_gditable	= 8
+	e2_gdfreeblks	= 12
+	e2_gdfreeinos	= 14
+	e2_gdndirs	= 16
+	e2_gdsize	= 32
+
+	// inode fields
+	e2_imode	= 0
+	e2_isize	= 4
+	e2_iatime	= 8
+	e2_ictime	= 12
+	e2_imtime	= 16
+	e2_idtime	= 20
+	e2_ilinks	= 26
+	e2_iblocks	= 28
+	e2_iflags	= 32
+	e2_iblock	= 40
+	e2_isizehi	= 108
+
+	// the inode flag of directories with a hashed index. the index is
+	// only a hint; it is cleared when a directory is changed.
+	e2_indexfl	= 0x1000
+
+	e2_rootino	= 2
+	// direct blocks in an inode, followed by the single, double, and
+	// triple indirect blocks
+	e2_ndirect	= 12
+
+	// directory entry fields
+	e2_deino	= 0
+	e2_dereclen	= 4
+	e2_denamelen	= 6
+	e2_detype	= 7
+	e2_dename	= 8
+	e2_maxname	= 255
+
+	// file types
+	e2_ifmt		= 0xf000
+	e2_iflnk	= 0xa000
+)
+
+type ext2_t struct {
+	sync.Mutex
+	dev	blockdev_t
+	rdonly	bool
+	bsz	int
+	// device sectors per block
+	spb	int
+	ninodes	int
+	nblocks	int
+	firstdata	int
+	bpg	int
+	ipg	int
+	isz	int
+	firstino	int
+	ngroups	int
+	// directory entries record the type of their file
+	filetype	bool
+	// the superblock and the group descriptors, which start in the block
+	// after the superblock's
+	sb	[]uint8
+	gd	[]uint8
+	gdblk	int
+	dirty	bool
+	// the number of open files of each inode. an unlinked inode is freed
+	// once its last open file is closed.
+	opens	map[int]int
+}
+
+// the fields of an inode we use; the others are left as they are on disk
+type e2inode_t struct {
+	ino	int
+	mode	int
+	links	int
+	size	int
+	// in 512 byte units
+	blocks	int
+	flags	int
+	mtime	int
+	dtime	int
+	block	[15]int
+}
+
+func ext2_mount(dev blockdev_t, flags int, data string) (fs_t, int) {
+	if data != "" {
+		return nil, -EINVAL
+	}
+	if dev.sectsize() != 512 {
+		return nil, -EINVAL
+	}
+	e := &ext2_t{dev: dev, rdonly: flags & MS_RDONLY != 0}
+	e.opens = make(map[int]int)
+	if err := e.init(); err != 0 {
+		return nil, err
+	}
+	return e, 0
+}
+
+func ext2_now() int {
+	return int(time.Now().Unix())
+}
+
+// reads and checks the superblock and group descriptors
+func (e *ext2_t) init() int {
+	bufs := []*diskbuf_t{{block: 2}, {block: 3}}
+	if err := bdev_read(e.dev, bufs); err != 0 {
+		return err
+	}
+	sb := append(bufs[0].data[:], bufs[1].data[:]...)
+	if readn(sb, 2, e2_sbmagic) != e2_magic {
+		return -EINVAL
+	}
+	lbsz := readn(sb, 4, e2_sblogbsz)
+	if lbsz > 2 {
+		return -EINVAL
+	}
+	e.bsz = 1024 << uint(lbsz)
+	e.spb = e.bsz/512
+	e.ninodes = readn(sb, 4, e2_sbninodes)
+	e.nblocks = readn(sb, 4, e2_sbnblocks)
+	e.firstdata = readn(sb, 4, e2_sbfirstdata)
+	e.bpg = readn(sb, 4, e2_sbbpg)
+	e.ipg = readn(sb, 4, e2_sbipg)
+	e.isz = 128
+	e.firstino = 11
+	if readn(sb, 4, e2_sbrev) != 0 {
+		e.isz = readn(sb, 2, e2_sbisz)
+		e.firstino = readn(sb, 4, e2_sbfirstino)
+		incompat := readn(sb, 4, e2_sbincompat)
+		if incompat &^ e2_filetype != 0 {
+			return -EINVAL
+		}
+		e.filetype = incompat & e2_filetype != 0
+		// features we don't know may be changed by writes
+		rocompat := readn(sb, 4, e2_sbrocompat)
+		if rocompat &^ (e2_sparse | e2_largefile) != 0 && !e.rdonly {
+			return -EROFS
+		}
+	}
+	if e.bpg <= 0 || e.bpg > e.bsz*8 || e.ipg <= 0 ||
+	    e.ipg > e.bsz*8 || e.isz < 128 || e.isz > e.bsz ||
+	    e.isz & (e.isz - 1) != 0 || e.firstdata >= e.nblocks ||
+	    e.nblocks*e.spb > e.dev.capacity() {
+		return -EINVAL
+	}
+	e.ngroups = roundup(e.nblocks - e.firstdata, e.bpg)/e.bpg
+	if e.ngroups*e.ipg < e.ninodes || e.firstino <= e2_rootino ||
+	    e.firstino > e.ninodes {
+		return -EINVAL
+	}
+	e.gdblk = e.firstdata + 1
+	gdblks := roundup(e.ngroups*e2_gdsize, e.bsz)/e.bsz
+	for i := 0; i < gdblks; i++ {
+		b, err := e.bread(e.gdblk + i)
+		if err != 0 {
+			return err
+		}
+		e.gd = append(e.gd, b...)
+	}
+	e.sb = sb
+	if !e.rdonly {
+		// marked clean again by unmount
+		e.sbset(e2_sbstate, 2, e.sbget(e2_sbstate, 2) &^ e2_valid)
+		if err := e.flush(); err != 0 {
+			return err
+		}
+	}
+	return 0
+}
+
+func (e *ext2_t) sbget(off int, n int) int {
+	return readn(e.sb, n, off)
+}
+
+func (e *ext2_t) sbset(off int, n int, v int) {
+	writen(e.sb, n, off, v)
+	e.dirty = true
+}
+
+func (e *ext2_t) gdget(g int, off int, n int) int {
+	return readn(e.gd, n, g*e2_gdsize + off)
+}
+
+func (e *ext2_t) gdset(g int, off int, n int, v int) {
+	writen(e.gd, n, g*e2_gdsize + off, v)
+	e.dirty = true
+}
+
+// writes the superblock and group descriptors if they changed
+func (e *ext2_t) flush() int {
+	if !e.dirty {
+		return 0
+	}
+	bufs := []*diskbuf_t{{block: 2}, {block: 3}}
+	copy(bufs[0].data[:], e.sb[:512])
+	copy(bufs[1].data[:], e.sb[512:])
+	if err := bdev_write(e.dev, bufs); err != 0 {
+		return err
+	}
+	for i := 0; i*e.bsz < len(e.gd); i++ {
+		err := e.bwrite(e.gdblk + i, e.gd[i*e.bsz:(i + 1)*e.bsz])
+		if err != 0 {
+			return err
+		}
+	}
+	e.dirty = false
+	return 0
+}
+
+func (e *ext2_t) bread(bn int) ([]uint8, int) {
+	if bn <= 0 || bn >= e.nblocks {
+		return nil, -EIO
+	}
+	bufs := make([]*diskbuf_t, e.spb)
+	for i := range bufs {
+		bufs[i] = &diskbuf_t{block: int32(bn*e.spb + i)}
+	}
+	if err := bdev_read(e.dev, bufs); err != 0 {
+		return nil, err
+	}
+	ret := make([]uint8, 0, e.bsz)
+	for _, b := range bufs {
+		ret = append(ret, b.data[:]...)
+	}
+	return ret, 0
+}
+
+func (e *ext2_t) bwrite(bn int, data []uint8) int {
+	if bn <= 0 || bn >= e.nblocks {
+		return -EIO
+	}
+	bufs := make([]*diskbuf_t, e.spb)
+	for i := range bufs {
+		bufs[i] = &diskbuf_t{block: int32(bn*e.spb + i)}
+		copy(bufs[i].data[:], data[i*512:])
+	}
+	return bdev_write(e.dev, bufs)
+}
+
+// returns the block and offset of inode ino
+func (e *ext2_t) iloc(ino int) (int, int, int) {
+	if ino < 1 || ino > e.ninodes {
+		return 0, 0, -EIO
+	}
+	g := (ino - 1)/e.ipg
+	off := (ino - 1) % e.ipg*e.isz
+	return e.gdget(g, e2_gditable, 4) + off/e.bsz, off % e.bsz, 0
+}
+
+func (e *ext2_t) iget(ino int) (*e2inode_t, int) {
+	bn, off, err := e.iloc(ino)
+	if err != 0 {
+		return nil, err
+	}
+	b, err := e.bread(bn)
+	if err != 0 {
+		return nil, err
+	}
+	r := b[off:off + e.isz]
+	in := &e2inode_t{ino: ino}
+	in.mode = readn(r, 2, e2_imode)
+	in.links = readn(r, 2, e2_ilinks)
+	in.size = readn(r, 4, e2_isize)
+	if in.mode & e2_ifmt == S_IFREG {
+		in.size |= readn(r, 4, e2_isizehi) << 32
+	}
+	in.blocks = readn(r, 4, e2_iblocks)
+	in.flags = readn(r, 4, e2_iflags)
+	in.mtime = readn(r, 4, e2_imtime)
+	in.dtime = readn(r, 4, e2_idtime)
+	for i := range in.block {
+		in.block[i] = readn(r, 4, e2_iblock + 4*i)
+	}
+	return in, 0
+}
+
+func (e *ext2_t) iput(in *e2inode_t) int {
+	bn, off, err := e.iloc(in.ino)
+	if err != 0 {
+		return err
+	}
+	b, err := e.bread(bn)
+	if err != 0 {
+		return err
+	}
+	r := b[off:off + e.isz]
+	writen(r, 2, e2_imode, in.mode)
+	writen(r, 2, e2_ilinks, in.links)
+	writen(r, 4, e2_isize, in.size & 0xffffffff)
+	if in.mode & e2_ifmt == S_IFREG {
+		writen(r, 4, e2_isizehi, in.size >> 32)
+	}
+	writen(r, 4, e2_iblocks, in.blocks)
+	writen(r, 4, e2_iflags, in.flags)
+	writen(r, 4, e2_imtime, in.mtime)
+	writen(r, 4, e2_ictime, in.mtime)
+	writen(r, 4, e2_idtime, in.dtime)
+	for i := range in.block {
+		writen(r, 4, e2_iblock + 4*i, in.block[i])
+	}
+	return e.bwrite(bn, b)
+}
+
+// finds a clear bit in the bitmap of one of the groups that have free
+// entries according to freeoff, starting with group first. bits returns the
+// range of usable bits of a group. the bit is set and its group and index
+// returned.
+func (e *ext2_t) bitalloc(first int, bmoff int, freeoff int,
+    bits func(int) (int, int)) (int, int, int) {
+	for i := 0; i < e.ngroups; i++ {
+		g := (first + i) % e.ngroups
+		if e.gdget(g, freeoff, 2) == 0 {
+			continue
+		}
+		bmbn := e.gdget(g, bmoff, 4)
+		bm, err := e.bread(bmbn)
+		if err != 0 {
+			return 0, 0, err
+		}
+		start, end := bits(g)
+		for j := start; j < end; j++ {
+			if bm[j/8] & (1 << uint(j % 8)) != 0 {
+				continue
+			}
+			bm[j/8] |= 1 << uint(j % 8)
+			if err := e.bwrite(bmbn, bm); err != 0 {
+				return 0, 0, err
+			}
+			e.gdset(g, freeoff, 2, e.gdget(g, freeoff, 2) - 1)
+			return g, j, 0
+		}
+	}
+	return 0, 0, -ENOSPC
+}
+
+// clears bit j of group g's bitmap
+func (e *ext2_t) bitfree(g int, j int, bmoff int, freeoff int) int {
+	bmbn := e.gdget(g, bmoff, 4)
+	bm, err := e.bread(bmbn)
+	if err != 0 {
+		return err
+	}
+	if bm[j/8] & (1 << uint(j % 8)) == 0 {
+		return -EIO
+	}
+	bm[j/8] &^= 1 << uint(j % 8)
+	if err := e.bwrite(bmbn, bm); err != 0 {
+		return err
+	}
+	e.gdset(g, freeoff, 2, e.gdget(g, freeoff, 2) + 1)
+	return 0
+}
+
+// allocates a block for in, preferably in the group of its inode. indirect
+// blocks are zeroed; data blocks are left for the caller to fill.
+func (e *ext2_t) balloc(in *e2inode_t, zero bool) (int, int) {
+	bits := func(g int) (int, int) {
+		left := e.nblocks - e.firstdata - g*e.bpg
+		if left > e.bpg {
+			return 0, e.bpg
+		}
+		return 0, left
+	}
+	g, j, err := e.bitalloc((in.ino - 1)/e.ipg, e2_gdbbitmap,
+	    e2_gdfreeblks, bits)
+	if err != 0 {
+		return 0, err
+	}
+	e.sbset(e2_sbfreeblks, 4, e.sbget(e2_sbfreeblks, 4) - 1)
+	bn := e.firstdata + g*e.bpg + j
+	if zero {
+		if err := e.bwrite(bn, make([]uint8, e.bsz)); err != 0 {
+			return 0, err
+		}
+	}
+	in.blocks += e.spb
+	return bn, 0
+}
+
+func (e *ext2_t) bfree(in *e2inode_t, bn int) int {
+	if bn < e.firstdata || bn >= e.nblocks {
+		return -EIO
+	}
+	b := bn - e.firstdata
+	err := e.bitfree(b/e.bpg, b % e.bpg, e2_gdbbitmap, e2_gdfreeblks)
+	if err != 0 {
+		return err
+	}
+	e.sbset(e2_sbfreeblks, 4, e.sbget(e2_sbfreeblks, 4) + 1)
+	in.blocks -= e.spb
+	return 0
+}
+
+// allocates a zeroed inode, preferably in the group of the inode of its
+// directory
+func (e *ext2_t) ialloc(dir *e2inode_t, mode int) (*e2inode_t, int) {
+	// skip the reserved inodes
+	bits := func(g int) (int, int) {
+		start := e.firstino - 1 - g*e.ipg
+		if start < 0 {
+			start = 0
+		}
+		left := e.ninodes - g*e.ipg
+		if left > e.ipg {
+			return start, e.ipg
+		}
+		return start, left
+	}
+	g, j, err := e.bitalloc((dir.ino - 1)/e.ipg, e2_gdibitmap,
+	    e2_gdfreeinos, bits)
+	if err != 0 {
+		return nil, err
+	}
+	e.sbset(e2_sbfreeinos, 4, e.sbget(e2_sbfreeinos, 4) - 1)
+	if mode & e2_ifmt == S_IFDIR {
+		e.gdset(g, e2_gdndirs, 2, e.gdget(g, e2_gdndirs, 2) + 1)
+	}
+	in := &e2inode_t{ino: g*e.ipg + j + 1, mode: mode, mtime: ext2_now()}
+	bn, off, err := e.iloc(in.ino)
+	if err != 0 {
+		return nil, err
+	}
+	b, err := e.bread(bn)
+	if err != 0 {
+		return nil, err
+	}
+	r := b[off:off + e.isz]
+	for i := range r {
+		r[i] = 0
+	}
+	writen(r, 4, e2_iatime, in.mtime)
+	if err := e.bwrite(bn, b); err != 0 {
+		return nil, err
+	}
+	return in, e.iput(in)
+}
+
+// frees the data and the inode of in, which has no links
+func (e *ext2_t) reclaim(in *e2inode_t) int {
+	if e.hasblocks(in) {
+		if err := e.itrunc(in, 0); err != 0 {
+			return err
+		}
+	}
+	return e.ifree(in)
+}
+
+// frees in, whose data must have been freed
+func (e *ext2_t) ifree(in *e2inode_t) int {
+	in.links = 0
+	in.dtime = ext2_now()
+	if in.dtime == 0 {
+		in.dtime = 1
+	}
+	if err := e.iput(in); err != 0 {
+		return err
+	}
+	i := in.ino - 1
+	err := e.bitfree(i/e.ipg, i % e.ipg, e2_gdibitmap, e2_gdfreeinos)
+	if err != 0 {
+		return err
+	}
+	e.sbset(e2_sbfreeinos, 4, e.sbget(e2_sbfreeinos, 4) + 1)
+	if in.mode & e2_ifmt == S_IFDIR {
+		g := i/e.ipg
+		e.gdset(g, e2_gdndirs, 2, e.gdget(g, e2_gdndirs, 2) - 1)
+	}
+	return 0
+}
+
+// returns the number of blocks mapped by an indirect block at level
+func (e *ext2_t) span(level int) int {
+	ret := 1
+	for i := 0; i < level; i++ {
+		ret *= e.bsz/4
+	}
+	return ret
+}
+
+// returns the block holding block lbn of in, or 0 for a hole. if alloc is
+// set, holes are filled; in must then be written by the caller.
+func (e *ext2_t) bmap(in *e2inode_t, lbn int, alloc bool) (int, int) {
+	if lbn < e2_ndirect {
+		if in.block[lbn] == 0 && alloc {
+			bn, err := e.balloc(in, false)
+			if err != 0 {
+				return 0, err
+			}
+			in.block[lbn] = bn
+		}
+		return in.block[lbn], 0
+	}
+	lbn -= e2_ndirect
+	for level := 1; level <= 3; level++ {
+		if lbn >= e.span(level) {
+			lbn -= e.span(level)
+			continue
+		}
+		slot := &in.block[e2_ndirect + level - 1]
+		if *slot == 0 {
+			if !alloc {
+				return 0, 0
+			}
+			bn, err := e.balloc(in, true)
+			if err != 0 {
+				return 0, err
+			}
+			*slot = bn
+		}
+		bn := *slot
+		for ; level > 0; level-- {
+			b, err := e.bread(bn)
+			if err != 0 {
+				return 0, err
+			}
+			i := lbn/e.span(level - 1)
+			lbn %= e.span(level - 1)
+			next := readn(b, 4, 4*i)
+			if next == 0 {
+				if !alloc {
+					return 0, 0
+				}
+				next, err = e.balloc(in, level > 1)
+				if err != 0 {
+					return 0, err
+				}
+				writen(b, 4, 4*i, next)
+				if err := e.bwrite(bn, b); err != 0 {
+					return 0, err
+				}
+			}
+			bn = next
+		}
+		return bn, 0
+	}
+	return 0, -EFBIG
+}
+
+// frees the blocks under bn, a block at level that maps blocks of the file
+// from its index from on; level 0 is a data block. returns whether bn was
+// freed too.
+func (e *ext2_t) freetree(in *e2inode_t, bn int, level int,
+    from int) (bool, int) {
+	if level > 0 {
+		b, err := e.bread(bn)
+		if err != 0 {
+			return false, err
+		}
+		span := e.span(level - 1)
+		for i := from/span; i < e.bsz/4; i++ {
+			child := readn(b, 4, 4*i)
+			if child == 0 {
+				continue
+			}
+			cfrom := 0
+			if i == from/span {
+				cfrom = from % span
+			}
+			freed, err := e.freetree(in, child, level - 1, cfrom)
+			if err != 0 {
+				return false, err
+			}
+			if freed {
+				writen(b, 4, 4*i, 0)
+			}
+		}
+		if from != 0 {
+			return false, e.bwrite(bn, b)
+		}
+	}
+	return true, e.bfree(in, bn)
+}
+
+// the blocks of symbolic links shorter than 60 bytes and of device files
+// hold no block numbers
+func (e *ext2_t) hasblocks(in *e2inode_t) bool {
+	switch in.mode & e2_ifmt {
+	case S_IFREG, S_IFDIR:
+		return true
+	case e2_iflnk:
+		return in.blocks != 0
+	}
+	return false
+}
+
+// frees the blocks of in past newlen bytes and sets its size; in must then be
+// written by the caller
+func (e *ext2_t) itrunc(in *e2inode_t, newlen int) int {
+	if !e.hasblocks(in) {
+		return -EINVAL
+	}
+	if newlen < in.size {
+		nb := roundup(newlen, e.bsz)/e.bsz
+		for i := nb; i < e2_ndirect; i++ {
+			if in.block[i] != 0 {
+				if err := e.bfree(in, in.block[i]); err != 0 {
+					return err
+				}
+				in.block[i] = 0
+			}
+		}
+		base := e2_ndirect
+		for level := 1; level <= 3; level++ {
+			slot := &in.block[e2_ndirect + level - 1]
+			if *slot != 0 && nb < base + e.span(level) {
+				from := 0
+				if nb > base {
+					from = nb - base
+				}
+				freed, err := e.freetree(in, *slot, level, from)
+				if err != 0 {
+					return err
+				}
+				if freed {
+					*slot = 0
+				}
+			}
+			base += e.span(level)
+		}
+		// zero the rest of the last block so that growing the file
+		// again reads zeros
+		if boff := newlen % e.bsz; boff != 0 {
+			bn, err := e.bmap(in, newlen/e.bsz, false)
+			if err != 0 {
+				return err
+			}
+			if bn != 0 {
+				b, err := e.bread(bn)
+				if err != 0 {
+					return err
+				}
+				for i := boff; i < e.bsz; i++ {
+					b[i] = 0
+				}
+				if err := e.bwrite(bn, b); err != 0 {
+					return err
+				}
+			}
+		}
+	}
+	// growing leaves a hole
+	in.size = newlen
+	in.mtime = ext2_now()
+	return 0
+}
+
+// calls f on each entry of directory d, with the entry's block, the block's
+// number, the entry's offset, and the previous entry's offset, or -1 for the
+// first. stops when f returns true.
+func (e *ext2_t) diriter(d *e2inode_t, f func([]uint8, int, int,
+    int) bool) int {
+	for lbn := 0; lbn < d.size/e.bsz; lbn++ {
+		bn, err := e.bmap(d, lbn, false)
+		if err != 0 {
+			return err
+		}
+		if bn == 0 {
+			return -EIO
+		}
+		b, err := e.bread(bn)
+		if err != 0 {
+			return err
+		}
+		prev := -1
+		for off := 0; off < e.bsz; {
+			rl := readn(b, 2, off + e2_dereclen)
+			nl := int(b[off + e2_denamelen])
+			if rl < e2_dename || rl % 4 != 0 || off + rl > e.bsz ||
+			    e2_dename + nl > rl {
+				return -EIO
+			}
+			if f(b, bn, off, prev) {
+				return 0
+			}
+			prev = off
+			off += rl
+		}
+	}
+	return 0
+}
+
+func e2_name(b []uint8, off int) string {
+	nl := int(b[off + e2_denamelen])
+	return string(b[off + e2_dename:off + e2_dename + nl])
+}
+
+// returns the inode number of name in d, or 0 if there is none
+func (e *ext2_t) lookup(d *e2inode_t, name string) (int, int) {
+	ret := 0
+	err := e.diriter(d, func(b []uint8, bn, off, prev int) bool {
+		ino := readn(b, 4, off + e2_deino)
+		if ino != 0 && e2_name(b, off) == name {
+			ret = ino
+			return true
+		}
+		return false
+	})
+	return ret, err
+}
+
+// returns the names in d besides "." and ".."
+func (e *ext2_t) ls(d *e2inode_t) ([]string, int) {
+	var ret []string
+	err := e.diriter(d, func(b []uint8, bn, off, prev int) bool {
+		name := e2_name(b, off)
+		if readn(b, 4, off + e2_deino) != 0 && name != "." &&
+		    name != ".." {
+			ret = append(ret, name)
+		}
+		return false
+	})
+	return ret, err
+}
+
+// returns the type of in for directory entries
+func (e *ext2_t) detype(in *e2inode_t) uint8 {
+	if !e.filetype {
+		return 0
+	}
+	switch in.mode & e2_ifmt {
+	case S_IFREG:
+		return 1
+	case S_IFDIR:
+		return 2
+	case S_IFCHR:
+		return 3
+	case e2_iflnk:
+		return 7
+	}
+	return 0
+}
+
+func e2_deput(b []uint8, off int, rl int, name string, ino int, typ uint8) {
+	writen(b, 4, off + e2_deino, ino)
+	writen(b, 2, off + e2_dereclen, rl)
+	b[off + e2_denamelen] = uint8(len(name))
+	b[off + e2_detype] = typ
+	copy(b[off + e2_dename:], name)
+}
+
+// adds an entry for in named name to d, taking an unused entry, the slack
+// after an entry, or a new block
+func (e *ext2_t) addent(d *e2inode_t, name string, in *e2inode_t) int {
+	if len(name) > e2_maxname {
+		return -ENAMETOOLONG
+	}
+	need := roundup(e2_dename + len(name), 4)
+	typ := e.detype(in)
+	done := false
+	var werr int
+	err := e.diriter(d, func(b []uint8, bn, off, prev int) bool {
+		rl := readn(b, 2, off + e2_dereclen)
+		used := 0
+		if readn(b, 4, off + e2_deino) != 0 {
+			used = roundup(e2_dename + int(b[off + e2_denamelen]), 4)
+		}
+		if rl - used < need {
+			return false
+		}
+		if used != 0 {
+			writen(b, 2, off + e2_dereclen, used)
+		}
+		e2_deput(b, off + used, rl - used, name, in.ino, typ)
+		werr = e.bwrite(bn, b)
+		done = true
+		return true
+	})
+	if err != 0 {
+		return err
+	}
+	if werr != 0 {
+		return werr
+	}
+	if !done {
+		bn, err := e.bmap(d, d.size/e.bsz, true)
+		if err != 0 {
+			return err
+		}
+		b := make([]uint8, e.bsz)
+		e2_deput(b, 0, e.bsz, name, in.ino, typ)
+		if err := e.bwrite(bn, b); err != 0 {
+			return err
+		}
+		d.size += e.bsz
+	}
+	d.flags &^= e2_indexfl
+	d.mtime = ext2_now()
+	return e.iput(d)
+}
+
+// removes the entry named name from d, merging it into the entry before it
+func (e *ext2_t) rment(d *e2inode_t, name string) int {
+	found := false
+	var werr int
+	err := e.diriter(d, func(b []uint8, bn, off, prev int) bool {
+		if readn(b, 4, off + e2_deino) == 0 || e2_name(b, off) != name {
+			return false
+		}
+		if prev == -1 {
+			writen(b, 4, off + e2_deino, 0)
+		} else {
+			rl := readn(b, 2, prev + e2_dereclen) +
+			    readn(b, 2, off + e2_dereclen)
+			writen(b, 2, prev + e2_dereclen, rl)
+		}
+		werr = e.bwrite(bn, b)
+		found = true
+		return true
+	})
+	if err != 0 {
+		return err
+	}
+	if werr != 0 {
+		return werr
+	}
+	if !found {
+		return -ENOENT
+	}
+	d.flags &^= e2_indexfl
+	d.mtime = ext2_now()
+	return e.iput(d)
+}
+
+// returns the inode at path
+func (e *ext2_t) walk(path []string) (*e2inode_t, int) {
+	in, err := e.iget(e2_rootino)
+	if err != 0 {
+		return nil, err
+	}
+	for _, name := range path {
+		if in.mode & e2_ifmt != S_IFDIR {
+			return nil, -ENOTDIR
+		}
+		ino, err := e.lookup(in, name)
+		if err != 0 {
+			return nil, err
+		}
+		if ino == 0 {
+			return nil, -ENOENT
+		}
+		if in, err = e.iget(ino); err != 0 {
+			return nil, err
+		}
+	}
+	return in, 0
+}
+
+// returns the directory holding the last element of path
+func (e *ext2_t) parent(path []string) (*e2inode_t, string, int) {
+	l := len(path) - 1
+	dir, err := e.walk(path[:l])
+	if err != 0 {
+		return nil, "", err
+	}
+	if dir.mode & e2_ifmt != S_IFDIR {
+		return nil, "", -ENOTDIR
+	}
+	return dir, path[l], 0
+}
+
+// makes a new inode named by path, which must not exist
+func (e *ext2_t) create(path []string, mode int) (*e2inode_t, *e2inode_t,
+    int) {
+	if e.rdonly {
+		return nil, nil, -EROFS
+	}
+	dir, name, err := e.parent(path)
+	if err != 0 {
+		return nil, nil, err
+	}
+	if len(name) > e2_maxname {
+		return nil, nil, -ENAMETOOLONG
+	}
+	ino, err := e.lookup(dir, name)
+	if err != 0 {
+		return nil, nil, err
+	}
+	if ino != 0 {
+		return nil, nil, -EEXIST
+	}
+	in, err := e.ialloc(dir, mode)
+	if err != 0 {
+		return nil, nil, err
+	}
+	in.links = 1
+	return in, dir, e.iput(in)
+}
+
+func (e *ext2_t) open(path []string, flags int, mode int) (fops_t, int) {
+	e.Lock()
+	defer e.Unlock()
+	if flags & O_CREAT != 0 && len(path) != 0 {
+		perm := mode & 0777
+		if perm == 0 {
+			perm = 0644
+		}
+		in, dir, err := e.create(path, S_IFREG | perm)
+		if err != 0 {
+			return nil, err
+		}
+		if err := e.addent(dir, path[len(path) - 1], in); err != 0 {
+			e.ifree(in)
+			return nil, err
+		}
+		e.opens[in.ino]++
+		return &e2file_t{fs: e, ino: in.ino}, 0
+	}
+	in, err := e.walk(path)
+	if err != 0 {
+		return nil, err
+	}
+	switch in.mode & e2_ifmt {
+	case S_IFREG:
+		e.opens[in.ino]++
+		return &e2file_t{fs: e, ino: in.ino}, 0
+	case S_IFDIR:
+		names, err := e.ls(in)
+		if err != 0 {
+			return nil, err
+		}
+		e.opens[in.ino]++
+		return &e2file_t{fs: e, ino: in.ino, dir: true,
+		    names: procfs_ls(names)}, 0
+	case S_IFCHR:
+		major, minor := e2_devnum(in)
+		df, err := devfile_new(major, minor, in.ino)
+		if err != 0 {
+			return nil, err
+		}
+		return df, 0
+	}
+	// symbolic links and other special files
+	return nil, -EINVAL
+}
+
+// returns the device of a device file. small numbers are in the first block
+// slot in the old format and large ones in the second.
+func e2_devnum(in *e2inode_t) (int, int) {
+	if d := in.block[0]; d != 0 {
+		return d >> 8 & 0xff, d & 0xff
+	}
+	d := in.block[1]
+	return d >> 8 & 0xfff, d & 0xff | d >> 12 & 0xfff00
+}
+
+func (e *ext2_t) mkdir(path []string, mode int) int {
+	e.Lock()
+	defer e.Unlock()
+	perm := mode & 0777
+	if perm == 0 {
+		perm = 0755
+	}
+	in, dir, err := e.create(path, S_IFDIR | perm)
+	if err != 0 {
+		return err
+	}
+	bn, err := e.bmap(in, 0, true)
+	if err != 0 {
+		e.ifree(in)
+		return err
+	}
+	// the new directory is freed if it cannot be finished
+	in.size = e.bsz
+	b := make([]uint8, e.bsz)
+	e2_deput(b, 0, 12, ".", in.ino, e.detype(in))
+	e2_deput(b, 12, e.bsz - 12, "..", dir.ino, e.detype(dir))
+	if err := e.bwrite(bn, b); err != 0 {
+		e.reclaim(in)
+		return err
+	}
+	in.links = 2
+	if err := e.iput(in); err != 0 {
+		e.reclaim(in)
+		return err
+	}
+	// addent writes dir with the link of the new directory's ".."
+	dir.links++
+	if err := e.addent(dir, path[len(path) - 1], in); err != 0 {
+		dir.links--
+		e.reclaim(in)
+		return err
+	}
+	return 0
+}
+
+func (e *ext2_t) mknod(path []string, major int, minor int) int {
+	e.Lock()
+	defer e.Unlock()
+	in, dir, err := e.create(path, S_IFCHR | 0644)
+	if err != 0 {
+		return err
+	}
+	if major < 256 && minor < 256 {
+		in.block[0] = major << 8 | minor
+	} else {
+		in.block[1] = minor & 0xff | major << 8 | (minor &^ 0xff) << 12
+	}
+	if err := e.iput(in); err != 0 {
+		return err
+	}
+	return e.addent(dir, path[len(path) - 1], in)
+}
+
+func (e *ext2_t) link(oldp []string, newp []string) int {
+	e.Lock()
+	defer e.Unlock()
+	if e.rdonly {
+		return -EROFS
+	}
+	in, err := e.walk(oldp)
+	if err != 0 {
+		return err
+	}
+	// no hard links on directories
+	if in.mode & e2_ifmt == S_IFDIR {
+		return -EPERM
+	}
+	dir, name, err := e.parent(newp)
+	if err != 0 {
+		return err
+	}
+	ino, err := e.lookup(dir, name)
+	if err != 0 {
+		return err
+	}
+	if ino != 0 {
+		return -EEXIST
+	}
+	in.links++
+	if err := e.iput(in); err != 0 {
+		return err
+	}
+	return e.addent(dir, name, in)
+}
+
+// an unlinked file that is open is freed once its last open file is closed.
+// one still open when the file system is forcibly unmounted is left for fsck.
+func (e *ext2_t) unlink(path []string) int {
+	e.Lock()
+	defer e.Unlock()
+	if e.rdonly {
+		return -EROFS
+	}
+	dir, name, err := e.parent(path)
+	if err != 0 {
+		return err
+	}
+	ino, err := e.lookup(dir, name)
+	if err != 0 {
+		return err
+	}
+	if ino == 0 {
+		return -ENOENT
+	}
+	in, err := e.iget(ino)
+	if err != 0 {
+		return err
+	}
+	isdir := in.mode & e2_ifmt == S_IFDIR
+	if isdir {
+		names, err := e.ls(in)
+		if err != 0 {
+			return err
+		}
+		if len(names) != 0 {
+			return -ENOTEMPTY
+		}
+		// the entry in its parent and its "."
+		in.links = 0
+		dir.links--
+	} else {
+		in.links--
+	}
+	if err := e.rment(dir, name); err != 0 {
+		return err
+	}
+	if in.links > 0 || e.opens[in.ino] > 0 {
+		return e.iput(in)
+	}
+	return e.reclaim(in)
+}
+
+func (e *ext2_t) sync() int {
+	e.Lock()
+	defer e.Unlock()
+	if err := e.flush(); err != 0 {
+		return err
+	}
+	return bdev_flush(e.dev)
+}
+
+func (e *ext2_t) unmount() int {
+	e.Lock()
+	defer e.Unlock()
+	if e.rdonly {
+		return 0
+	}
+	e.sbset(e2_sbstate, 2, e.sbget(e2_sbstate, 2) | e2_valid)
+	if err := e.flush(); err != 0 {
+		return err
+	}
+	return bdev_flush(e.dev)
+}
+
+// an open file or directory. the inode is read again by every operation, since
+// other opens of the file may change it.
+type e2file_t struct {
+	fs	*ext2_t
+	ino	int
+	dir	bool
+	// a directory's listing
+	names	[]uint8
+}
+
+func (f *e2file_t) read(dsts [][]uint8, offset int) (int, int) {
+	if f.dir {
+		c := 0
+		for _, dst := range dsts {
+			if offset + c >= len(f.names) {
+				break
+			}
+			c += copy(dst, f.names[offset + c:])
+		}
+		return c, 0
+	}
+	e := f.fs
+	e.Lock()
+	defer e.Unlock()
+	in, err := e.iget(f.ino)
+	if err != 0 {
+		return 0, err
+	}
+	end := offset + bufs_len(dsts)
+	if end > in.size {
+		end = in.size
+	}
+	c := 0
+	for offset + c < end {
+		off := offset + c
+		boff := off % e.bsz
+		n := e.bsz - boff
+		if n > end - off {
+			n = end - off
+		}
+		bn, err := e.bmap(in, off/e.bsz, false)
+		if err != 0 {
+			return c, err
+		}
+		var b []uint8
+		if bn == 0 {
+			b = make([]uint8, e.bsz)
+		} else if b, err = e.bread(bn); err != 0 {
+			return c, err
+		}
+		bufs_put(dsts, c, b[boff:boff + n])
+		c += n
+	}
+	return c, 0
+}
+
+// a write that fails part way returns the number of bytes written along with
+// the error
+func (f *e2file_t) write(srcs [][]uint8, offset int, append bool) (int, int) {
+	if f.dir {
+		return 0, -EISDIR
+	}
+	e := f.fs
+	e.Lock()
+	defer e.Unlock()
+	if e.rdonly {
+		return 0, -EROFS
+	}
+	in, err := e.iget(f.ino)
+	if err != 0 {
+		return 0, err
+	}
+	if append {
+		offset = in.size
+	}
+	end := offset + bufs_len(srcs)
+	if end > 0x7fffffff && e.sbget(e2_sbrocompat, 4) & e2_largefile == 0 {
+		e.sbset(e2_sbrocompat, 4,
+		    e.sbget(e2_sbrocompat, 4) | e2_largefile)
+	}
+	c := 0
+	for offset + c < end {
+		off := offset + c
+		boff := off % e.bsz
+		n := e.bsz - boff
+		if n > end - off {
+			n = end - off
+		}
+		var bn int
+		bn, err = e.bmap(in, off/e.bsz, false)
+		if err != 0 {
+			break
+		}
+		var b []uint8
+		if bn == 0 {
+			// a new block has no old data to keep
+			if bn, err = e.bmap(in, off/e.bsz, true); err != 0 {
+				break
+			}
+			b = make([]uint8, e.bsz)
+		} else if n != e.bsz {
+			if b, err = e.bread(bn); err != 0 {
+				break
+			}
+		} else {
+			b = make([]uint8, e.bsz)
+		}
+		bufs_get(srcs, c, b[boff:boff + n])
+		if err = e.bwrite(bn, b); err != 0 {
+			break
+		}
+		c += n
+	}
+	if offset + c > in.size {
+		in.size = offset + c
+	}
+	in.mtime = ext2_now()
+	if ierr := e.iput(in); ierr != 0 && err == 0 {
+		err = ierr
+	}
+	return c, err
+}
+
+func (f *e2file_t) fsync() int {
+	return f.fs.sync()
+}
+
+func (f *e2file_t) truncate(newlen int) int {
+	if f.dir {
+		return -EISDIR
+	}
+	e := f.fs
+	e.Lock()
+	defer e.Unlock()
+	if e.rdonly {
+		return -EROFS
+	}
+	in, err := e.iget(f.ino)
+	if err != 0 {
+		return err
+	}
+	if err := e.itrunc(in, newlen); err != 0 {
+		return err
+	}
+	return e.iput(in)
+}
+
+func (f *e2file_t) stat(st *stat_t) int {
+	e := f.fs
+	e.Lock()
+	defer e.Unlock()
+	in, err := e.iget(f.ino)
+	if err != 0 {
+		return err
+	}
+	st.ino = in.ino
+	st.mode = in.mode
+	st.nlink = in.links
+	st.size = in.size
+	return 0
+}
+
+// frees the inode with its last open file if it was unlinked
+func (f *e2file_t) close() int {
+	e := f.fs
+	e.Lock()
+	defer e.Unlock()
+	e.opens[f.ino]--
+	if e.opens[f.ino] > 0 {
+		return 0
+	}
+	delete(e.opens, f.ino)
+	if e.rdonly {
+		return 0
+	}
+	in, err := e.iget(f.ino)
+	if err != 0 {
+		return err
+	}
+	if in.links > 0 {
+		return 0
+	}
+	return e.reclaim(in)
+}
@@ -0,0 +1,567 @@
+package main
+
+import "strings"
+import "sync"
+import "unicode/utf16"
+
+// a read-only driver for FAT12, FAT16, and FAT32 file systems, with long
+// file names. names are matched without regard to case, as on other systems.
+// directories read as the names of their entries, one per line, like those of
+// procfs.
+
+var fat_type	= fstype_t{name: "vfat", needdev: true, mount: fat_mount}
+
+const(
+	// BIOS parameter block fields
+	fat_bps		= 11
+	fat_spc		= 13
+	fat_rsvd	= 14
+	fat_nfats	= 16
+	fat_rootents	= 17
+	fat_totsec16	= 19
+	fat_fatsz16	= 22
+	fat_totsec32	= 32
+	fat_fatsz32	= 36
+	fat_rootclus	= 44
+
+	// directory entry fields
+	fat_desz	= 32
+	fat_deattr	= 11
+	fat_decase	= 12
+	fat_declushi	= 20
+	fat_declus	= 26
+	fat_desize	= 28
+
+	// directory entry attributes
+	fat_adir	= 0x10
+	fat_avol	= 0x08
+	fat_alfn	= 0x0f
+
+	// the FAT sectors kept in memory
+	fat_ncache	= 64
+)
+
+type fat_t struct {
+	dev	blockdev_t
+	// FAT12, FAT16, or FAT32
+	bits	int
+	// the size of a FAT sector in device sectors
+	dps	int
+	bps	int
+	spc	int
+	// the first FAT sector of the first FAT, the fixed root directory of
+	// FAT12 and FAT16, and the data area
+	fatsec	int
+	rootsec	int
+	datasec	int
+	rootents	int
+	// the root directory's first cluster on FAT32
+	rootclus	int
+	nclust	int
+	// recently read FAT sectors
+	sync.Mutex
+	cache	map[int][]uint8
+}
+
+// a file or directory
+type fnode_t struct {
+	dir	bool
+	first	int
+	size	int
+	ino	int
+}
+
+func fat_mount(dev blockdev_t, flags int, data string) (fs_t, int) {
+	if flags & MS_RDONLY == 0 {
+		return nil, -EROFS
+	}
+	if data != "" {
+		return nil, -EINVAL
+	}
+	if dev.sectsize() != 512 {
+		return nil, -EINVAL
+	}
+	f := &fat_t{dev: dev, cache: make(map[int][]uint8)}
+	if err := f.init(); err != 0 {
+		return nil, err
+	}
+	return f, 0
+}
+
+// reads the boot sector and checks its parameters
+func (f *fat_t) init() int {
+	b := &diskbuf_t{block: 0}
+	if err := bdev_read(f.dev, []*diskbuf_t{b}); err != 0 {
+		return err
+	}
+	bs := b.data[:]
+	if readn(bs, 2, mbr_sig) != 0xaa55 {
+		return -EINVAL
+	}
+	f.bps = readn(bs, 2, fat_bps)
+	f.spc = readn(bs, 1, fat_spc)
+	rsvd := readn(bs, 2, fat_rsvd)
+	nfats := readn(bs, 1, fat_nfats)
+	f.rootents = readn(bs, 2, fat_rootents)
+	totsec := readn(bs, 2, fat_totsec16)
+	if totsec == 0 {
+		totsec = readn(bs, 4, fat_totsec32)
+	}
+	fatsz := readn(bs, 2, fat_fatsz16)
+	if fatsz == 0 {
+		fatsz = readn(bs, 4, fat_fatsz32)
+	}
+	pow2 := func(n int) bool {
+		return n != 0 && n & (n - 1) == 0
+	}
+	if !pow2(f.bps) || f.bps < 512 || f.bps > 4096 || !pow2(f.spc) ||
+	    rsvd == 0 || nfats == 0 || fatsz == 0 {
+		return -EINVAL
+	}
+	f.dps = f.bps/512
+	rootsecs := roundup(f.rootents*fat_desz, f.bps)/f.bps
+	f.fatsec = rsvd
+	f.rootsec = rsvd + nfats*fatsz
+	f.datasec = f.rootsec + rootsecs
+	if totsec <= f.datasec || totsec*f.dps > f.dev.capacity() {
+		return -EINVAL
+	}
+	f.nclust = (totsec - f.datasec)/f.spc
+	switch {
+	case f.nclust < 4085:
+		f.bits = 12
+	case f.nclust < 65525:
+		f.bits = 16
+	default:
+		f.bits = 32
+		f.rootclus = readn(bs, 4, fat_rootclus)
+		if !f.clusok(f.rootclus) {
+			return -EINVAL
+		}
+	}
+	// the FAT must hold an entry for every cluster
+	if fatsz*f.bps*8/f.bits < f.nclust + 2 {
+		return -EINVAL
+	}
+	return 0
+}
+
+// reads n FAT sectors starting at sec
+func (f *fat_t) rd(sec int, n int) ([]uint8, int) {
+	bufs := make([]*diskbuf_t, n*f.dps)
+	for i := range bufs {
+		bufs[i] = &diskbuf_t{block: int32(sec*f.dps + i)}
+	}
+	if err := bdev_read(f.dev, bufs); err != 0 {
+		return nil, err
+	}
+	ret := make([]uint8, 0, len(bufs)*512)
+	for _, b := range bufs {
+		ret = append(ret, b.data[:]...)
+	}
+	return ret, 0
+}
+
+// returns FAT sector sec of the first FAT
+func (f *fat_t) fatrd(sec int) ([]uint8, int) {
+	f.Lock()
+	defer f.Unlock()
+	if b, ok := f.cache[sec]; ok {
+		return b, 0
+	}
+	b, err := f.rd(f.fatsec + sec, 1)
+	if err != 0 {
+		return nil, err
+	}
+	if len(f.cache) >= fat_ncache {
+		f.cache = make(map[int][]uint8)
+	}
+	f.cache[sec] = b
+	return b, 0
+}
+
+func (f *fat_t) clusok(c int) bool {
+	return c >= 2 && c < f.nclust + 2
+}
+
+// returns the cluster following c in its chain, or 0 at the end of the chain
+func (f *fat_t) next(c int) (int, int) {
+	off := c*f.bits/8
+	sec := off/f.bps
+	b, err := f.fatrd(sec)
+	if err != 0 {
+		return 0, err
+	}
+	i := off % f.bps
+	var v, eoc int
+	switch f.bits {
+	case 12:
+		// an entry may straddle two sectors
+		lo := int(b[i])
+		var hi int
+		if i + 1 < f.bps {
+			hi = int(b[i + 1])
+		} else {
+			b2, err := f.fatrd(sec + 1)
+			if err != 0 {
+				return 0, err
+			}
+			hi = int(b2[0])
+		}
+		v = lo | hi << 8
+		if c & 1 != 0 {
+			v >>= 4
+		}
+		v &= 0xfff
+		eoc = 0xff8
+	case 16:
+		v = readn(b, 2, i)
+		eoc = 0xfff8
+	case 32:
+		v = readn(b, 4, i) & 0x0fffffff
+		eoc = 0x0ffffff8
+	}
+	if v >= eoc {
+		return 0, 0
+	}
+	// free, bad, or reserved clusters in a chain mean the FAT is corrupt
+	if !f.clusok(v) {
+		return 0, -EIO
+	}
+	return v, 0
+}
+
+// returns the clusters of the chain starting at first
+func (f *fat_t) chain(first int) ([]int, int) {
+	if first == 0 {
+		return nil, 0
+	}
+	if !f.clusok(first) {
+		return nil, -EIO
+	}
+	ret := []int{first}
+	for {
+		n, err := f.next(ret[len(ret) - 1])
+		if err != 0 {
+			return nil, err
+		}
+		if n == 0 {
+			return ret, 0
+		}
+		// a chain longer than the file system has a loop
+		if len(ret) > f.nclust {
+			return nil, -EIO
+		}
+		ret = append(ret, n)
+	}
+}
+
+// returns the first FAT sector of cluster c
+func (f *fat_t) clussec(c int) int {
+	return f.datasec + (c - 2)*f.spc
+}
+
+// returns the raw entries of directory n and the inode number of its first
+// entry, which is the entry's position on disk in entries
+func (f *fat_t) dirdata(n *fnode_t) ([]uint8, []int, int) {
+	var ret []uint8
+	var inos []int
+	if n.first == 0 && n.ino != 1 {
+		return nil, nil, -EIO
+	}
+	if n.first == 0 {
+		// the fixed root directory of FAT12 and FAT16
+		secs := roundup(f.rootents*fat_desz, f.bps)/f.bps
+		b, err := f.rd(f.rootsec, secs)
+		if err != 0 {
+			return nil, nil, err
+		}
+		ret = b[:f.rootents*fat_desz]
+		for i := 0; i < f.rootents; i++ {
+			inos = append(inos, f.rootsec*f.bps/fat_desz + i)
+		}
+		return ret, inos, 0
+	}
+	cl, err := f.chain(n.first)
+	if err != 0 {
+		return nil, nil, err
+	}
+	for _, c := range cl {
+		b, err := f.rd(f.clussec(c), f.spc)
+		if err != 0 {
+			return nil, nil, err
+		}
+		ret = append(ret, b...)
+		for i := 0; i < len(b)/fat_desz; i++ {
+			inos = append(inos, f.clussec(c)*f.bps/fat_desz + i)
+		}
+	}
+	return ret, inos, 0
+}
+
+// returns the checksum of a short name stored in long name entries
+func fat_lfnsum(short []uint8) uint8 {
+	var s uint8
+	for _, c := range short[:11] {
+		s = (s >> 1 | s << 7) + c
+	}
+	return s
+}
+
+// returns the short name of an entry, using the lower case flags set by
+// Windows NT
+func fat_shortname(de []uint8) string {
+	base := strings.TrimRight(string(de[:8]), " ")
+	ext := strings.TrimRight(string(de[8:11]), " ")
+	// 0x05 stands for a leading 0xe5
+	if len(base) > 0 && base[0] == 0x05 {
+		base = "\xe5" + base[1:]
+	}
+	if de[fat_decase] & 0x08 != 0 {
+		base = strings.ToLower(base)
+	}
+	if de[fat_decase] & 0x10 != 0 {
+		ext = strings.ToLower(ext)
+	}
+	if ext == "" {
+		return base
+	}
+	return base + "." + ext
+}
+
+// a directory entry
+type fatent_t struct {
+	name	string
+	node	fnode_t
+}
+
+// returns the entries of directory n, without "." and ".."
+func (f *fat_t) readdir(n *fnode_t) ([]fatent_t, int) {
+	data, inos, err := f.dirdata(n)
+	if err != 0 {
+		return nil, err
+	}
+	var ret []fatent_t
+	// the long name being collected, whose pieces come in reverse order
+	var lfn []uint16
+	lfnsum := uint8(0)
+	lfnnext := 0
+	for i := 0; i + fat_desz <= len(data); i += fat_desz {
+		de := data[i:i + fat_desz]
+		if de[0] == 0 {
+			break
+		}
+		if de[0] == 0xe5 {
+			lfn = nil
+			continue
+		}
+		attr := de[fat_deattr]
+		if attr & 0x3f == fat_alfn {
+			ord := int(de[0] & 0x3f)
+			if de[0] & 0x40 != 0 {
+				lfn = make([]uint16, ord*13)
+				lfnsum = de[13]
+				lfnnext = ord
+			}
+			if lfn == nil || ord != lfnnext || ord == 0 ||
+			    de[13] != lfnsum {
+				lfn = nil
+				continue
+			}
+			lfnnext--
+			off := (ord - 1)*13
+			for j, p := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20,
+			    22, 24, 28, 30} {
+				lfn[off + j] = uint16(readn(de, 2, p))
+			}
+			continue
+		}
+		if attr & fat_avol != 0 {
+			lfn = nil
+			continue
+		}
+		name := fat_shortname(de)
+		if lfn != nil && lfnnext == 0 && fat_lfnsum(de) == lfnsum {
+			// the name ends at a 0 and is padded with 0xffff
+			l := 0
+			for l < len(lfn) && lfn[l] != 0 && lfn[l] != 0xffff {
+				l++
+			}
+			name = string(utf16.Decode(lfn[:l]))
+		}
+		lfn = nil
+		if name == "." || name == ".." {
+			continue
+		}
+		first := readn(de, 2, fat_declus)
+		if f.bits == 32 {
+			first |= readn(de, 2, fat_declushi) << 16
+		}
+		node := fnode_t{dir: attr & fat_adir != 0, first: first,
+		    size: readn(de, 4, fat_desize), ino: inos[i/fat_desz]}
+		ret = append(ret, fatent_t{name, node})
+	}
+	return ret, 0
+}
+
+func (f *fat_t) root() *fnode_t {
+	return &fnode_t{dir: true, first: f.rootclus, ino: 1}
+}
+
+func (f *fat_t) walk(path []string) (*fnode_t, int) {
+	n := f.root()
+	for _, name := range path {
+		if !n.dir {
+			return nil, -ENOTDIR
+		}
+		ents, err := f.readdir(n)
+		if err != 0 {
+			return nil, err
+		}
+		var next *fnode_t
+		for i := range ents {
+			if strings.EqualFold(ents[i].name, name) {
+				next = &ents[i].node
+				break
+			}
+		}
+		if next == nil {
+			return nil, -ENOENT
+		}
+		n = next
+	}
+	return n, 0
+}
+
+func (f *fat_t) open(path []string, flags int, mode int) (fops_t, int) {
+	if flags & (O_CREAT | O_WRONLY | O_RDWR) != 0 {
+		return nil, -EROFS
+	}
+	n, err := f.walk(path)
+	if err != 0 {
+		return nil, err
+	}
+	ret := &ffile_t{fs: f, n: n}
+	if n.dir {
+		ents, err := f.readdir(n)
+		if err != 0 {
+			return nil, err
+		}
+		names := make([]string, len(ents))
+		for i := range ents {
+			names[i] = ents[i].name
+		}
+		ret.ls = procfs_ls(names)
+		return ret, 0
+	}
+	ret.clus, err = f.chain(n.first)
+	if err != 0 {
+		return nil, err
+	}
+	// the chain must hold the whole file
+	csz := f.spc*f.bps
+	if len(ret.clus)*csz < n.size {
+		return nil, -EIO
+	}
+	return ret, 0
+}
+
+func (f *fat_t) mkdir(path []string, mode int) int {
+	return -EROFS
+}
+
+func (f *fat_t) mknod(path []string, major int, minor int) int {
+	return -EROFS
+}
+
+func (f *fat_t) link(oldp []string, newp []string) int {
+	return -EROFS
+}
+
+func (f *fat_t) unlink(path []string) int {
+	return -EROFS
+}
+
+func (f *fat_t) sync() int {
+	return 0
+}
+
+func (f *fat_t) unmount() int {
+	return 0
+}
+
+// an open file or directory
+type ffile_t struct {
+	fs	*fat_t
+	n	*fnode_t
+	// a file's clusters
+	clus	[]int
+	// a directory's listing
+	ls	[]uint8
+}
+
+func (ff *ffile_t) read(dsts [][]uint8, offset int) (int, int) {
+	if ff.n.dir {
+		c := 0
+		for _, dst := range dsts {
+			if offset + c >= len(ff.ls) {
+				break
+			}
+			c += copy(dst, ff.ls[offset + c:])
+		}
+		return c, 0
+	}
+	f := ff.fs
+	end := offset + bufs_len(dsts)
+	if end > ff.n.size {
+		end = ff.n.size
+	}
+	c := 0
+	for offset + c < end {
+		off := offset + c
+		// read the rest of the FAT sector holding off
+		sec := f.clussec(ff.clus[off/(f.spc*f.bps)]) +
+		    off % (f.spc*f.bps)/f.bps
+		b, err := f.rd(sec, 1)
+		if err != 0 {
+			return c, err
+		}
+		so := off % f.bps
+		n := f.bps - so
+		if n > end - off {
+			n = end - off
+		}
+		bufs_put(dsts, c, b[so:so + n])
+		c += n
+	}
+	return c, 0
+}
+
+func (ff *ffile_t) write(srcs [][]uint8, offset int, append bool) (int, int) {
+	return 0, -EROFS
+}
+
+func (ff *ffile_t) fsync() int {
+	return 0
+}
+
+func (ff *ffile_t) truncate(newlen int) int {
+	return -EROFS
+}
+
+func (ff *ffile_t) stat(st *stat_t) int {
+	st.ino = ff.n.ino
+	st.nlink = 1
+	if ff.n.dir {
+		st.mode = S_IFDIR
+		st.size = len(ff.ls)
+	} else {
+		st.mode = S_IFREG
+		st.size = ff.n.size
+	}
+	return 0
+}
+
+func (ff *ffile_t) close() int {
+	return 0
+}
@@ -0,0 +1,57 @@
+package fs
+
+// the interface between the file system and the rest of the kernel: the
+// device holding the file system, errnos, and byte helpers. the kernel
+// adapts its block devices to Disk_i; the tests use a disk in memory.
+
+type Diskbuf_t struct {
+	Block	int32
+	Data	[512]uint8
+}
+
+// a device of 512 byte sectors. the methods return 0 or a negative errno once
+// the request has finished and may be called concurrently.
+type Disk_i interface {
+	// reads a run of consecutive sectors starting at the block of the
+	// first buffer
+	Read(bufs []*Diskbuf_t) int
+	// writes bufs, which need not be consecutive
+	Write(bufs []*Diskbuf_t) int
+	// writes bufs to stable media without making earlier writes stable
+	Writefua(bufs []*Diskbuf_t) int
+	// makes the writes that finished before the call stable
+	Flush() int
+	// the number of sectors on the device
+	Capacity() int
+}
+
+// the errnos the file system returns; the same as the kernel's
+const(
+	EPERM		= 1
+	ENOENT		= 2
+	EIO		= 5
+	EEXIST		= 17
+	EFBIG		= 27
+	EISDIR		= 21
+	EROFS		= 30
+	ENOTEMPTY	= 39
+)
+
+func readn(a []uint8, n int, off int) int {
+	ret := 0
+	for i := 0; i < n; i++ {
+		ret |= int(a[off + i]) << (uint(i)*8)
+	}
+	return ret
+}
+
+func writen(a []uint8, n int, off int, val int) {
+	v := uint(val)
+	for i := 0; i < n; i++ {
+		a[off + i] = uint8((v >> (uint(i)*8)) & 0xff)
+	}
+}
+
+func roundup(v int, b int) int {
+	return (v + b - 1)/b*b
+}
@@ -0,0 +1,165 @@
+package fs
+
+import "os"
+import "sync"
+
+// the disks the tests run the file system on
+
+// a disk in memory
+type memdisk_t struct {
+	sync.Mutex
+	blks	[][512]uint8
+}
+
+func memdisk_new(nblks int) *memdisk_t {
+	return &memdisk_t{blks: make([][512]uint8, nblks)}
+}
+
+func (md *memdisk_t) inrange(bufs []*Diskbuf_t) bool {
+	for _, b := range bufs {
+		if b.Block < 0 || int(b.Block) >= len(md.blks) {
+			return false
+		}
+	}
+	return true
+}
+
+func (md *memdisk_t) Read(bufs []*Diskbuf_t) int {
+	md.Lock()
+	defer md.Unlock()
+	if !md.inrange(bufs) {
+		return -EIO
+	}
+	for _, b := range bufs {
+		b.Data = md.blks[b.Block]
+	}
+	return 0
+}
+
+func (md *memdisk_t) Write(bufs []*Diskbuf_t) int {
+	md.Lock()
+	defer md.Unlock()
+	if !md.inrange(bufs) {
+		return -EIO
+	}
+	for _, b := range bufs {
+		md.blks[b.Block] = b.Data
+	}
+	return 0
+}
+
+func (md *memdisk_t) Writefua(bufs []*Diskbuf_t) int {
+	return md.Write(bufs)
+}
+
+func (md *memdisk_t) Flush() int {
+	return 0
+}
+
+func (md *memdisk_t) Capacity() int {
+	return len(md.blks)
+}
+
+// a disk backed by a file, such as an image made by mkbdisk.py
+type filedisk_t struct {
+	f	*os.File
+	nblks	int
+}
+
+func filedisk_new(path string, nblks int) (*filedisk_t, error) {
+	f, err := os.OpenFile(path, os.O_RDWR | os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(int64(nblks)*512); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &filedisk_t{f: f, nblks: nblks}, nil
+}
+
+func (fd *filedisk_t) Read(bufs []*Diskbuf_t) int {
+	for _, b := range bufs {
+		_, err := fd.f.ReadAt(b.Data[:], int64(b.Block)*512)
+		if err != nil {
+			return -EIO
+		}
+	}
+	return 0
+}
+
+func (fd *filedisk_t) Write(bufs []*Diskbuf_t) int {
+	for _, b := range bufs {
+		_, err := fd.f.WriteAt(b.Data[:], int64(b.Block)*512)
+		if err != nil {
+			return -EIO
+		}
+	}
+	return 0
+}
+
+func (fd *filedisk_t) Writefua(bufs []*Diskbuf_t) int {
+	if err := fd.Write(bufs); err != 0 {
+		return err
+	}
+	return fd.Flush()
+}
+
+func (fd *filedisk_t) Flush() int {
+	if fd.f.Sync() != nil {
+		return -EIO
+	}
+	return 0
+}
+
+func (fd *filedisk_t) Capacity() int {
+	return fd.nblks
+}
+
+// makes an empty file system with a log of loglen blocks on d, which must be
+// zeroed, laid out like mkbdisk.py does: the boot block, the superblock, the
+// free bitmap, the log, and the root directory's inode block. free inodes
+// have type I_INVALID, which is zero.
+func mkfs(d Disk_i, loglen int) int {
+	nblks := d.Capacity()
+	sbn := 1
+	fstart := sbn + 1
+	flen := (nblks + 512*8 - 1)/(512*8)
+	ustart := fstart + flen + loglen
+	if ustart >= nblks {
+		panic("disk too small")
+	}
+
+	b0 := &Diskbuf_t{Block: 0}
+	writen(b0.Data[:], 4, FSOFF, sbn)
+
+	// the root is the first inode of the first data block; the other
+	// inodes of the block are free
+	ib := &Diskbuf_t{Block: int32(ustart)}
+	ind := &inode_t{&bbuf_t{buf: ib}, 0}
+	ind.w_itype(I_DIR)
+	ind.w_linkcount(1)
+	for i := 1; i < 3; i++ {
+		ind = &inode_t{&bbuf_t{buf: ib}, i}
+		ind.w_freenext(biencode(ustart, i + 1))
+	}
+	cksum_set(&ib.Data)
+
+	fb := &Diskbuf_t{Block: int32(fstart)}
+	fb.Data[0] = 1
+
+	sb := &Diskbuf_t{Block: int32(sbn)}
+	s := &superblock_t{blk: &bbuf_t{buf: sb}}
+	s.w_freeblock(fstart)
+	s.w_freeblocklen(flen)
+	s.w_loglen(loglen)
+	s.w_rootinode(ustart, 0)
+	s.w_lastblock(nblks)
+	s.w_freeinode(biencode(ustart, 1))
+	cksum_set(&sb.Data)
+
+	if err := d.Write([]*Diskbuf_t{b0, sb, fb, ib}); err != 0 {
+		return err
+	}
+	return d.Flush()
+}
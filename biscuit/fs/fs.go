@@ -0,0 +1,3102 @@
+package fs
+
+import "fmt"
+import "hash/crc32"
+import "sync"
+import "sync/atomic"
+import "time"
+
+// the offset in block 0 of the block number of the superblock; the build
+// system installs it there for us
+const FSOFF	= 506
+
+var superb_start	int
+var superb		superblock_t
+var iroot		*idaemon_t
+var free_start		int
+var free_len		int
+var usable_start	int
+// the device holding the file system
+var fsdev		Disk_i
+
+// file system journal
+var fslog	= log_t{}
+var bcdaemon	= bcdaemon_t{}
+
+// free block bitmap lock
+var fblock	= sync.Mutex{}
+// free block counts of each block group and the allocation cursor; protected
+// by fblock
+var fgroups	[]int
+var fcursor	int
+// free inode lock
+var filock	= sync.Mutex{}
+
+// starts the file system on dev, which must hold one, with a block cache of
+// at most nbufs blocks. all of the file system's state is global, so it can
+// only be started once.
+func Fs_init(dev Disk_i, nbufs int) {
+	fsdev = dev
+
+	bcdaemon.init(nbufs)
+	go bc_daemon(&bcdaemon)
+
+	// find the first fs block
+	blk0 := bmust(bread(0))
+	superb_start = readn(blk0.buf.Data[:], 4, FSOFF)
+	if superb_start <= 0 {
+		panic("bad superblock start")
+	}
+	// the superblock is never released back to the block cache so that
+	// superb.blk is always the cached copy; see log_bread()
+	blk := bmust(bread_meta(superb_start))
+	superb = superblock_t{}
+	superb.blk = blk
+	if superb.lastblock() > fsdev.Capacity() {
+		panic("file system larger than disk")
+	}
+	brelse(blk0)
+	ri := superb.rootinode()
+	var err int
+	iroot, err = idaemon_ensure(ri)
+	if err != 0 {
+		panic("cannot read root inode")
+	}
+
+	free_start = superb.freeblock()
+	free_len = superb.freeblocklen()
+	logstart := free_start + free_len
+	loglen := superb.loglen()
+	usable_start = logstart + loglen
+	if loglen < 0 {
+		panic("bad log len")
+	}
+
+	fslog.init(logstart, loglen)
+	fs_recover()
+	balloc_init()
+	go log_daemon(&fslog)
+}
+
+// returns true if dev holds a file system: block 0 points to a superblock
+// with a valid checksum that fits on dev. the block cache isn't used since the
+// file system isn't initialized yet.
+func Fs_probe(dev Disk_i) bool {
+	if dev.Capacity() < 2 {
+		return false
+	}
+	blk0 := &Diskbuf_t{Block: 0}
+	if dev.Read([]*Diskbuf_t{blk0}) != 0 {
+		return false
+	}
+	sbn := readn(blk0.Data[:], 4, FSOFF)
+	if sbn <= 0 || sbn >= dev.Capacity() {
+		return false
+	}
+	sb := &Diskbuf_t{Block: int32(sbn)}
+	if dev.Read([]*Diskbuf_t{sb}) != 0 || !cksum_ok(&sb.Data) {
+		return false
+	}
+	last := fieldr(&sb.Data, 4)
+	return last > sbn && last <= dev.Capacity()
+}
+
+// replays the transaction in the log if its commit record, its descriptor
+// blocks, and all of its logged blocks are intact. a transaction whose commit
+// record was not written completely, or whose descriptor or log blocks were
+// partially overwritten by a later, uncommitted transaction, is ignored.
+func fs_recover() {
+	l := &fslog
+	cblk := bmust(bread(l.logstart))
+	cr := logcommit_t{cblk}
+	if cr.magic() != LOG_MAGIC {
+		brelse(cblk)
+		fmt.Printf("no FS recovery needed\n")
+		return
+	}
+	l.seq = cr.seq()
+	rlen := cr.nblks()
+	valid := cksum_ok(&cblk.buf.Data) && rlen >= 0 && rlen <= l.loglen
+	brelse(cblk)
+	if !valid || rlen == 0 {
+		fmt.Printf("no FS recovery needed\n")
+		return
+	}
+
+	fmt.Printf("starting FS recovery...")
+	dsum := uint32(0)
+	stale := false
+	for d := 0; d < l.ndescs(rlen); d++ {
+		dblk := bmust(bread(l.logstart + 1 + d))
+		dsum = crc32.Update(dsum, crc32c_tab, dblk.buf.Data[:])
+		if fieldr(&dblk.buf.Data, LOGDPB) != l.seq {
+			stale = true
+		}
+		brelse(dblk)
+	}
+	if dsum != cr.dsum() {
+		fmt.Printf("bad descriptor checksum; ignoring log\n")
+		return
+	}
+	// the descriptor blocks must belong to the committed transaction
+	if stale {
+		fmt.Printf("stale descriptor block; ignoring log\n")
+		return
+	}
+
+	dests := make([]int, rlen)
+	for i := 0; i < rlen; i++ {
+		dn, doff := l.destoff(i)
+		dblk := bmust(bread(dn))
+		dests[i] = readn(dblk.buf.Data[:], 4, doff)
+		sum := uint32(readn(dblk.buf.Data[:], 4, doff + 4))
+		brelse(dblk)
+
+		src := bmust(bread(l.logblk(i)))
+		ok := crc32.Checksum(src.buf.Data[:], crc32c_tab) == sum
+		brelse(src)
+		if !ok {
+			fmt.Printf("bad checksum for log block %v; ignoring " +
+			    "log\n", i)
+			return
+		}
+	}
+
+	for i := 0; i < rlen; i++ {
+		src := bmust(bread(l.logblk(i)))
+		dst := bmust(log_bread(dests[i]))
+		dst.buf.Data = src.buf.Data
+		err := dst.writeback()
+		brelse(src)
+		log_brelse(dst)
+		if err != 0 {
+			// the log stays intact for the next boot
+			fs_ioerr("log replay")
+			return
+		}
+	}
+	// the replayed blocks must be stable before the log is emptied
+	if fs_flush() != 0 {
+		fs_ioerr("log replay")
+		return
+	}
+
+	// empty the log so that the transaction is not replayed again
+	cblk = bmust(bread(l.logstart))
+	cr.blk = cblk
+	cr.w_nblks(0)
+	cksum_set(&cblk.buf.Data)
+	err := fsdev.Writefua([]*Diskbuf_t{cblk.buf})
+	if err == 0 {
+		cblk.dirty = false
+	}
+	brelse(cblk)
+	if err != 0 {
+		fs_ioerr("log reset")
+		return
+	}
+	fmt.Printf("restored %v blocks\n", rlen)
+}
+
+// upper bounds on the number of distinct blocks logged by each operation,
+// which op_begin() reserves in the log.
+const(
+	// target inode, directory data block, free bitmap block, and directory
+	// inode
+	LINK_BLKS	= 4
+	// directory data block, directory inode, and target inode. the
+	// target's blocks are freed by later transactions; see fs_ifree().
+	UNLINK_BLKS	= 3
+	// superblock, new inode block, directory data block, directory inode,
+	// and up to two free bitmap blocks
+	CREATE_BLKS	= 6
+)
+
+// links the file at oldp to newp
+func Fs_link(oldp []string, newp []string) int {
+	if err := fs_rdonly(); err != 0 {
+		return err
+	}
+	op_begin(LINK_BLKS)
+
+	nl := len(newp) - 1
+	newdirs := make([]string, 0)
+	for i := 0; i < nl; i++ {
+		newdirs = append(newdirs, newp[i])
+	}
+	newname := newp[nl]
+
+	// first get inode number and inc ref count
+	req := &ireq_t{}
+	req.mkget(oldp, true)
+	iroot.req <- req
+	resp := <- req.ack
+	if resp.err != 0 {
+		op_end()
+		return resp.err
+	}
+
+	// insert directory entry
+	priv := resp.gnext
+	req = &ireq_t{}
+	req.mkinsert(newdirs, newname, priv)
+	iroot.req <- req
+	resp = <- req.ack
+	if resp.err == 0 {
+		op_end()
+		return 0
+	}
+	// decrement ref count if the insert failed. the file may have been
+	// unlinked in the meantime.
+	dofree, err := idrop(priv, REFDEC)
+	op_end()
+	if err == 0 && dofree {
+		fs_ifree(priv)
+	}
+	return resp.err
+}
+
+func Fs_unlink(path []string) int {
+	if err := fs_rdonly(); err != 0 {
+		return err
+	}
+	op_begin(UNLINK_BLKS)
+
+	// remove directory entry
+	req := &ireq_t{}
+	l := len(path) - 1
+	req.mkunlink(path[:l], path[l])
+	iroot.req <- req
+	resp := <- req.ack
+	if resp.err != 0 {
+		op_end()
+		return resp.err
+	}
+
+	// dec ref count of unlinked inode
+	priv := resp.unext
+	dofree, err := idrop(priv, REFDEC)
+	op_end()
+	if err != 0 || !dofree {
+		return err
+	}
+	return fs_ifree(priv)
+}
+
+// sends a REFDEC or CLOSE request to the idaemon of priv. returns true if the
+// inode has neither links nor opens left, in which case the caller must free
+// it with fs_ifree() outside of its operation.
+func idrop(priv inum, rt rtype_t) (bool, int) {
+	req := &ireq_t{}
+	if rt == REFDEC {
+		req.mkrefdec()
+	} else {
+		req.mkclose()
+	}
+	idmon, err := idaemon_ensure(priv)
+	if err != 0 {
+		return false, err
+	}
+	idmon.req <- req
+	resp := <- req.ack
+	return resp.dofree, 0
+}
+
+// frees the inode priv, which has neither links nor opens, and its blocks.
+// the blocks are freed from the end of the file by several transactions, like
+// a large truncation; a crash in between leaves an inode without links, which
+// bfsck frees.
+func fs_ifree(priv inum) int {
+	idmon, err := idaemon_ensure(priv)
+	if err != 0 {
+		return err
+	}
+	return fs_shrink(idmon, 0, true)
+}
+
+func fs_read(dsts [][]uint8, priv inum, offset int) (int, int) {
+	// send read request to inode daemon owning priv
+	req := &ireq_t{}
+	req.mkread(dsts, offset)
+
+	idmon, err := idaemon_ensure(priv)
+	if err != 0 {
+		return 0, err
+	}
+	idmon.req <- req
+	resp := <- req.ack
+	if resp.err != 0 {
+		return 0, resp.err
+	}
+	return resp.count, 0
+}
+
+// an upper bound on the number of distinct blocks logged by a write that
+// touches n data blocks: the data blocks, the indirect blocks, the free bitmap
+// blocks, and the inode.
+func write_blks(n int) int {
+	return n + (n/63 + 2) + (n/(512*8) + 2) + 1
+}
+
+// returns the largest number of bytes a single write transaction may carry
+// such that it fits in half of the log.
+func write_max() int {
+	lim := fslog.loglen/2
+	n := lim
+	for n > 0 && write_blks(n + 1) > lim {
+		n--
+	}
+	if n <= 0 {
+		panic("log too small for writes")
+	}
+	// an unaligned write of n*512 bytes may touch n+1 blocks
+	return n*512
+}
+
+// splits bufs into slices of buffers, each one holding at most max bytes.
+func bufs_split(bufs [][]uint8, max int) [][][]uint8 {
+	ret := make([][][]uint8, 0)
+	cur := make([][]uint8, 0)
+	c := 0
+	for _, b := range bufs {
+		for len(b) > 0 {
+			n := len(b)
+			if c + n > max {
+				n = max - c
+			}
+			cur = append(cur, b[:n])
+			b = b[n:]
+			c += n
+			if c == max {
+				ret = append(ret, cur)
+				cur = make([][]uint8, 0)
+				c = 0
+			}
+		}
+	}
+	if c != 0 {
+		ret = append(ret, cur)
+	}
+	return ret
+}
+
+// writes are split into several transactions when they are too large for the
+// log. thus a large write is not atomic; if an error occurs, the number of
+// bytes written by the preceding transactions is returned along with it.
+func fs_write(srcs [][]uint8, priv inum, offset int, append bool) (int, int) {
+	if err := fs_rdonly(); err != 0 {
+		return 0, err
+	}
+	max := write_max()
+	c := 0
+	for _, chunk := range bufs_split(srcs, max) {
+		n := 0
+		for _, b := range chunk {
+			n += len(b)
+		}
+		wrote, err := fs_write1(chunk, priv, offset + c, append, n)
+		c += wrote
+		if err != 0 {
+			return c, err
+		}
+	}
+	return c, 0
+}
+
+func fs_write1(srcs [][]uint8, priv inum, offset int, append bool,
+    nbytes int) (int, int) {
+	// the number of data blocks the write touches. an append starts at the
+	// end of the file, whose alignment isn't known yet.
+	nblks := (offset%512 + nbytes + 511)/512
+	if append {
+		nblks = (nbytes + 511)/512 + 1
+	}
+	op_begin(write_blks(nblks))
+	defer op_end()
+
+	// send write request to inode daemon owning priv
+	req := &ireq_t{}
+	req.mkwrite(srcs, offset, append)
+
+	idmon, err := idaemon_ensure(priv)
+	if err != 0 {
+		return 0, err
+	}
+	idmon.req <- req
+	resp := <- req.ack
+	if resp.err != 0 {
+		return 0, resp.err
+	}
+	return resp.count, 0
+}
+
+func fs_stat(priv inum, st *Stat_t) int {
+	req := &ireq_t{}
+	req.mkstat(st)
+	idmon, err := idaemon_ensure(priv)
+	if err != 0 {
+		return err
+	}
+	idmon.req <- req
+	resp := <- req.ack
+	return resp.err
+}
+
+// an upper bound on the number of distinct blocks logged by a truncation that
+// frees at most n data blocks: the free bitmap blocks of the freed data and
+// indirect blocks, the indirect block holding the new end of the file, the
+// inode, and the superblock, which freeing the inode logs.
+func trunc_blks(n int) int {
+	bm := n + n/63 + 2
+	if bm > free_len {
+		bm = free_len
+	}
+	return bm + 3
+}
+
+// returns the largest number of data blocks a single truncation transaction
+// may free such that it fits in half of the log.
+func trunc_max() int {
+	lim := fslog.loglen/2
+	all := free_len*512*8
+	if trunc_blks(all) <= lim {
+		return all
+	}
+	n := 0
+	for trunc_blks(n + 1) <= lim {
+		n++
+	}
+	if n == 0 {
+		panic("log too small for truncation")
+	}
+	return n
+}
+
+// shrinks the file of idmon to newlen bytes by as many transactions as it
+// takes to free its blocks. if ifree is set, newlen must be 0 and the inode is
+// freed too.
+func fs_shrink(idmon *idaemon_t, newlen int, ifree bool) int {
+	max := trunc_max()
+	for {
+		if err := fs_rdonly(); err != 0 {
+			return err
+		}
+		op_begin(trunc_blks(max))
+		req := &ireq_t{}
+		req.mktrunc(newlen, max, ifree)
+		idmon.req <- req
+		resp := <- req.ack
+		op_end()
+		if resp.err != 0 || resp.count <= newlen {
+			return resp.err
+		}
+	}
+}
+
+// grows the file of idmon to newlen bytes by writing zeros from its end, by as
+// many transactions as it takes. data appended meanwhile is kept.
+func fs_grow(idmon *idaemon_t, newlen int) int {
+	max := write_max()
+	for {
+		if err := fs_rdonly(); err != 0 {
+			return err
+		}
+		op_begin(write_blks(max/512 + 1))
+		req := &ireq_t{}
+		req.mkgrow(newlen, max)
+		idmon.req <- req
+		resp := <- req.ack
+		op_end()
+		if resp.err != 0 || resp.count >= newlen {
+			return resp.err
+		}
+	}
+}
+
+// the largest size of a file: the size of all data blocks of the file system
+func fs_maxsize() int {
+	return balloc_nbits()*512
+}
+
+// growing a file writes zeros up to the new size, and shrinking a file frees
+// its blocks, both of which may take several transactions.
+func fs_truncate(priv inum, newlen int) int {
+	if err := fs_rdonly(); err != 0 {
+		return err
+	}
+	if newlen > fs_maxsize() {
+		return -EFBIG
+	}
+	st := &Stat_t{}
+	if err := fs_stat(priv, st); err != 0 {
+		return err
+	}
+	if st.Itype == I_DIR {
+		return -EISDIR
+	}
+	idmon, err := idaemon_ensure(priv)
+	if err != 0 {
+		return err
+	}
+	if newlen > st.Size {
+		return fs_grow(idmon, newlen)
+	}
+	return fs_shrink(idmon, newlen, false)
+}
+
+func Fs_mkdir(path []string) int {
+	if err := fs_rdonly(); err != 0 {
+		return err
+	}
+	op_begin(CREATE_BLKS)
+	defer op_end()
+
+	l := len(path) - 1
+	dirs := path[:l]
+	name := path[l]
+
+	req := &ireq_t{}
+	req.mkcreate(dirs, name, I_DIR)
+	iroot.req <- req
+	resp := <- req.ack
+	return resp.err
+}
+
+// makes a device file for the character device major, minor
+func Fs_mknod(path []string, major int, minor int) int {
+	if err := fs_rdonly(); err != 0 {
+		return err
+	}
+	op_begin(CREATE_BLKS)
+	defer op_end()
+
+	l := len(path) - 1
+	req := &ireq_t{}
+	req.mkcreate(path[:l], path[l], I_DEV)
+	req.cr_major = major
+	req.cr_minor = minor
+	iroot.req <- req
+	resp := <- req.ack
+	return resp.err
+}
+
+// opens the file at path, creating a file if create is set and the file does
+// not exist. the file must be closed; an unlinked file keeps its inode and
+// blocks until then.
+func Fs_open(path []string, create bool) (*Ifile_t, int) {
+	if create && len(path) != 0 {
+		if err := fs_rdonly(); err != 0 {
+			return nil, err
+		}
+		op_begin(CREATE_BLKS)
+		defer op_end()
+
+		l := len(path) - 1
+		dirs := path[:l]
+
+		name := path[len(path) - 1]
+		req := &ireq_t{}
+		req.mkcreate(dirs, name, I_FILE)
+		req.doopen = true
+		iroot.req <- req
+		resp := <- req.ack
+		if resp.err != 0 {
+			return nil, resp.err
+		}
+		return &Ifile_t{resp.cnext}, 0
+	}
+
+	// send inum get request to root inode daemon
+	priv, err := iroot_getp(path)
+	if err != 0 {
+		return nil, err
+	}
+
+	ret := &Ifile_t{priv}
+	return ret, 0
+}
+
+// looks up path and opens the file it names
+func iroot_getp(path []string) (inum, int) {
+	req := &ireq_t{}
+	req.mkget(path, false)
+	req.doopen = true
+	iroot.req <- req
+	resp := <- req.ack
+	if resp.err != 0 {
+		return 0, resp.err
+	}
+	return resp.gnext, 0
+}
+
+// an open file of the file system
+type Ifile_t struct {
+	priv	inum
+}
+
+func (f *Ifile_t) Read(dsts [][]uint8, offset int) (int, int) {
+	return fs_read(dsts, f.priv, offset)
+}
+
+func (f *Ifile_t) Write(srcs [][]uint8, offset int, append bool) (int, int) {
+	return fs_write(srcs, f.priv, offset, append)
+}
+
+// the journal commits all finished operations at once, thus making one file
+// durable makes all of them durable.
+func (f *Ifile_t) Fsync() int {
+	return log_sync(false)
+}
+
+// sets the file's size, filling with zeros when it grows
+func (f *Ifile_t) Truncate(newlen int) int {
+	return fs_truncate(f.priv, newlen)
+}
+
+func (f *Ifile_t) Stat(st *Stat_t) int {
+	return fs_stat(f.priv, st)
+}
+
+// the file must not be used afterwards. an unlinked file is freed once it is
+// closed everywhere.
+func (f *Ifile_t) Close() int {
+	dofree, err := idrop(f.priv, CLOSE)
+	if err != 0 || !dofree {
+		return err
+	}
+	return fs_ifree(f.priv)
+}
+
+// the attributes of a file
+type Stat_t struct {
+	Ino	int
+	// I_FILE, I_DIR, or I_DEV
+	Itype	int
+	Links	int
+	Size	int
+	// the device of device files
+	Major	int
+	Minor	int
+}
+
+// makes all changes durable and installs them in their home locations
+func Fs_sync() int {
+	return log_sync(true)
+}
+
+// the number of blocks the block cache holds
+func Bc_nbufs() int {
+	return bcdaemon.nbufs
+}
+
+type idaemon_t struct {
+	req		chan *ireq_t
+	ack		chan *iresp_t
+	priv		inum
+	blkno		int
+	ioff		int
+	// cache of inode data in case block cache evicts our inode block
+	icache		icache_t
+	ra		readahead_t
+	// the number of open files of the inode. an inode without links is
+	// freed once it has no opens either.
+	opens		int
+}
+
+const(
+	// initial and maximum read-ahead windows, in blocks
+	RA_MIN	= 4
+	RA_MAX	= 64
+)
+
+// tracks sequential reads of a file. the read-ahead window doubles each time
+// a read continues where the previous one left off and collapses on a seek.
+type readahead_t struct {
+	// the file block following the last one read
+	next	int
+	// number of blocks to prefetch beyond the last block read
+	win	int
+	// the file block following the last one prefetched
+	end	int
+}
+
+type icache_t struct {
+	itype	int
+	links	int
+	size	int
+	major	int
+	minor	int
+	indir	int
+	addrs	[NIADDRS]int
+}
+
+func (ic *icache_t) fill(blk *bbuf_t, ioff int) {
+	inode := inode_t{blk, ioff}
+	ic.itype = inode.itype()
+	ic.links = inode.linkcount()
+	ic.size  = inode.size()
+	ic.major = inode.major()
+	ic.minor = inode.minor()
+	ic.indir = inode.indirect()
+	for i := 0; i < NIADDRS; i++ {
+		ic.addrs[i] = inode.addr(i)
+	}
+}
+
+func (ic *icache_t) flushto(blk *bbuf_t, ioff int) {
+	inode := inode_t{blk, ioff}
+	inode.w_itype(ic.itype)
+	inode.w_linkcount(ic.links)
+	inode.w_size(ic.size)
+	inode.w_major(ic.major)
+	inode.w_minor(ic.minor)
+	inode.w_indirect(ic.indir)
+	for i := 0; i < NIADDRS; i++ {
+		inode.w_addr(i, ic.addrs[i])
+	}
+}
+
+type rtype_t int
+
+const (
+	GET	rtype_t = iota
+	READ
+	REFDEC
+	WRITE
+	CREATE
+	INSERT
+	LINK
+	UNLINK
+	STAT
+	TRUNC
+	GROW
+	OPEN
+	CLOSE
+	EMPTY
+)
+
+type ireq_t struct {
+	// request type
+	rtype		rtype_t
+	// tree traversal
+	path		[]string
+	// read/write op
+	offset		int
+	// read op
+	rbufs		[][]uint8
+	// writes op
+	dbufs		[][]uint8
+	dappend		bool
+	// create op
+	cr_name		string
+	cr_type		int
+	cr_major	int
+	cr_minor	int
+	// insert op
+	insert_name	string
+	insert_priv	inum
+	// unlink op
+	unlink_name	string
+	// stat op
+	st		*Stat_t
+	// trunc and grow ops; the new length is in offset
+	tmax		int
+	tfree		bool
+	// inc ref count after get
+	doinc		bool
+	// open the file found by get or made by create
+	doopen		bool
+	ack		chan *iresp_t
+}
+
+// if incref is true, the call must be made between op_{begin,end}.
+func (r *ireq_t) mkget(name []string, incref bool) {
+	r.ack = make(chan *iresp_t)
+	r.rtype = GET
+	r.path = name
+	if incref {
+		r.doinc = true
+	}
+}
+
+func (r *ireq_t) mkread(dsts [][]uint8, offset int) {
+	r.ack = make(chan *iresp_t)
+	r.rtype = READ
+	r.rbufs = dsts
+	r.offset = offset
+}
+
+func (r *ireq_t) mkwrite(srcs [][]uint8, offset int, append bool) {
+	r.ack = make(chan *iresp_t)
+	r.rtype = WRITE
+	r.dbufs = srcs
+	r.offset = offset
+	r.dappend = append
+}
+
+func (r *ireq_t) mkcreate(dirs []string, nname string, ntype int) {
+	r.ack = make(chan *iresp_t)
+	r.rtype = CREATE
+	r.path = dirs
+	r.cr_name = nname
+	r.cr_type = ntype
+}
+
+func (r *ireq_t) mkinsert(dirs []string, nname string, priv inum) {
+	r.ack = make(chan *iresp_t)
+	r.rtype = INSERT
+	r.path = dirs
+	r.insert_name = nname
+	r.insert_priv = priv
+}
+
+func (r *ireq_t) mkrefdec() {
+	r.ack = make(chan *iresp_t)
+	r.rtype = REFDEC
+}
+
+func (r *ireq_t) mkstat(st *Stat_t) {
+	r.ack = make(chan *iresp_t)
+	r.rtype = STAT
+	r.st = st
+}
+
+// frees at most max data blocks. if ifree is set, the inode is freed once the
+// file is empty.
+func (r *ireq_t) mktrunc(newlen int, max int, ifree bool) {
+	r.ack = make(chan *iresp_t)
+	r.rtype = TRUNC
+	r.offset = newlen
+	r.tmax = max
+	r.tfree = ifree
+}
+
+// writes at most max bytes of zeros at the end of the file, up to newlen
+func (r *ireq_t) mkgrow(newlen int, max int) {
+	r.ack = make(chan *iresp_t)
+	r.rtype = GROW
+	r.offset = newlen
+	r.tmax = max
+}
+
+func (r *ireq_t) mkopen() {
+	r.ack = make(chan *iresp_t)
+	r.rtype = OPEN
+}
+
+func (r *ireq_t) mkclose() {
+	r.ack = make(chan *iresp_t)
+	r.rtype = CLOSE
+}
+
+func (r *ireq_t) mkempty() {
+	r.ack = make(chan *iresp_t)
+	r.rtype = EMPTY
+}
+
+func (r *ireq_t) mkunlink(dirs []string, name string) {
+	r.ack = make(chan *iresp_t)
+	r.rtype = UNLINK
+	r.path = dirs
+	r.unlink_name = name
+}
+
+type iresp_t struct {
+	gnext	inum
+	cnext	inum
+	unext	inum
+	count	int
+	err	int
+	// set by refdec and close once the inode has neither links nor opens
+	dofree	bool
+}
+
+// a type for an inode block/offset identifier
+type inum int
+
+var allidmons	= map[inum]*idaemon_t{}
+var idmonl	= sync.Mutex{}
+
+// returns the idaemon of the inode priv, starting it if necessary, or -EIO if
+// the inode could not be read.
+func idaemon_ensure(priv inum) (*idaemon_t, int) {
+	idmonl.Lock()
+	defer idmonl.Unlock()
+	ret, ok := allidmons[priv]
+	if !ok {
+		ret = &idaemon_t{}
+		if err := ret.init(priv); err != 0 {
+			return nil, err
+		}
+		allidmons[priv] = ret
+		idaemonize(ret)
+	}
+	return ret, 0
+}
+
+// creates a new idaemon struct and fills its inode
+func (idm *idaemon_t) init(priv inum) int {
+	blkno, ioff := bidecode(int(priv))
+	idm.priv = priv
+	idm.blkno = blkno
+	idm.ioff = ioff
+
+	idm.req = make(chan *ireq_t)
+	idm.ack = make(chan *iresp_t)
+
+	blk, err := bread_meta(blkno)
+	if err != 0 {
+		return err
+	}
+	idm.icache.fill(blk, ioff)
+	brelse(blk)
+	return 0
+}
+
+// sends an open request to the idaemon of priv
+func iopen(priv inum) int {
+	idmon, err := idaemon_ensure(priv)
+	if err != 0 {
+		return err
+	}
+	req := &ireq_t{}
+	req.mkopen()
+	idmon.req <- req
+	<- req.ack
+	return 0
+}
+
+// returns true if the request was forwarded or if an error occured. if an
+// error occurs, writes the error back to the requester.
+func (idm *idaemon_t) forwardreq(r *ireq_t) bool {
+	if len(r.path) == 0 {
+		// req is for this idaemon
+		return false
+	}
+
+	next := r.path[0]
+	r.path = r.path[1:]
+	npriv, err := idm.iget(next)
+	if err != 0 {
+		r.ack <- &iresp_t{err: err}
+		return true
+	}
+	nextidm, err := idaemon_ensure(npriv)
+	if err != 0 {
+		r.ack <- &iresp_t{err: err}
+		return true
+	}
+	// forward request
+	nextidm.req <- r
+	return true
+}
+
+func idaemonize(idm *idaemon_t) {
+	// writes the cached inode to its block. returns err if it is an error
+	// and otherwise the error reading the inode block, if any.
+	iupdate := func(err int) int {
+		blk, rerr := bread_meta(idm.blkno)
+		if rerr != 0 {
+			if err != 0 {
+				return err
+			}
+			return rerr
+		}
+		idm.icache.flushto(blk, idm.ioff)
+		log_write(blk)
+		brelse(blk)
+		return err
+	}
+
+	// simple operations
+	go func() {
+	for {
+		r := <- idm.req
+		switch r.rtype {
+		case CREATE:
+			if idm.forwardreq(r) {
+				break
+			}
+
+			if idm.icache.itype != I_DIR {
+				panic("create in non-dir")
+			}
+			if r.cr_type != I_FILE && r.cr_type != I_DIR &&
+			    r.cr_type != I_DEV {
+				panic("no imp")
+			}
+			cnext, err := idm.icreate(r.cr_name, r.cr_type,
+			    r.cr_major, r.cr_minor)
+			err = iupdate(err)
+			if err == 0 && r.doopen {
+				// open the file before its name can be
+				// unlinked
+				err = iopen(cnext)
+			}
+			ret := &iresp_t{cnext: cnext, err: err}
+			r.ack <- ret
+
+		case GET:
+			// is the requester asking for this daemon?
+			if idm.forwardreq(r) {
+				break
+			}
+			if r.doinc {
+				// no hard links on directories
+				if idm.icache.itype != I_FILE {
+					r.ack <- &iresp_t{err: -EPERM}
+					break
+				}
+				idm.icache.links++
+				if err := iupdate(0); err != 0 {
+					idm.icache.links--
+					r.ack <- &iresp_t{err: err}
+					break
+				}
+			}
+			if r.doopen {
+				idm.opens++
+			}
+			// req is for us
+			r.ack <- &iresp_t{gnext: idm.priv}
+
+		case INSERT:
+			// create new dir ent with given inode number
+			if idm.forwardreq(r) {
+				break
+			}
+			err := idm.iinsert(r.insert_name, r.insert_priv)
+			r.ack <- &iresp_t{err: iupdate(err)}
+
+		case READ:
+			read, err := idm.iread(r.rbufs, r.offset)
+			ret := &iresp_t{count: read, err: err}
+			r.ack <- ret
+
+		case REFDEC:
+			// decrement reference count
+			idm.icache.links--
+			if idm.icache.links < 0 {
+				panic("ref count is negative")
+			}
+			iupdate(0)
+			dofree := idm.icache.links == 0 && idm.opens == 0
+			r.ack <- &iresp_t{dofree: dofree}
+
+		case OPEN:
+			idm.opens++
+			r.ack <- &iresp_t{}
+
+		case CLOSE:
+			idm.opens--
+			if idm.opens < 0 {
+				panic("open count is negative")
+			}
+			dofree := idm.icache.links == 0 && idm.opens == 0
+			r.ack <- &iresp_t{dofree: dofree}
+
+		case UNLINK:
+			if idm.forwardreq(r) {
+				break
+			}
+			upriv, err := idm.iunlink(r.unlink_name)
+			err = iupdate(err)
+			r.ack <- &iresp_t{unext: upriv, err: err}
+
+		case WRITE:
+			if idm.icache.itype == I_DIR {
+				panic("write to dir")
+			}
+			offset := r.offset
+			if r.dappend {
+				offset = idm.icache.size
+			}
+			read, err := idm.iwrite(r.dbufs, offset)
+			// iupdate() must come before the response is sent.
+			// otherwise the idaemon and the requester race to
+			// log_write()/op_end().
+			err = iupdate(err)
+			ret := &iresp_t{count: read, err: err}
+			r.ack <- ret
+
+		case STAT:
+			st := r.st
+			st.Ino = int(idm.priv)
+			st.Itype = idm.icache.itype
+			st.Links = idm.icache.links
+			st.Size = idm.icache.size
+			st.Major = idm.icache.major
+			st.Minor = idm.icache.minor
+			r.ack <- &iresp_t{}
+
+		case TRUNC:
+			if idm.icache.itype == I_DIR && !r.tfree {
+				r.ack <- &iresp_t{err: -EISDIR}
+				break
+			}
+			newlen := r.offset
+			nb := roundup(idm.icache.size, 512)/512
+			if lim := (nb - r.tmax)*512; lim > newlen {
+				newlen = lim
+			}
+			err := idm.itrunc(newlen)
+			if err == 0 && r.tfree && idm.icache.size == 0 {
+				// nothing can reach the inode anymore
+				idmonl.Lock()
+				delete(allidmons, idm.priv)
+				idmonl.Unlock()
+				ifree(idm.priv)
+				r.ack <- &iresp_t{}
+				return
+			}
+			err = iupdate(err)
+			r.ack <- &iresp_t{count: idm.icache.size, err: err}
+
+		case GROW:
+			if idm.icache.itype == I_DIR {
+				r.ack <- &iresp_t{err: -EISDIR}
+				break
+			}
+			// the file may have grown since the request was made
+			err := 0
+			if n := r.offset - idm.icache.size; n > 0 {
+				if n > r.tmax {
+					n = r.tmax
+				}
+				zeros := make([]uint8, n)
+				_, err = idm.iwrite([][]uint8{zeros},
+				    idm.icache.size)
+			}
+			err = iupdate(err)
+			r.ack <- &iresp_t{count: idm.icache.size, err: err}
+
+		case EMPTY:
+			err := 0
+			if idm.icache.itype == I_DIR {
+				err = idm.iempty()
+			}
+			r.ack <- &iresp_t{err: err}
+
+		default:
+			panic("bad req type")
+		}
+	}}()
+}
+
+// returns the block number containing the byte at offset, or -EIO if an
+// indirect block could not be read. new blocks are allocated next to the
+// previous block of the file, or next to the inode for the first block, so
+// that sequential writes are contiguous on disk. new blocks are zeroed so that
+// the parts a write doesn't cover don't expose the data of deleted files.
+func (idm *idaemon_t) offsetblk(offset int, writing bool) (int, int) {
+	zalloc := func(goal int) (int, int) {
+		ret := balloc(goal)
+		zblk, err := bread(ret)
+		if err != 0 {
+			bfree(ret)
+			return 0, err
+		}
+		for i := range zblk.buf.Data {
+			zblk.buf.Data[i] = 0
+		}
+		log_write(zblk)
+		brelse(zblk)
+		return ret, 0
+	}
+
+	whichblk := offset/512
+	var blkn int
+	if whichblk >= NIADDRS {
+		indslot := whichblk - NIADDRS
+		slotpb := 63
+		nextindb := 63*8
+		indno := idm.icache.indir
+		if writing && indno == 0 {
+			var err int
+			indno, err = zalloc(idm.icache.addrs[NIADDRS - 1])
+			if err != 0 {
+				return 0, err
+			}
+			idm.icache.indir = indno
+		}
+		indblk, err := bread(indno)
+		if err != 0 {
+			return 0, err
+		}
+		for i := 0; i < indslot/slotpb; i++ {
+			nextno := readn(indblk.buf.Data[:], 8, nextindb)
+			if writing && nextno == 0 {
+				last := readn(indblk.buf.Data[:], 8, nextindb - 8)
+				nextno, err = zalloc(last)
+				if err != 0 {
+					brelse(indblk)
+					return 0, err
+				}
+				writen(indblk.buf.Data[:], 8, nextindb, nextno)
+				log_write(indblk)
+			}
+			brelse(indblk)
+			indno = nextno
+			indblk, err = bread(indno)
+			if err != 0 {
+				return 0, err
+			}
+		}
+		noff := (indslot % slotpb)*8
+		blkn = readn(indblk.buf.Data[:], 8, noff)
+		if writing && blkn == 0 {
+			goal := indno
+			if noff != 0 {
+				goal = readn(indblk.buf.Data[:], 8, noff - 8)
+			}
+			blkn, err = zalloc(goal)
+			if err != 0 {
+				brelse(indblk)
+				return 0, err
+			}
+			writen(indblk.buf.Data[:], 8, noff, blkn)
+			log_write(indblk)
+		}
+		brelse(indblk)
+	} else {
+		blkn = idm.icache.addrs[whichblk]
+		if writing && blkn == 0 {
+			goal := idm.blkno
+			if whichblk != 0 && idm.icache.addrs[whichblk - 1] != 0 {
+				goal = idm.icache.addrs[whichblk - 1]
+			}
+			var err int
+			blkn, err = zalloc(goal)
+			if err != 0 {
+				return 0, err
+			}
+			idm.icache.addrs[whichblk] = blkn
+		}
+	}
+	return blkn, 0
+}
+
+// if writing, allocate a block if necessary and don't trim the slice to the
+// size of the file
+func (idm *idaemon_t) blkslice(offset int, writing bool) ([]uint8, *bbuf_t,
+    int) {
+	blkn, err := idm.offsetblk(offset, writing)
+	if err != 0 {
+		return nil, nil, err
+	}
+	if blkn < superb_start && idm.icache.size > 0 {
+		panic("bad block")
+	}
+	blk, err := bread(blkn)
+	if err != 0 {
+		return nil, nil, err
+	}
+	start := offset % 512
+	bsp := 512 - start
+	if !writing {
+		// trim src buffer to end of file
+		left := idm.icache.size - offset
+		if bsp > left {
+			bsp = left
+		}
+	}
+	src := blk.buf.Data[start:start+bsp]
+	return src, blk, 0
+}
+
+func (idm *idaemon_t) iread(dsts [][]uint8, offset int) (int, int) {
+	c := 0
+	for _, d := range dsts {
+		read, err := idm.iread1(d, offset + c)
+		c += read
+		if err != 0 {
+			return c, err
+		}
+		if read != len(d) {
+			break
+		}
+	}
+	return c, 0
+}
+
+// detects whether a read starting at offset continues a sequential stream
+// and, if so, prefetches the blocks following lastb, the last file block read.
+func (idm *idaemon_t) readahead(offset int, lastb int) {
+	ra := &idm.ra
+	first := offset/512
+	// a read may start in the block the previous read ended in
+	if first != ra.next && first != ra.next - 1 {
+		ra.win = 0
+		ra.end = 0
+	} else if ra.win == 0 {
+		ra.win = RA_MIN
+	} else if ra.win < RA_MAX {
+		ra.win *= 2
+	}
+	ra.next = lastb + 1
+	if ra.win == 0 {
+		return
+	}
+
+	start := lastb + 1
+	if ra.end > start {
+		start = ra.end
+	}
+	end := lastb + 1 + ra.win
+	if fend := (idm.icache.size + 511)/512; end > fend {
+		end = fend
+	}
+	if start >= end {
+		return
+	}
+	blks := make([]int, 0, end - start)
+	for i := start; i < end; i++ {
+		blkn, err := idm.offsetblk(i*512, false)
+		if err != 0 {
+			break
+		}
+		if blkn != 0 {
+			blks = append(blks, blkn)
+		}
+	}
+	ra.end = end
+	bprefetch(blks)
+}
+
+func (idm *idaemon_t) iread1(dst []uint8, offset int) (int, int) {
+	isz := idm.icache.size
+	if offset >= isz {
+		return 0, 0
+	}
+
+	sz := len(dst)
+	c := 0
+	dstfull := false
+	for c < sz {
+		src, blk, err := idm.blkslice(offset + c, false)
+		if err != 0 {
+			return c, err
+		}
+		// copy upto len(dst) bytes
+		ub := len(src)
+		if len(dst) < ub {
+			ub = len(dst)
+			dstfull = true
+		}
+		for i := 0; i < ub; i++ {
+			dst[i] = src[i]
+		}
+		brelse(blk)
+		c += ub
+		dst = dst[ub:]
+		if offset + c == isz || dstfull {
+			break
+		}
+	}
+	if c != 0 {
+		idm.readahead(offset, (offset + c - 1)/512)
+	}
+	return c, 0
+}
+
+func (idm *idaemon_t) iwrite(srcs [][]uint8, offset int) (int, int) {
+	c := 0
+	for _, s := range srcs {
+		wrote, err := idm.iwrite1(s, offset + c)
+		c += wrote
+		if err != 0 {
+			return c, err
+		}
+		// short write
+		if wrote != len(s) {
+			panic("short write")
+		}
+	}
+	return c, 0
+}
+
+func (idm *idaemon_t) iwrite1(src []uint8, offset int) (int, int) {
+	// XXX if file length is shortened, when to free old blocks?
+	sz := len(src)
+	c := 0
+	for c < sz {
+		dst, blk, err := idm.blkslice(offset + c, true)
+		if err != 0 {
+			if offset + c > idm.icache.size {
+				idm.icache.size = offset + c
+			}
+			return c, err
+		}
+		ub := len(dst)
+		if len(src) < ub {
+			ub = len(src)
+		}
+		for i := 0; i < ub; i++ {
+			dst[i] = src[i]
+		}
+		log_write(blk)
+		brelse(blk)
+		c += ub
+		src = src[ub:]
+	}
+	// writes before the end of the file leave its size alone
+	if offset + c > idm.icache.size {
+		idm.icache.size = offset + c
+	}
+	return c, 0
+}
+
+// frees the chain of indirect blocks starting at indno and the blocks they
+// point to
+func (idm *idaemon_t) ichain_free(indno int) {
+	slotpb := 63
+	nextindb := 63*8
+	for indno != 0 {
+		indblk, err := bread(indno)
+		if err != 0 {
+			// the rest of the file's blocks are leaked
+			fmt.Printf("fs: cannot free blocks of inode %v\n",
+			    idm.priv)
+			break
+		}
+		for i := 0; i < slotpb; i++ {
+			blkn := readn(indblk.buf.Data[:], 8, i*8)
+			if blkn != 0 {
+				bfree(blkn)
+			}
+		}
+		next := readn(indblk.buf.Data[:], 8, nextindb)
+		brelse(indblk)
+		bfree(indno)
+		indno = next
+	}
+}
+
+// shrinks the file to newlen bytes, freeing the blocks past the new end. the
+// bytes past newlen in the last block are left alone; they are overwritten
+// with zeros if the file grows again.
+func (idm *idaemon_t) itrunc(newlen int) int {
+	if newlen >= idm.icache.size {
+		return 0
+	}
+	nb := roundup(newlen, 512)/512
+	if nb <= NIADDRS {
+		for i := nb; i < NIADDRS; i++ {
+			if idm.icache.addrs[i] != 0 {
+				bfree(idm.icache.addrs[i])
+				idm.icache.addrs[i] = 0
+			}
+		}
+		idm.ichain_free(idm.icache.indir)
+		idm.icache.indir = 0
+		idm.icache.size = newlen
+		return 0
+	}
+
+	// find the indirect block holding the new last block
+	slotpb := 63
+	nextindb := 63*8
+	last := nb - 1 - NIADDRS
+	indno := idm.icache.indir
+	for i := 0; i < last/slotpb && indno != 0; i++ {
+		indblk, err := bread(indno)
+		if err != 0 {
+			return err
+		}
+		indno = readn(indblk.buf.Data[:], 8, nextindb)
+		brelse(indblk)
+	}
+	if indno == 0 {
+		idm.icache.size = newlen
+		return 0
+	}
+	indblk, err := bread(indno)
+	if err != 0 {
+		return err
+	}
+	for j := last % slotpb + 1; j < slotpb; j++ {
+		blkn := readn(indblk.buf.Data[:], 8, j*8)
+		if blkn != 0 {
+			bfree(blkn)
+			writen(indblk.buf.Data[:], 8, j*8, 0)
+		}
+	}
+	next := readn(indblk.buf.Data[:], 8, nextindb)
+	writen(indblk.buf.Data[:], 8, nextindb, 0)
+	log_write(indblk)
+	brelse(indblk)
+	idm.ichain_free(next)
+	idm.icache.size = newlen
+	return 0
+}
+
+// does not check if name already exists. does not update ds.
+func (idm *idaemon_t) dirent_add(ds []*dirdata_t, name string, nblkno int,
+    ioff int) int {
+
+	var deoff int
+	var ddata *dirdata_t
+	dorelse := false
+
+	found, eblkidx, eslot := dirent_empty(ds)
+	if found {
+		// use existing dirdata block
+		deoff = eslot
+		ddata = ds[eblkidx]
+	} else {
+		// allocate new dir data block
+		oldsz := idm.icache.size
+		nextslot := oldsz/512
+		goal := idm.blkno
+		if nextslot != 0 {
+			goal = idm.icache.addrs[nextslot - 1]
+		}
+		if nextslot >= NIADDRS {
+			panic("need indirect support")
+		}
+		if idm.icache.addrs[nextslot] != 0 {
+			panic("addr slot allocated")
+		}
+		newddn := balloc(goal)
+		blk, err := bread(newddn)
+		if err != 0 {
+			bfree(newddn)
+			return err
+		}
+		idm.icache.addrs[nextslot] = newddn
+		idm.icache.size = oldsz + 512
+
+		deoff = 0
+		// zero new directory data block
+		for i := range blk.buf.Data {
+			blk.buf.Data[i] = 0
+		}
+		blk.meta = true
+		ddata = &dirdata_t{blk}
+		dorelse = true
+	}
+	// write dir entry
+	if ddata.filename(deoff) != "" {
+		panic("dir entry slot is not free")
+	}
+	ddata.w_filename(deoff, name)
+	ddata.w_inodenext(deoff, nblkno, ioff)
+	log_write(ddata.blk)
+	if dorelse {
+		brelse(ddata.blk)
+	}
+	return 0
+}
+
+// major and minor are only used for device files
+func (idm *idaemon_t) icreate(name string, itype int, major int,
+    minor int) (inum, int) {
+	// make sure file does not already exist
+	ds, err := idm.all_dirents()
+	if err != 0 {
+		return 0, err
+	}
+	defer dirent_brelse(ds)
+
+	_, found := dirent_lookup(ds, name)
+	if found {
+		return 0, -EEXIST
+	}
+
+	// allocate new inode
+	newbn, newioff := ialloc()
+
+	newinum := inum(biencode(newbn, newioff))
+	newiblk, err := bread_meta(newbn)
+	if err != 0 {
+		// ialloc() just read the block, so this is unlikely; the inode
+		// is leaked
+		return 0, err
+	}
+	newinode := &inode_t{newiblk, newioff}
+	newinode.w_itype(itype)
+	newinode.w_linkcount(1)
+	newinode.w_size(0)
+	newinode.w_major(major)
+	newinode.w_minor(minor)
+	newinode.w_indirect(0)
+	for i := 0; i < NIADDRS; i++ {
+		newinode.w_addr(i, 0)
+	}
+	log_write(newiblk)
+	brelse(newiblk)
+
+	// write new directory entry referencing newinode
+	if err := idm.dirent_add(ds, name, newbn, newioff); err != 0 {
+		ifree(newinum)
+		return 0, err
+	}
+	return newinum, 0
+}
+
+func (idm *idaemon_t) iget(name string) (inum, int) {
+	ds, err := idm.all_dirents()
+	if err != 0 {
+		return 0, err
+	}
+	priv, found := dirent_lookup(ds, name)
+	dirent_brelse(ds)
+	if found {
+		return priv, 0
+	}
+	return 0, -ENOENT
+}
+
+// creates a new directory entry with name "name" and inode number priv
+func (idm *idaemon_t) iinsert(name string, priv inum) int {
+	ds, err := idm.all_dirents()
+	if err != 0 {
+		return err
+	}
+	defer dirent_brelse(ds)
+
+	_, found := dirent_lookup(ds, name)
+	if found {
+		return -EEXIST
+	}
+	a, b := bidecode(int(priv))
+	return idm.dirent_add(ds, name, a, b)
+}
+
+// returns inode number of unliked inode so caller can decrement its ref count
+func (idm *idaemon_t) iunlink(name string) (inum, int) {
+	ds, err := idm.all_dirents()
+	if err != 0 {
+		return 0, err
+	}
+	defer dirent_brelse(ds)
+
+	priv, found := dirent_lookup(ds, name)
+	if !found {
+		return 0, -ENOENT
+	}
+	// nothing can be created in the directory meanwhile since creations
+	// pass through this idaemon
+	idmon, err := idaemon_ensure(priv)
+	if err != 0 {
+		return 0, err
+	}
+	req := &ireq_t{}
+	req.mkempty()
+	idmon.req <- req
+	if resp := <- req.ack; resp.err != 0 {
+		return 0, resp.err
+	}
+	dirent_erase(ds, name)
+	return priv, 0
+}
+
+// returns -ENOTEMPTY if the directory has entries
+func (idm *idaemon_t) iempty() int {
+	ds, err := idm.all_dirents()
+	if err != 0 {
+		return err
+	}
+	defer dirent_brelse(ds)
+	for _, d := range ds {
+		for j := 0; j < NDIRENTS; j++ {
+			if d.filename(j) != "" {
+				return -ENOTEMPTY
+			}
+		}
+	}
+	return 0
+}
+
+// fetch all directory entries from a directory data block. returns dirent
+// names, inums, and index of first empty dirent.
+func (idm *idaemon_t) dirents_get() ([]string, []inum, bool, int, int) {
+	if idm.icache.itype != I_DIR {
+		panic("not a directory")
+	}
+	isz := idm.icache.size
+	sret := make([]string, 0)
+	iret := make([]inum, 0)
+	var emptyb int
+	var emptys int
+	evalid := false
+	for bn := 0; bn < isz/512; bn++ {
+		blkn := idm.icache.addrs[bn]
+		blk, err := bread_meta(blkn)
+		if err != 0 {
+			break
+		}
+		dirdata := dirdata_t{blk}
+		for i := 0; i < NDIRENTS; i++ {
+			fn := dirdata.filename(i)
+			if fn == "" {
+				if !evalid {
+					evalid = true
+					emptyb = blkn
+					emptys = i
+				}
+				continue
+			}
+			sret = append(sret, fn)
+			inde := dirdata.inodenext(i)
+			iret = append(iret, inde)
+		}
+		brelse(blk)
+	}
+	return sret, iret, evalid, emptyb, emptys
+}
+
+// returns a slice of all directory data blocks. caller must brelse all
+// underlying blocks unless an error is returned.
+func (idm *idaemon_t) all_dirents() ([]*dirdata_t, int) {
+	if idm.icache.itype != I_DIR {
+		panic("not a directory")
+	}
+	isz := idm.icache.size
+	ret := make([]*dirdata_t, 0)
+	for bn := 0; bn < isz/512; bn++ {
+		blkn := idm.icache.addrs[bn]
+		blk, err := bread_meta(blkn)
+		if err != 0 {
+			dirent_brelse(ret)
+			return nil, err
+		}
+		dirdata := &dirdata_t{blk}
+		ret = append(ret, dirdata)
+	}
+	return ret, 0
+}
+
+// returns the inode number for the specified filename
+func dirent_lookup(ds []*dirdata_t, name string) (inum, bool) {
+	for i := 0; i < len(ds); i++ {
+		for j := 0; j < NDIRENTS; j++ {
+			if name == ds[i].filename(j) {
+				return ds[i].inodenext(j), true
+			}
+		}
+	}
+	return 0, false
+}
+
+func dirent_brelse(ds []*dirdata_t) {
+	for _, d := range ds {
+		brelse(d.blk)
+	}
+}
+
+// returns an empty directory entry
+func dirent_empty(ds []*dirdata_t) (bool, int, int) {
+	for i := 0; i < len(ds); i++ {
+		for j := 0; j < NDIRENTS; j++ {
+			if ds[i].filename(j) == "" {
+				return true, i, j
+			}
+		}
+	}
+	return false, 0, 0
+}
+
+// erases the specified directory entry
+func dirent_erase(ds []*dirdata_t, name string) (inum, bool) {
+	for i := 0; i < len(ds); i++ {
+		for j := 0; j < NDIRENTS; j++ {
+			if name == ds[i].filename(j) {
+				ret := ds[i].inodenext(j)
+				ds[i].w_filename(j, "")
+				ds[i].w_inodenext(j, 0, 0)
+				log_write(ds[i].blk)
+				return ret, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func fieldr(p *[512]uint8, field int) int {
+	return readn(p[:], 8, field*8)
+}
+
+func fieldw(p *[512]uint8, field int, val int) {
+	writen(p[:], 8, field*8, val)
+}
+
+func biencode(blk int, iidx int) int {
+	logisperblk := uint(2)
+	isperblk := 1 << logisperblk
+	if iidx < 0 || iidx >= isperblk {
+		panic("bad inode index")
+	}
+	return int(blk << logisperblk | iidx)
+}
+
+func bidecode(val int) (int, int) {
+	logisperblk := uint(2)
+	blk := int(uint(val) >> logisperblk)
+	iidx := val & 0x3
+	return blk, iidx
+}
+
+// superblock format:
+// bytes, meaning
+// 0-7,   freeblock start
+// 8-15,  freeblock length
+// 16-23, number of log blocks
+// 24-31, root inode
+// 32-39, last block
+// 40-47, head of the free inode list; zero if the list is empty
+// 48-55, unused
+// 508-511, checksum
+type superblock_t struct {
+	l	sync.Mutex
+	blk	*bbuf_t
+}
+
+func (sb *superblock_t) freeblock() int {
+	return fieldr(&sb.blk.buf.Data, 0)
+}
+
+func (sb *superblock_t) freeblocklen() int {
+	return fieldr(&sb.blk.buf.Data, 1)
+}
+
+func (sb *superblock_t) loglen() int {
+	return fieldr(&sb.blk.buf.Data, 2)
+}
+
+func (sb *superblock_t) rootinode() inum {
+	v := fieldr(&sb.blk.buf.Data, 3)
+	return inum(v)
+}
+
+func (sb *superblock_t) lastblock() int {
+	return fieldr(&sb.blk.buf.Data, 4)
+}
+
+func (sb *superblock_t) freeinode() int {
+	return fieldr(&sb.blk.buf.Data, 5)
+}
+
+func (sb *superblock_t) w_freeblock(n int) {
+	fieldw(&sb.blk.buf.Data, 0, n)
+}
+
+func (sb *superblock_t) w_freeblocklen(n int) {
+	fieldw(&sb.blk.buf.Data, 1, n)
+}
+
+func (sb *superblock_t) w_loglen(n int) {
+	fieldw(&sb.blk.buf.Data, 2, n)
+}
+
+func (sb *superblock_t) w_rootinode(blk int, iidx int) {
+	fieldw(&sb.blk.buf.Data, 3, biencode(blk, iidx))
+}
+
+func (sb *superblock_t) w_lastblock(n int) {
+	fieldw(&sb.blk.buf.Data, 4, n)
+}
+
+func (sb *superblock_t) w_freeinode(n int) {
+	fieldw(&sb.blk.buf.Data, 5, n)
+}
+
+// inode format:
+// bytes, meaning
+// 0-7,    inode type
+// 8-15,   link count
+// 16-23,  size in bytes
+// 24-31,  major
+// 32-39,  minor
+// 40-47,  indirect block
+// 48-119, block addresses
+// ...repeated, totaling 4 times. the last four bytes of an inode block hold
+// its checksum.
+//
+// a free inode has type I_INVALID and its link count field holds the inode
+// number of the next free inode (or zero), forming the free inode list rooted
+// in the superblock.
+type inode_t struct {
+	blk	*bbuf_t
+	ioff	int
+}
+
+// inode file types
+const(
+	I_FIRST = 0
+	I_INVALID = I_FIRST
+	I_FILE  = 1
+	I_DIR   = 2
+	I_DEV   = 3
+	I_LAST = I_DEV
+
+	NIADDRS = 9
+	// number of words in an inode
+	NIWORDS = 6 + NIADDRS
+)
+
+func ifield(iidx int, fieldn int) int {
+	return iidx*NIWORDS + fieldn
+}
+
+// iidx is the inode index; necessary since there are four inodes in one block
+func (ind *inode_t) itype() int {
+	it := fieldr(&ind.blk.buf.Data, ifield(ind.ioff, 0))
+	if it < I_FIRST || it > I_LAST {
+		panic(fmt.Sprintf("weird inode type %d", it))
+	}
+	return it
+}
+
+func (ind *inode_t) linkcount() int {
+	return fieldr(&ind.blk.buf.Data, ifield(ind.ioff, 1))
+}
+
+func (ind *inode_t) size() int {
+	return fieldr(&ind.blk.buf.Data, ifield(ind.ioff, 2))
+}
+
+func (ind *inode_t) major() int {
+	return fieldr(&ind.blk.buf.Data, ifield(ind.ioff, 3))
+}
+
+func (ind *inode_t) minor() int {
+	return fieldr(&ind.blk.buf.Data, ifield(ind.ioff, 4))
+}
+
+func (ind *inode_t) indirect() int {
+	return fieldr(&ind.blk.buf.Data, ifield(ind.ioff, 5))
+}
+
+func (ind *inode_t) addr(i int) int {
+	if i < 0 || i > NIADDRS {
+		panic("bad inode block index")
+	}
+	addroff := 6
+	return fieldr(&ind.blk.buf.Data, ifield(ind.ioff, addroff + i))
+}
+
+func (ind *inode_t) freenext() int {
+	return fieldr(&ind.blk.buf.Data, ifield(ind.ioff, 1))
+}
+
+func (ind *inode_t) w_itype(n int) {
+	if n < I_FIRST || n > I_LAST {
+		panic("weird inode type")
+	}
+	fieldw(&ind.blk.buf.Data, ifield(ind.ioff, 0), n)
+}
+
+func (ind *inode_t) w_linkcount(n int) {
+	fieldw(&ind.blk.buf.Data, ifield(ind.ioff, 1), n)
+}
+
+func (ind *inode_t) w_size(n int) {
+	fieldw(&ind.blk.buf.Data, ifield(ind.ioff, 2), n)
+}
+
+func (ind *inode_t) w_major(n int) {
+	fieldw(&ind.blk.buf.Data, ifield(ind.ioff, 3), n)
+}
+
+func (ind *inode_t) w_minor(n int) {
+	fieldw(&ind.blk.buf.Data, ifield(ind.ioff, 4), n)
+}
+
+func (ind *inode_t) w_freenext(n int) {
+	fieldw(&ind.blk.buf.Data, ifield(ind.ioff, 1), n)
+}
+
+// blk is the block number and iidx in the index of the inode on block blk.
+func (ind *inode_t) w_indirect(blk int) {
+	fieldw(&ind.blk.buf.Data, ifield(ind.ioff, 5), blk)
+}
+
+func (ind *inode_t) w_addr(i int, blk int) {
+	if i < 0 || i > NIADDRS {
+		panic("bad inode block index")
+	}
+	addroff := 6
+	fieldw(&ind.blk.buf.Data, ifield(ind.ioff, addroff + i), blk)
+}
+
+// directory data format
+// 0-13,  file name characters
+// 14-21, inode block/offset
+// ...repeated, totaling 23 times
+// 508-511, checksum
+type dirdata_t struct {
+	blk	*bbuf_t
+}
+
+const(
+	DNAMELEN = 14
+	NDBYTES  = 22
+	NDIRENTS = CKSUMOFF/NDBYTES
+)
+
+func doffset(didx int, off int) int {
+	if didx < 0 || didx >= NDIRENTS {
+		panic("bad dirent index")
+	}
+	return NDBYTES*didx + off
+}
+
+func (dir *dirdata_t) filename(didx int) string {
+	st := doffset(didx, 0)
+	sl := dir.blk.buf.Data[st : st + DNAMELEN]
+	ret := make([]byte, 0)
+	for _, c := range sl {
+		if c != 0 {
+			ret = append(ret, c)
+		}
+	}
+	return string(ret)
+}
+
+func (dir *dirdata_t) inodenext(didx int) inum {
+	st := doffset(didx, 14)
+	v := readn(dir.blk.buf.Data[:], 8, st)
+	return inum(v)
+}
+
+func (dir *dirdata_t) w_filename(didx int, fn string) {
+	st := doffset(didx, 0)
+	sl := dir.blk.buf.Data[st : st + DNAMELEN]
+	l := len(fn)
+	for i := range sl {
+		if i >= l {
+			sl[i] = 0
+		} else {
+			sl[i] = fn[i]
+		}
+	}
+}
+
+func (dir *dirdata_t) w_inodenext(didx int, blk int, iidx int) {
+	st := doffset(didx, 14)
+	v := biencode(blk, iidx)
+	writen(dir.blk.buf.Data[:], 8, st, v)
+}
+
+// number of blocks tracked by the free bitmap
+func balloc_nbits() int {
+	bitsperblk := 512*8
+	ret := superb.lastblock() - usable_start
+	if ret > free_len*bitsperblk {
+		ret = free_len*bitsperblk
+	}
+	return ret
+}
+
+// counts the free blocks of each block group. a block group is the range of
+// blocks described by a single free bitmap block.
+func balloc_init() {
+	fblock.Lock()
+	defer fblock.Unlock()
+
+	bitsperblk := 512*8
+	nbits := balloc_nbits()
+	fgroups = make([]int, free_len)
+	total := 0
+	for g := range fgroups {
+		blk := bmust(bread(free_start + g))
+		for i := 0; i < bitsperblk && g*bitsperblk + i < nbits; i++ {
+			if blk.buf.Data[i/8] & (1 << uint(i % 8)) == 0 {
+				fgroups[g]++
+			}
+		}
+		brelse(blk)
+		total += fgroups[g]
+	}
+	fcursor = 0
+	fmt.Printf("%v free blocks in %v groups\n", total, len(fgroups))
+}
+
+// searches block group g for a free block, starting at bit from of the group.
+// returns the bit index of the free block within the group. the caller must
+// hold fblock.
+func bgroup_scan(g int, from int) (int, bool) {
+	bitsperblk := 512*8
+	lim := balloc_nbits() - g*bitsperblk
+	if lim > bitsperblk {
+		lim = bitsperblk
+	}
+	blk := bmust(bread(free_start + g))
+	defer brelse(blk)
+	for i := from; i < lim; {
+		c := blk.buf.Data[i/8]
+		if i % 8 == 0 && c == 0xff {
+			// skip whole allocated bytes
+			i += 8
+			continue
+		}
+		if c & (1 << uint(i % 8)) == 0 {
+			blk.buf.Data[i/8] |= 1 << uint(i % 8)
+			log_write(blk)
+			return i, true
+		}
+		i++
+	}
+	return 0, false
+}
+
+// allocates a block, marking it used in the free block bitmap. free blocks and
+// log blocks are not accounted for in the free bitmap; all others are. the
+// block following goal is preferred; if goal is not a data block, the search
+// starts at the allocation cursor instead. block groups without free blocks
+// are skipped using the in-memory free counts. balloc should only ever
+// acquire fblock.
+func balloc(goal int) int {
+	fst := free_start
+	flen := free_len
+	if fst == 0 || flen == 0 {
+		panic("fs not initted")
+	}
+
+	fblock.Lock()
+	defer fblock.Unlock()
+
+	bitsperblk := 512*8
+	start := goal - usable_start + 1
+	if goal < usable_start || start >= balloc_nbits() {
+		start = fcursor
+	}
+	sg := start/bitsperblk
+	ng := len(fgroups)
+	// the starting group is visited twice: once from the start bit and,
+	// after wrapping around, from its first bit
+	for n := 0; n <= ng; n++ {
+		g := (sg + n) % ng
+		if fgroups[g] == 0 {
+			continue
+		}
+		from := 0
+		if n == 0 {
+			from = start % bitsperblk
+		}
+		bit, ok := bgroup_scan(g, from)
+		if !ok {
+			continue
+		}
+		fgroups[g]--
+		ret := g*bitsperblk + bit
+		fcursor = (ret + 1) % balloc_nbits()
+		return usable_start + ret
+	}
+	panic("no free blocks")
+}
+
+// frees a block, marking it free in the free block bitmap. bfree should only
+// ever acquire fblock.
+func bfree(blkn int) {
+	bit := blkn - usable_start
+	if bit < 0 {
+		panic("free of non-data block")
+	}
+
+	fblock.Lock()
+	defer fblock.Unlock()
+
+	bitsperblk := 512*8
+	blk := bmust(bread(free_start + bit/bitsperblk))
+	oct := (bit % bitsperblk)/8
+	m := uint8(1 << uint(bit % 8))
+	if blk.buf.Data[oct] & m == 0 {
+		panic("block already free")
+	}
+	blk.buf.Data[oct] &^= m
+	log_write(blk)
+	brelse(blk)
+	fgroups[bit/bitsperblk]++
+}
+
+// allocates and zeros a new inode block and pushes all of its inodes onto the
+// free inode list. the caller must hold filock.
+func iblk_new() {
+	blkn := balloc(0)
+	zblk := bmust(bread(blkn))
+	for i := range zblk.buf.Data {
+		zblk.buf.Data[i] = 0
+	}
+	zblk.meta = true
+	blkwords := 512/8
+	isperblk := blkwords/NIWORDS
+	next := superb.freeinode()
+	for i := isperblk - 1; i >= 0; i-- {
+		ind := &inode_t{zblk, i}
+		ind.w_itype(I_INVALID)
+		ind.w_freenext(next)
+		next = biencode(blkn, i)
+	}
+	log_write(zblk)
+	brelse(zblk)
+	superb.w_freeinode(next)
+}
+
+// returns block/index of free inode, removing it from the free inode list.
+// callers must synchronize access to this block via filetree locks.
+func ialloc() (int, int) {
+	filock.Lock()
+	defer filock.Unlock()
+
+	if superb.freeinode() == 0 {
+		iblk_new()
+	}
+	blkn, ioff := bidecode(superb.freeinode())
+	blk := bmust(bread_meta(blkn))
+	ind := &inode_t{blk, ioff}
+	if ind.itype() != I_INVALID {
+		panic("free inode is in use")
+	}
+	superb.w_freeinode(ind.freenext())
+	ind.w_freenext(0)
+	log_write(blk)
+	brelse(blk)
+	log_write(superb.blk)
+	return blkn, ioff
+}
+
+// returns the inode priv to the free inode list.
+func ifree(priv inum) {
+	filock.Lock()
+	defer filock.Unlock()
+
+	blkn, ioff := bidecode(int(priv))
+	blk := bmust(bread_meta(blkn))
+	ind := &inode_t{blk, ioff}
+	ind.w_itype(I_INVALID)
+	ind.w_freenext(superb.freeinode())
+	ind.w_size(0)
+	ind.w_major(0)
+	ind.w_minor(0)
+	ind.w_indirect(0)
+	for i := 0; i < NIADDRS; i++ {
+		ind.w_addr(i, 0)
+	}
+	log_write(blk)
+	brelse(blk)
+	superb.w_freeinode(int(priv))
+	log_write(superb.blk)
+}
+
+type bbuf_t struct {
+	buf	*Diskbuf_t
+	dirty	bool
+	// true if the block holds checksummed metadata: a superblock, an inode
+	// block, or a directory data block
+	meta	bool
+	// neighbors in the block cache's LRU list
+	lprev	*bbuf_t
+	lnext	*bbuf_t
+	// set on buffers handed to requesters when the block could not be
+	// read; such buffers are not cached
+	err	int
+}
+
+// writes the block to disk. the block stays dirty if the write fails.
+func (b *bbuf_t) writeback() int {
+	err := fs_writeall([]*Diskbuf_t{b.buf})
+	if err == 0 {
+		b.dirty = false
+	}
+	return err
+}
+
+// writes bufs to the file system's device
+func fs_writeall(bufs []*Diskbuf_t) int {
+	return fsdev.Write(bufs)
+}
+
+// makes the writes that finished before the call stable: disks with a
+// volatile write cache may otherwise reorder them or lose them on power loss.
+func fs_flush() int {
+	return fsdev.Flush()
+}
+
+// non-zero once a write to the file system's device has failed. the file
+// system is read-only from then on: the log cannot be reused safely once a
+// logged block may have failed to reach its home location.
+var fs_failed	int32
+
+// remounts the file system read-only after a failed write
+func fs_ioerr(what string) {
+	if atomic.CompareAndSwapInt32(&fs_failed, 0, 1) {
+		fmt.Printf("fs: %v failed; remounting read-only\n", what)
+	}
+}
+
+// returns -EROFS if the file system was remounted read-only. operations that
+// modify the file system check before they begin.
+func fs_rdonly() int {
+	if atomic.LoadInt32(&fs_failed) != 0 {
+		return -EROFS
+	}
+	return 0
+}
+
+type bcreq_t struct {
+	blkno	int
+	ack	chan *bbuf_t
+}
+
+func bcreq_new(blkno int) *bcreq_t {
+	return &bcreq_t{blkno, make(chan *bbuf_t)}
+}
+
+// a doubly-linked list of cached blocks, most recently used first
+type lru_t struct {
+	head	*bbuf_t
+	tail	*bbuf_t
+}
+
+func (l *lru_t) remove(b *bbuf_t) {
+	if b.lprev != nil {
+		b.lprev.lnext = b.lnext
+	} else {
+		l.head = b.lnext
+	}
+	if b.lnext != nil {
+		b.lnext.lprev = b.lprev
+	} else {
+		l.tail = b.lprev
+	}
+	b.lprev = nil
+	b.lnext = nil
+}
+
+func (l *lru_t) push(b *bbuf_t) {
+	b.lprev = nil
+	b.lnext = l.head
+	if l.head != nil {
+		l.head.lprev = b
+	} else {
+		l.tail = b
+	}
+	l.head = b
+}
+
+// marks b as the most recently used block
+func (l *lru_t) touch(b *bbuf_t) {
+	l.remove(b)
+	l.push(b)
+}
+
+// the block cache holds at least BC_MINBUFS blocks
+const BC_MINBUFS	= 512
+
+type bcdaemon_t struct {
+	req		chan *bcreq_t
+	bnew		chan *bbuf_t
+	done		chan int
+	blocks		map[int]*bbuf_t
+	given		map[int]bool
+	waiters		map[int][]*chan *bbuf_t
+	lru		lru_t
+	// the number of blocks the cache should hold
+	nbufs		int
+	// writers blocked until the cache shrinks to nbufs blocks
+	throttle	chan chan bool
+	throttled	[]chan bool
+	// wakes the flusher
+	flush		chan bool
+	// blocks to read ahead
+	prefetch	chan []int
+}
+
+func (blc *bcdaemon_t) init(nbufs int) {
+	blc.req = make(chan *bcreq_t)
+	blc.bnew = make(chan *bbuf_t)
+	blc.done = make(chan int)
+	blc.blocks = make(map[int]*bbuf_t)
+	blc.given = make(map[int]bool)
+	blc.waiters = make(map[int][]*chan *bbuf_t)
+	blc.throttle = make(chan chan bool)
+	blc.throttled = make([]chan bool, 0)
+	blc.flush = make(chan bool, 1)
+	blc.prefetch = make(chan []int)
+
+	blc.nbufs = nbufs
+	if blc.nbufs < BC_MINBUFS {
+		blc.nbufs = BC_MINBUFS
+	}
+	fmt.Printf("block cache: %v blocks\n", blc.nbufs)
+	go bc_flusher(blc.flush)
+}
+
+// returns a bbuf_t for the specified block
+func (blc *bcdaemon_t) bc_read(blkno int, ack *chan *bbuf_t) {
+	ret, ok := blc.blocks[blkno]
+	if !ok {
+		// add requester to queue before kicking off disk read
+		blc.qadd(blkno, ack)
+		go blc.fill(blkno, 1)
+		return
+	}
+	blc.lru.touch(ret)
+	*ack <- ret
+}
+
+// starts reading blocks that are not cached without waiting for them. blocks
+// that are cached or in use are skipped, as is the whole request when the
+// cache is full.
+// consecutive blocks are read with a single disk request.
+func (blc *bcdaemon_t) bc_prefetch(blks []int) {
+	start, n := 0, 0
+	for _, blkno := range blks {
+		if len(blc.blocks) + n >= blc.nbufs {
+			break
+		}
+		if blc.given[blkno] {
+			continue
+		}
+		if _, ok := blc.blocks[blkno]; ok {
+			continue
+		}
+		if n != 0 && blkno != start + n {
+			go blc.fill(start, n)
+			n = 0
+		}
+		if n == 0 {
+			start = blkno
+		}
+		n++
+		// the block is busy until the read finishes; requests in the
+		// meantime wait for it
+		blc.given[blkno] = true
+	}
+	if n != 0 {
+		go blc.fill(start, n)
+	}
+}
+
+// reads n consecutive blocks from disk and hands them to the daemon, marked
+// with the error if the read failed
+func (blc *bcdaemon_t) fill(start int, n int) {
+	bufs := make([]*Diskbuf_t, n)
+	for i := range bufs {
+		bufs[i] = &Diskbuf_t{Block: int32(start + i)}
+	}
+	err := fsdev.Read(bufs)
+	if err != 0 {
+		fmt.Printf("fs: disk read of blocks %v-%v failed\n", start,
+		    start + n - 1)
+	}
+	for _, b := range bufs {
+		blc.bnew <- &bbuf_t{buf: b, err: err}
+	}
+}
+
+func (blc *bcdaemon_t) qadd(blkno int, ack *chan *bbuf_t) {
+	q, ok := blc.waiters[blkno]
+	if !ok {
+		q = make([]*chan *bbuf_t, 1, 8)
+		blc.waiters[blkno] = q
+		q[0] = ack
+		return
+	}
+	blc.waiters[blkno] = append(q, ack)
+}
+
+func (blc *bcdaemon_t) qpop(blkno int) (*chan *bbuf_t, bool) {
+	q, ok := blc.waiters[blkno]
+	if !ok || len(q) == 0 {
+		return nil, false
+	}
+	ret := q[0]
+	blc.waiters[blkno] = q[1:]
+	return ret, true
+}
+
+func bc_daemon(blc *bcdaemon_t) {
+	for {
+		select {
+		case r := <- blc.req:
+			// block request
+			if r.blkno < 0 {
+				panic("bad block")
+			}
+			inuse := blc.given[r.blkno]
+			if !inuse {
+				blc.given[r.blkno] = true
+				blc.bc_read(r.blkno, &r.ack)
+			} else {
+				blc.qadd(r.blkno, &r.ack)
+			}
+		case bfin := <- blc.done:
+			// relinquish block
+			if bfin < 0 {
+				panic("bad block")
+			}
+			inuse := blc.given[bfin]
+			if !inuse {
+				panic("relinquish unused block")
+			}
+			nextc, ok := blc.qpop(bfin)
+			if ok {
+				// busy blocks cannot be evicted
+				blk, _ := blc.blocks[bfin]
+				*nextc <- blk
+			} else {
+				blc.given[bfin] = false
+				blc.chk_evict()
+			}
+		case nb := <- blc.bnew:
+			// disk read finished
+			blkno := int(nb.buf.Block)
+			if nb.err != 0 {
+				// every waiter gets the error. the block is not
+				// cached so that later requests read it again.
+				for {
+					nextc, ok := blc.qpop(blkno)
+					if !ok {
+						break
+					}
+					*nextc <- nb
+				}
+				delete(blc.waiters, blkno)
+				blc.given[blkno] = false
+				break
+			}
+			blc.blocks[blkno] = nb
+			blc.lru.push(nb)
+			nextc, ok := blc.qpop(blkno)
+			if ok {
+				*nextc <- nb
+			} else {
+				// prefetched block
+				blc.given[blkno] = false
+			}
+			blc.chk_evict()
+		case blks := <- blc.prefetch:
+			blc.bc_prefetch(blks)
+		case ack := <- blc.throttle:
+			if len(blc.blocks) <= blc.nbufs {
+				ack <- true
+			} else {
+				blc.throttled = append(blc.throttled, ack)
+				blc.kick()
+			}
+		}
+	}
+}
+
+// evicts the least recently used blocks until the cache holds at most nbufs
+// blocks. busy and dirty blocks cannot be evicted; if they alone exceed the
+// capacity, the cache grows temporarily and the flusher is woken to clean
+// the dirty blocks.
+func (blc *bcdaemon_t) chk_evict() {
+	for bb := blc.lru.tail; bb != nil && len(blc.blocks) > blc.nbufs; {
+		prev := bb.lprev
+		blkno := int(bb.buf.Block)
+		// the holder of a given block may be changing dirty
+		if !blc.given[blkno] && !bb.dirty {
+			blc.lru.remove(bb)
+			delete(blc.blocks, blkno)
+			delete(blc.given, blkno)
+		}
+		bb = prev
+	}
+	if len(blc.blocks) > blc.nbufs {
+		blc.kick()
+		return
+	}
+	for _, ack := range blc.throttled {
+		ack <- true
+	}
+	blc.throttled = blc.throttled[0:0]
+}
+
+func (blc *bcdaemon_t) kick() {
+	select {
+	case blc.flush <- true:
+	default:
+	}
+}
+
+// commits and installs the logged blocks when the block cache is full of
+// dirty blocks. dirty blocks are only written to their home locations once
+// their transaction is committed, so they become clean, and thus evictable,
+// when their transaction is installed.
+func bc_flusher(kick chan bool) {
+	for {
+		<- kick
+		log_sync(true)
+	}
+}
+
+// blocks the caller while the block cache holds more blocks than its
+// capacity. operations call bc_throttle() before they begin so that they
+// don't hold any blocks while blocked.
+func bc_throttle() {
+	ack := make(chan bool)
+	bcdaemon.throttle <- ack
+	<- ack
+}
+
+// returns a cached block without changing whether it is considered metadata,
+// or -EIO if the block could not be read. the caller must not brelse the
+// block on error.
+func bget(blkno int) (*bbuf_t, int) {
+	req := bcreq_new(blkno)
+	bcdaemon.req <- req
+	ret := <- req.ack
+	if ret.err != 0 {
+		return nil, ret.err
+	}
+	return ret, 0
+}
+
+// returns the block from bread() and friends, panicking if it could not be
+// read. for blocks without which the file system cannot operate, such as the
+// free bitmap and the log.
+func bmust(b *bbuf_t, err int) *bbuf_t {
+	if err != 0 {
+		panic("cannot read a critical file system block")
+	}
+	return b
+}
+
+// asynchronously reads blocks into the cache in anticipation of their use.
+func bprefetch(blks []int) {
+	if len(blks) != 0 {
+		bcdaemon.prefetch <- blks
+	}
+}
+
+// returns a block that holds file data, an indirect block, or a free bitmap
+// block.
+func bread(blkno int) (*bbuf_t, int) {
+	ret, err := bget(blkno)
+	if err != 0 {
+		return nil, err
+	}
+	ret.meta = false
+	return ret, 0
+}
+
+// returns a metadata block, verifying its checksum the first time it is used
+// as metadata since it was read from disk. a corrupt block is an I/O error.
+func bread_meta(blkno int) (*bbuf_t, int) {
+	ret, err := bget(blkno)
+	if err != 0 {
+		return nil, err
+	}
+	if !ret.meta {
+		if !cksum_ok(&ret.buf.Data) {
+			fmt.Printf("fs: bad checksum for block %v\n", blkno)
+			brelse(ret)
+			return nil, -EIO
+		}
+		ret.meta = true
+	}
+	return ret, 0
+}
+
+var crc32c_tab = crc32.MakeTable(crc32.Castagnoli)
+
+// metadata blocks and the log commit record end with a CRC32C of the rest of
+// the block.
+const CKSUMOFF = 512 - 4
+
+func cksum_ok(d *[512]uint8) bool {
+	want := crc32.Checksum(d[:CKSUMOFF], crc32c_tab)
+	return uint32(readn(d[:], 4, CKSUMOFF)) == want
+}
+
+func cksum_set(d *[512]uint8) {
+	sum := crc32.Checksum(d[:CKSUMOFF], crc32c_tab)
+	writen(d[:], 4, CKSUMOFF, int(sum))
+}
+
+func brelse(b *bbuf_t) {
+	bcdaemon.done <- int(b.buf.Block)
+}
+
+// list of dirty blocks that are pending commit.
+type log_t struct {
+	blks		[]int
+	logstart	int
+	// number of descriptor blocks following the commit record
+	ndesc		int
+	// number of blocks the log can hold, not counting the commit record
+	// and descriptor blocks
+	loglen		int
+	// sequence number of the last committed transaction
+	seq		int
+	incoming	chan int
+	admission	chan *logadm_t
+	done		chan bool
+	syncs		chan *logsync_t
+	// true while the previously committed transaction is being installed
+	installing	bool
+	installed	chan bool
+}
+
+// a request to begin an operation which logs at most nblks distinct blocks
+type logadm_t struct {
+	nblks	int
+	ack	chan bool
+}
+
+// a request to commit all finished operations. if install is true, the
+// requester also waits for them to be installed. the requester receives
+// -EIO if the file system failed to write its blocks.
+type logsync_t struct {
+	install	bool
+	ack	chan int
+}
+
+// how often finished operations are committed when nobody asks for it
+const LOG_INTERVAL = 500*time.Millisecond
+
+// log format:
+// block, meaning
+// 0,     commit record
+// 1-n,   descriptor blocks
+// n+1-,  logged blocks
+//
+// descriptor block format:
+// bytes,   meaning
+// 0-3,     destination of a logged block
+// 4-7,     CRC32C of the logged block
+// ...repeated, totaling 63 times
+// 504-511, sequence number of the transaction
+const LOGDPB = 512/8 - 1
+
+// commit record format:
+// bytes, meaning
+// 0-7,   magic
+// 8-15,  transaction sequence number
+// 16-23, number of logged blocks
+// 24-31, CRC32C of the descriptor blocks in use
+// 508-511, checksum
+type logcommit_t struct {
+	blk	*bbuf_t
+}
+
+const LOG_MAGIC = 0x6269736375697421
+
+func (cr *logcommit_t) magic() int {
+	return fieldr(&cr.blk.buf.Data, 0)
+}
+
+func (cr *logcommit_t) seq() int {
+	return fieldr(&cr.blk.buf.Data, 1)
+}
+
+func (cr *logcommit_t) nblks() int {
+	return fieldr(&cr.blk.buf.Data, 2)
+}
+
+func (cr *logcommit_t) dsum() uint32 {
+	return uint32(fieldr(&cr.blk.buf.Data, 3))
+}
+
+func (cr *logcommit_t) w_magic(n int) {
+	fieldw(&cr.blk.buf.Data, 0, n)
+}
+
+func (cr *logcommit_t) w_seq(n int) {
+	fieldw(&cr.blk.buf.Data, 1, n)
+}
+
+func (cr *logcommit_t) w_nblks(n int) {
+	fieldw(&cr.blk.buf.Data, 2, n)
+}
+
+func (cr *logcommit_t) w_dsum(n uint32) {
+	fieldw(&cr.blk.buf.Data, 3, int(n))
+}
+
+func (log *log_t) init(ls int, ll int) {
+	log.logstart = ls
+	// the commit record is followed by an array of log block destinations
+	ll--
+	log.ndesc = (ll + LOGDPB)/(LOGDPB + 1)
+	log.loglen = ll - log.ndesc
+	if log.loglen <= 0 {
+		panic("log too small")
+	}
+	log.blks = make([]int, 0, log.loglen)
+	log.incoming = make(chan int)
+	log.admission = make(chan *logadm_t)
+	log.done = make(chan bool)
+	log.syncs = make(chan *logsync_t)
+	log.installed = make(chan bool)
+}
+
+// returns the block number of the descriptor block and the offset within it
+// holding the destination and checksum of the ith log block
+func (log *log_t) destoff(i int) (int, int) {
+	return log.logstart + 1 + i/LOGDPB, 8*(i % LOGDPB)
+}
+
+// returns the number of descriptor blocks used by n logged blocks
+func (log *log_t) ndescs(n int) int {
+	return (n + LOGDPB - 1)/LOGDPB
+}
+
+// returns the block number of the ith log block
+func (log *log_t) logblk(i int) int {
+	return log.logstart + 1 + log.ndesc + i
+}
+
+func (log *log_t) append(blkn int) {
+	// log absorption
+	for _, b := range log.blks {
+		if b == blkn {
+			return
+		}
+	}
+	log.blks = append(log.blks, blkn)
+	if len(log.blks) > log.loglen {
+		panic("log larger than log len")
+	}
+}
+
+// writes the logged blocks and the commit record to disk. once the commit
+// record is written, the transaction is durable; installing the blocks in
+// their home locations is left to a background goroutine. the next commit
+// waits for the installation to finish before reusing the log.
+func (log *log_t) commit() {
+	if len(log.blks) == 0 {
+		// nothing to commit
+		return
+	}
+
+	log.install_wait()
+	if fs_rdonly() != 0 {
+		// the logged blocks stay dirty in the block cache and are
+		// never written
+		log.blks = log.blks[0:0]
+		return
+	}
+	// no operations are running, thus the logged blocks hold exactly the
+	// committed state. snapshot them so that the installer doesn't write
+	// changes of later, uncommitted transactions to their home locations.
+	seq := log.seq + 1
+	copies := make([]*Diskbuf_t, len(log.blks))
+	descs := make([]*Diskbuf_t, 0)
+	for i, lbn := range log.blks {
+		src := bmust(log_bread(lbn))
+		if src.meta {
+			cksum_set(&src.buf.Data)
+		}
+		copies[i] = &Diskbuf_t{Block: int32(log.logblk(i))}
+		copies[i].Data = src.buf.Data
+		log_brelse(src)
+
+		// install log destination and checksum in its descriptor block
+		dn, doff := log.destoff(i)
+		if len(descs) == 0 || int(descs[len(descs) - 1].Block) != dn {
+			nd := &Diskbuf_t{Block: int32(dn)}
+			fieldw(&nd.Data, LOGDPB, seq)
+			descs = append(descs, nd)
+		}
+		d := descs[len(descs) - 1].Data[:]
+		writen(d, 4, doff, lbn)
+		sum := crc32.Checksum(copies[i].Data[:], crc32c_tab)
+		writen(d, 4, doff + 4, int(sum))
+	}
+	dsum := uint32(0)
+	for _, d := range descs {
+		dsum = crc32.Update(dsum, crc32c_tab, d.Data[:])
+	}
+
+	// write the descriptor and log blocks. they must be stable before the
+	// commit record is written, or the disk could write the commit record
+	// first and a crash would leave a committed transaction with garbage
+	// in the log.
+	if fs_writeall(append(descs, copies...)) != 0 || fs_flush() != 0 {
+		fs_ioerr("log write")
+		log.blks = log.blks[0:0]
+		return
+	}
+
+	// commit log
+	log.seq = seq
+	cbuf := &Diskbuf_t{Block: int32(log.logstart)}
+	cr := logcommit_t{&bbuf_t{buf: cbuf}}
+	cr.w_magic(LOG_MAGIC)
+	cr.w_seq(log.seq)
+	cr.w_nblks(len(log.blks))
+	cr.w_dsum(dsum)
+	cksum_set(&cbuf.Data)
+	// the transaction is durable once the commit record is stable
+	if fsdev.Writefua([]*Diskbuf_t{cbuf}) != 0 {
+		// the transaction may or may not be committed
+		fs_ioerr("log commit")
+		log.blks = log.blks[0:0]
+		return
+	}
+
+	//runtime.Crash()
+
+	// the log is committed. if we crash while installing the blocks to
+	// their destinations, we should be able to recover
+	dsts := make([]int, len(log.blks))
+	copy(dsts, log.blks)
+	log.installing = true
+	go log_install(dsts, copies, log.installed)
+
+	log.blks = log.blks[0:0]
+}
+
+// writes the committed copies of the logged blocks to their home locations. a
+// failed write leaves the transaction in the log, where the next boot finds
+// it, and makes the file system read-only so that the log is not reused.
+func log_install(dsts []int, copies []*Diskbuf_t, done chan bool) {
+	failed := false
+	for i, lbn := range dsts {
+		copies[i].Block = int32(lbn)
+		var err int
+		// the superblock is never released to the block cache
+		if lbn == superb_start {
+			err = fs_writeall([]*Diskbuf_t{copies[i]})
+		} else {
+			blk := bmust(bget(lbn))
+			if blk.buf.Data == copies[i].Data {
+				err = blk.writeback()
+			} else {
+				// modified by a later transaction; the block
+				// stays dirty until that transaction is
+				// installed
+				err = fs_writeall([]*Diskbuf_t{copies[i]})
+			}
+			brelse(blk)
+		}
+		if err != 0 {
+			failed = true
+		}
+	}
+	// the next commit overwrites the log, which must not happen before
+	// the installed blocks are stable
+	if !failed && fs_flush() != 0 {
+		failed = true
+	}
+	if failed {
+		fs_ioerr("log installation")
+	}
+	done <- true
+}
+
+// waits for the installation of the previously committed transaction.
+func (log *log_t) install_wait() {
+	if log.installing {
+		<- log.installed
+		log.installing = false
+	}
+}
+
+// admits operations as long as the sum of their reserved blocks fits in the
+// log. the finished operations are committed together once all admitted
+// operations have finished and either an operation doesn't fit in the log, a
+// sync was requested, or LOG_INTERVAL has passed. no more operations are
+// admitted while an operation or a sync is waiting for the commit.
+func log_daemon(l *log_t) {
+	var waiting *logadm_t
+	syncers := make([]*logsync_t, 0)
+	tick := time.Tick(LOG_INTERVAL)
+	due := false
+	reserved := 0
+	t := 0
+	for {
+		adm := l.admission
+		if waiting != nil || len(syncers) != 0 {
+			adm = nil
+		}
+		select {
+		case nb := <- l.incoming:
+			if t <= 0 {
+				panic("oh noes")
+			}
+			l.append(nb)
+		case <- l.done:
+			t--
+		case r := <- adm:
+			if r.nblks > l.loglen {
+				panic("operation larger than log")
+			}
+			if reserved + r.nblks > l.loglen {
+				// wait for the log to drain
+				waiting = r
+				break
+			}
+			reserved += r.nblks
+			t++
+			r.ack <- true
+		case r := <- l.syncs:
+			syncers = append(syncers, r)
+		case <- tick:
+			due = true
+		}
+
+		if t != 0 || (waiting == nil && len(syncers) == 0 && !due) {
+			continue
+		}
+		l.commit()
+		due = false
+		reserved = 0
+		for _, r := range syncers {
+			if r.install {
+				l.install_wait()
+			}
+			err := 0
+			if fs_rdonly() != 0 {
+				err = -EIO
+			}
+			r.ack <- err
+		}
+		syncers = syncers[0:0]
+		if waiting != nil {
+			reserved = waiting.nblks
+			t = 1
+			waiting.ack <- true
+			waiting = nil
+		}
+	}
+}
+
+// like bread/brelse, but for blocks that may be the superblock, which stays in
+// the block cache for good and thus cannot be bread again.
+func log_bread(blkn int) (*bbuf_t, int) {
+	if blkn == superb_start {
+		return superb.blk, 0
+	}
+	return bget(blkn)
+}
+
+func log_brelse(b *bbuf_t) {
+	if b != superb.blk {
+		brelse(b)
+	}
+}
+
+// blocks until there is room in the log for an operation that logs at most
+// nblks distinct blocks.
+func op_begin(nblks int) {
+	bc_throttle()
+	r := &logadm_t{nblks, make(chan bool)}
+	fslog.admission <- r
+	<- r.ack
+}
+
+func op_end() {
+	fslog.done <- true
+}
+
+// waits until all finished operations are committed. if install is true, also
+// waits until they are installed in their home locations. returns -EIO if the
+// file system has failed to write its blocks, in which case they may not be
+// on disk.
+func log_sync(install bool) int {
+	r := &logsync_t{install, make(chan int)}
+	fslog.syncs <- r
+	return <- r.ack
+}
+
+func log_write(b *bbuf_t) {
+	b.dirty = true
+	fslog.incoming <- int(b.buf.Block)
+}
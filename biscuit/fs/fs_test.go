@@ -0,0 +1,596 @@
+package fs
+
+import "bytes"
+import "flag"
+import "fmt"
+import "hash/crc32"
+import "os"
+import "strings"
+import "sync"
+import "testing"
+
+// the file system is global, so all tests share one, made when the tests
+// start. each test works in a directory of its own. directories have no
+// indirect blocks, so they hold at most NIADDRS*NDIRENTS entries.
+
+var image = flag.String("image", "", "run the tests on a file system " +
+    "made in this file instead of in memory")
+// mkbdisk.py makes logs of 31 blocks by default. a transaction fills at most
+// half of the log, thus only logs of more than about 130 blocks have
+// transactions that take several descriptor blocks.
+var loglen = flag.Int("log", 200, "the length of the file system's log")
+
+// the size of the test file system in blocks
+const TBLKS = 16384
+
+// the disk of the test file system
+var tdisk	Disk_i
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	var d Disk_i
+	if *image != "" {
+		fd, err := filedisk_new(*image, TBLKS)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(2)
+		}
+		d = fd
+	} else {
+		d = memdisk_new(TBLKS)
+	}
+	if mkfs(d, *loglen) != 0 || !Fs_probe(d) {
+		fmt.Fprintf(os.Stderr, "cannot make file system\n")
+		os.Exit(2)
+	}
+	// the smallest cache, so that blocks are evicted
+	tdisk = d
+	Fs_init(d, BC_MINBUFS)
+	os.Exit(m.Run())
+}
+
+func sp(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+// returns the number of free blocks
+func nfree() int {
+	fblock.Lock()
+	defer fblock.Unlock()
+	ret := 0
+	for _, n := range fgroups {
+		ret += n
+	}
+	return ret
+}
+
+// returns n bytes that differ for each seed and offset
+func pattern(seed int, n int) []uint8 {
+	ret := make([]uint8, n)
+	for i := range ret {
+		ret[i] = uint8(seed*7 + i + i/251)
+	}
+	return ret
+}
+
+// fills the block cache with other blocks so that clean blocks are evicted
+// and read from the disk again
+func evict(t *testing.T) {
+	if err := Fs_sync(); err != 0 {
+		t.Fatalf("sync: %v", err)
+	}
+	f := open(t, "evict", true)
+	d := make([]uint8, 2*BC_MINBUFS*512)
+	write(t, f, d, 0)
+	check(t, f, d, 0)
+	fclose(t, f)
+	if err := Fs_unlink(sp("evict")); err != 0 {
+		t.Fatalf("unlink: %v", err)
+	}
+}
+
+func mkdir(t *testing.T, path string) {
+	if err := Fs_mkdir(sp(path)); err != 0 {
+		t.Fatalf("mkdir %v: %v", path, err)
+	}
+}
+
+func open(t *testing.T, path string, create bool) *Ifile_t {
+	f, err := Fs_open(sp(path), create)
+	if err != 0 {
+		t.Fatalf("open %v: %v", path, err)
+	}
+	return f
+}
+
+func fclose(t *testing.T, f *Ifile_t) {
+	if err := f.Close(); err != 0 {
+		t.Fatalf("close: %v", err)
+	}
+}
+
+func stat(t *testing.T, f *Ifile_t) *Stat_t {
+	st := &Stat_t{}
+	if err := f.Stat(st); err != 0 {
+		t.Fatalf("stat: %v", err)
+	}
+	return st
+}
+
+func write(t *testing.T, f *Ifile_t, d []uint8, offset int) {
+	n, err := f.Write([][]uint8{d}, offset, false)
+	if err != 0 || n != len(d) {
+		t.Fatalf("write of %v at %v: %v, %v", len(d), offset, n, err)
+	}
+}
+
+// checks that the file holds want at offset
+func check(t *testing.T, f *Ifile_t, want []uint8, offset int) {
+	got := make([]uint8, len(want))
+	n, err := f.Read([][]uint8{got}, offset)
+	if err != 0 || n != len(want) {
+		t.Fatalf("read of %v at %v: %v, %v", len(want), offset, n, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("read of %v at %v: wrong data", len(want), offset)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	mkdir(t, "create")
+	f := open(t, "create/a", true)
+	st := stat(t, f)
+	if st.Itype != I_FILE || st.Links != 1 || st.Size != 0 {
+		t.Fatalf("new file: %+v", st)
+	}
+	if _, err := Fs_open(sp("create/a"), true); err != -EEXIST {
+		t.Fatalf("create of existing file: %v", err)
+	}
+	if stat(t, open(t, "create/a", false)).Ino != st.Ino {
+		t.Fatalf("open finds another inode")
+	}
+	if _, err := Fs_open(sp("create/b"), false); err != -ENOENT {
+		t.Fatalf("open of missing file: %v", err)
+	}
+	if _, err := Fs_open(sp("create/no/b"), true); err != -ENOENT {
+		t.Fatalf("create in missing directory: %v", err)
+	}
+	if err := Fs_mknod(sp("create/dev"), 4, 2); err != 0 {
+		t.Fatalf("mknod: %v", err)
+	}
+	st = stat(t, open(t, "create/dev", false))
+	if st.Itype != I_DEV || st.Major != 4 || st.Minor != 2 {
+		t.Fatalf("device file: %+v", st)
+	}
+}
+
+func TestWriteRead(t *testing.T) {
+	mkdir(t, "rw")
+	f := open(t, "rw/f", true)
+	d := pattern(1, 3000)
+	write(t, f, d, 0)
+	if st := stat(t, f); st.Size != len(d) {
+		t.Fatalf("size %v after write of %v", st.Size, len(d))
+	}
+	check(t, f, d, 0)
+	check(t, f, d[700:1900], 700)
+
+	// overwrite across a block boundary
+	o := pattern(2, 100)
+	write(t, f, o, 1000)
+	copy(d[1000:], o)
+	check(t, f, d, 0)
+
+	// append
+	a := pattern(3, 600)
+	n, err := f.Write([][]uint8{a}, 0, true)
+	if err != 0 || n != len(a) {
+		t.Fatalf("append: %v, %v", n, err)
+	}
+	d = append(d, a...)
+	check(t, f, d, 0)
+
+	// reads stop at the end of the file
+	buf := make([]uint8, 100)
+	n, err = f.Read([][]uint8{buf}, len(d) - 10)
+	if err != 0 || n != 10 {
+		t.Fatalf("read at end: %v, %v", n, err)
+	}
+	n, err = f.Read([][]uint8{buf}, len(d))
+	if err != 0 || n != 0 {
+		t.Fatalf("read past end: %v, %v", n, err)
+	}
+
+	// several buffers
+	b1 := make([]uint8, 512)
+	b2 := make([]uint8, 77)
+	n, err = f.Read([][]uint8{b1, b2}, 5)
+	if err != 0 || n != len(b1) + len(b2) ||
+	    !bytes.Equal(append(b1, b2...), d[5:5 + n]) {
+		t.Fatalf("read into two buffers: %v, %v", n, err)
+	}
+
+	if err := f.Truncate(100); err != 0 {
+		t.Fatalf("truncate: %v", err)
+	}
+	if st := stat(t, f); st.Size != 100 {
+		t.Fatalf("size %v after truncate", st.Size)
+	}
+	check(t, f, d[:100], 0)
+	if err := f.Fsync(); err != 0 {
+		t.Fatalf("fsync: %v", err)
+	}
+}
+
+func TestLink(t *testing.T) {
+	mkdir(t, "link")
+	mkdir(t, "link/d")
+	f := open(t, "link/a", true)
+	d := pattern(4, 1234)
+	write(t, f, d, 0)
+
+	if err := Fs_link(sp("link/a"), sp("link/d/b")); err != 0 {
+		t.Fatalf("link: %v", err)
+	}
+	g := open(t, "link/d/b", false)
+	if st := stat(t, g); st.Ino != stat(t, f).Ino || st.Links != 2 {
+		t.Fatalf("linked file: %+v", st)
+	}
+	check(t, g, d, 0)
+
+	if err := Fs_link(sp("link/a"), sp("link/d/b")); err != -EEXIST {
+		t.Fatalf("link to existing name: %v", err)
+	}
+	if err := Fs_link(sp("link/c"), sp("link/e")); err != -ENOENT {
+		t.Fatalf("link of missing file: %v", err)
+	}
+	if err := Fs_link(sp("link/d"), sp("link/e")); err != -EPERM {
+		t.Fatalf("link of directory: %v", err)
+	}
+	// failed links leave the link count alone
+	if st := stat(t, f); st.Links != 2 {
+		t.Fatalf("link count %v after failed links", st.Links)
+	}
+
+	if err := Fs_unlink(sp("link/a")); err != 0 {
+		t.Fatalf("unlink: %v", err)
+	}
+	if st := stat(t, g); st.Links != 1 {
+		t.Fatalf("link count %v after unlink", st.Links)
+	}
+	check(t, g, d, 0)
+}
+
+func TestUnlink(t *testing.T) {
+	mkdir(t, "unlink")
+	f := open(t, "unlink/a", true)
+	before := nfree()
+	write(t, f, pattern(5, 20*512), 0)
+	if nfree() >= before {
+		t.Fatalf("write allocated no blocks")
+	}
+	fclose(t, f)
+	if err := Fs_unlink(sp("unlink/a")); err != 0 {
+		t.Fatalf("unlink: %v", err)
+	}
+	if _, err := Fs_open(sp("unlink/a"), false); err != -ENOENT {
+		t.Fatalf("open of unlinked file: %v", err)
+	}
+	if err := Fs_unlink(sp("unlink/a")); err != -ENOENT {
+		t.Fatalf("unlink of missing file: %v", err)
+	}
+	if n := nfree(); n != before {
+		t.Fatalf("%v free blocks after unlink, %v before", n, before)
+	}
+	// the unlink must survive the eviction of the directory block
+	evict(t)
+	if _, err := Fs_open(sp("unlink/a"), false); err != -ENOENT {
+		t.Fatalf("open of unlinked file after eviction: %v", err)
+	}
+
+	// the name can be used again
+	f = open(t, "unlink/a", true)
+	if st := stat(t, f); st.Size != 0 {
+		t.Fatalf("new file has size %v", st.Size)
+	}
+	mkdir(t, "unlink/d")
+	fclose(t, open(t, "unlink/d/a", true))
+	if err := Fs_unlink(sp("unlink/d")); err != -ENOTEMPTY {
+		t.Fatalf("unlink of non-empty directory: %v", err)
+	}
+	if err := Fs_unlink(sp("unlink/d/a")); err != 0 {
+		t.Fatalf("unlink: %v", err)
+	}
+	if err := Fs_unlink(sp("unlink/d")); err != 0 {
+		t.Fatalf("unlink of empty directory: %v", err)
+	}
+}
+
+// an unlinked file stays usable until it is closed, and its inode isn't
+// reused before then
+func TestUnlinkOpen(t *testing.T) {
+	mkdir(t, "unlinkopen")
+	before := nfree()
+	f := open(t, "unlinkopen/a", true)
+	g := open(t, "unlinkopen/a", false)
+	d := pattern(8, 30*512)
+	write(t, f, d, 0)
+	ino := stat(t, f).Ino
+	if err := Fs_unlink(sp("unlinkopen/a")); err != 0 {
+		t.Fatalf("unlink: %v", err)
+	}
+	if st := stat(t, f); st.Links != 0 || st.Size != len(d) {
+		t.Fatalf("unlinked file: %+v", st)
+	}
+	for i := 0; i < 8; i++ {
+		h := open(t, fmt.Sprintf("unlinkopen/b%v", i), true)
+		if stat(t, h).Ino == ino {
+			t.Fatalf("inode of open file reused")
+		}
+		write(t, h, pattern(9, 512), 0)
+		fclose(t, h)
+	}
+	o := pattern(10, 700)
+	write(t, g, o, 100)
+	copy(d[100:], o)
+	check(t, f, d, 0)
+
+	fclose(t, f)
+	check(t, g, d, 0)
+	used := before - nfree()
+	fclose(t, g)
+	// the file's data blocks and indirect block are freed once it is
+	// closed everywhere
+	if n := before - nfree(); n != used - len(d)/512 - 1 {
+		t.Fatalf("%v blocks used after close, %v before", n, used)
+	}
+}
+
+// a new file must not expose the data of a deleted file whose blocks it
+// reuses
+func TestReuse(t *testing.T) {
+	mkdir(t, "reuse")
+	f := open(t, "reuse/a", true)
+	write(t, f, bytes.Repeat([]uint8{0xab}, 20*512), 0)
+	fclose(t, f)
+	if err := Fs_unlink(sp("reuse/a")); err != 0 {
+		t.Fatalf("unlink: %v", err)
+	}
+	f = open(t, "reuse/b", true)
+	write(t, f, []uint8{1}, 100)
+	check(t, f, make([]uint8, 100), 0)
+	fclose(t, f)
+}
+
+func TestMkdir(t *testing.T) {
+	mkdir(t, "mkdir")
+	mkdir(t, "mkdir/a")
+	mkdir(t, "mkdir/a/b")
+	st := stat(t, open(t, "mkdir/a/b", false))
+	if st.Itype != I_DIR || st.Links != 1 {
+		t.Fatalf("new directory: %+v", st)
+	}
+	if err := Fs_mkdir(sp("mkdir/a")); err != -EEXIST {
+		t.Fatalf("mkdir of existing directory: %v", err)
+	}
+	if err := Fs_mkdir(sp("mkdir/x/y")); err != -ENOENT {
+		t.Fatalf("mkdir in missing directory: %v", err)
+	}
+	if err := open(t, "mkdir/a", false).Truncate(0); err != -EISDIR {
+		t.Fatalf("truncate of directory: %v", err)
+	}
+
+	// enough entries to use several directory blocks
+	for i := 0; i < 3*NDIRENTS; i++ {
+		f := open(t, fmt.Sprintf("mkdir/a/b/f%v", i), true)
+		write(t, f, pattern(i, 10), 0)
+	}
+	for i := 0; i < 3*NDIRENTS; i++ {
+		f := open(t, fmt.Sprintf("mkdir/a/b/f%v", i), false)
+		check(t, f, pattern(i, 10), 0)
+	}
+	if st := stat(t, open(t, "mkdir/a/b", false)); st.Size != 3*512 {
+		t.Fatalf("directory size %v", st.Size)
+	}
+}
+
+func TestLargeFile(t *testing.T) {
+	mkdir(t, "large")
+	f := open(t, "large/f", true)
+	before := nfree()
+
+	// the direct blocks and several indirect blocks
+	nblks := NIADDRS + 3*63 + 10
+	d := pattern(6, nblks*512 + 100)
+	write(t, f, d, 0)
+	if st := stat(t, f); st.Size != len(d) {
+		t.Fatalf("size %v after write of %v", st.Size, len(d))
+	}
+	// the data blocks and four indirect blocks
+	if used := before - nfree(); used != nblks + 1 + 4 {
+		t.Fatalf("%v blocks used by %v data blocks", used, nblks + 1)
+	}
+	check(t, f, d, 0)
+	// across the start of the first and second indirect blocks
+	check(t, f, d[(NIADDRS - 1)*512 + 7:(NIADDRS + 65)*512],
+	    (NIADDRS - 1)*512 + 7)
+
+	// rewrite in the middle of an indirect block
+	o := pattern(7, 5000)
+	off := (NIADDRS + 100)*512 + 3
+	write(t, f, o, off)
+	copy(d[off:], o)
+	check(t, f, d, 0)
+
+	// shrink into the direct blocks and grow again; the new part reads
+	// as zeros
+	if err := f.Truncate(3*512 + 5); err != 0 {
+		t.Fatalf("truncate: %v", err)
+	}
+	if used := before - nfree(); used != 4 {
+		t.Fatalf("%v blocks used after truncate to 4 blocks", used)
+	}
+	if err := f.Truncate(len(d)); err != 0 {
+		t.Fatalf("truncate: %v", err)
+	}
+	copy(d[3*512 + 5:], make([]uint8, len(d)))
+	check(t, f, d, 0)
+	if err := f.Truncate(1 << 50); err != -EFBIG {
+		t.Fatalf("truncate past the largest size: %v", err)
+	}
+
+	fclose(t, f)
+	if err := Fs_unlink(sp("large/f")); err != 0 {
+		t.Fatalf("unlink: %v", err)
+	}
+	if n := nfree(); n != before {
+		t.Fatalf("%v free blocks after unlink, %v before", n, before)
+	}
+}
+
+// reads block blkn of the test disk, bypassing the block cache
+func dread(t *testing.T, blkn int) *[512]uint8 {
+	b := &Diskbuf_t{Block: int32(blkn)}
+	if err := tdisk.Read([]*Diskbuf_t{b}); err != 0 {
+		t.Fatalf("read of block %v: %v", blkn, err)
+	}
+	return &b.Data
+}
+
+// a write transaction that logs more blocks than a descriptor block describes.
+// the committed log on the disk must describe the blocks as fs_recover() reads
+// them.
+func TestLog(t *testing.T) {
+	if fslog.loglen/2 <= LOGDPB {
+		t.Skip("log too small for several descriptor blocks")
+	}
+	mkdir(t, "log")
+	f := open(t, "log/f", true)
+	defer fclose(t, f)
+	if err := Fs_sync(); err != 0 {
+		t.Fatalf("sync: %v", err)
+	}
+	d := pattern(11, write_max())
+	write(t, f, d, 0)
+	if err := Fs_sync(); err != 0 {
+		t.Fatalf("sync: %v", err)
+	}
+
+	cr := dread(t, fslog.logstart)
+	n := fieldr(cr, 2)
+	if !cksum_ok(cr) || fieldr(cr, 0) != LOG_MAGIC || fieldr(cr, 1) !=
+	    fslog.seq {
+		t.Fatalf("bad commit record")
+	}
+	if n <= LOGDPB || fslog.ndescs(n) < 2 {
+		t.Fatalf("transaction of %v blocks", n)
+	}
+	dsum := uint32(0)
+	for i := 0; i < fslog.ndescs(n); i++ {
+		db := dread(t, fslog.logstart + 1 + i)
+		dsum = crc32.Update(dsum, crc32c_tab, db[:])
+		if fieldr(db, LOGDPB) != fslog.seq {
+			t.Fatalf("descriptor block %v of another transaction",
+			    i)
+		}
+	}
+	if dsum != uint32(fieldr(cr, 3)) {
+		t.Fatalf("bad descriptor checksum")
+	}
+	// the transaction is installed, thus every logged block matches its
+	// home location
+	for i := 0; i < n; i++ {
+		dn, doff := fslog.destoff(i)
+		db := dread(t, dn)
+		dst := readn(db[:], 4, doff)
+		sum := uint32(readn(db[:], 4, doff + 4))
+		lb := dread(t, fslog.logblk(i))
+		if crc32.Checksum(lb[:], crc32c_tab) != sum {
+			t.Fatalf("bad checksum of log block %v", i)
+		}
+		if *dread(t, dst) != *lb {
+			t.Fatalf("log block %v differs from block %v", i, dst)
+		}
+	}
+	check(t, f, d, 0)
+}
+
+// goroutines that create, write, read, link, and unlink files at the same
+// time, in directories of their own and in a shared one
+func TestConcurrent(t *testing.T) {
+	mkdir(t, "conc")
+	mkdir(t, "conc/shared")
+	const nworkers = 8
+	const nfiles = 10
+	errs := make(chan error, nworkers)
+	var wg sync.WaitGroup
+	for w := 0; w < nworkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			errs <- worker(w, nfiles)
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// each worker leaves its odd files, linked into the shared directory
+	for w := 0; w < nworkers; w++ {
+		for i := 1; i < nfiles; i += 2 {
+			p := fmt.Sprintf("conc/shared/w%vf%v", w, i)
+			f := open(t, p, false)
+			d := pattern(w*nfiles + i, 700 + 300*i)
+			check(t, f, d, 0)
+			st := stat(t, f)
+			if st.Links != 2 || st.Size != len(d) {
+				t.Fatalf("%v: %+v", p, st)
+			}
+		}
+	}
+	if err := Fs_sync(); err != 0 {
+		t.Fatalf("sync: %v", err)
+	}
+}
+
+func worker(w int, nfiles int) error {
+	dir := fmt.Sprintf("conc/w%v", w)
+	if err := Fs_mkdir(sp(dir)); err != 0 {
+		return fmt.Errorf("mkdir %v: %v", dir, err)
+	}
+	for i := 0; i < nfiles; i++ {
+		p := fmt.Sprintf("%v/f%v", dir, i)
+		f, err := Fs_open(sp(p), true)
+		if err != 0 {
+			return fmt.Errorf("create %v: %v", p, err)
+		}
+		d := pattern(w*nfiles + i, 700 + 300*i)
+		if n, err := f.Write([][]uint8{d}, 0, false); err != 0 ||
+		    n != len(d) {
+			return fmt.Errorf("write %v: %v, %v", p, n, err)
+		}
+		got := make([]uint8, len(d))
+		if n, err := f.Read([][]uint8{got}, 0); err != 0 ||
+		    n != len(d) || !bytes.Equal(got, d) {
+			return fmt.Errorf("read %v: %v, %v", p, n, err)
+		}
+		if err := f.Close(); err != 0 {
+			return fmt.Errorf("close %v: %v", p, err)
+		}
+		if i % 2 == 0 {
+			if err := Fs_unlink(sp(p)); err != 0 {
+				return fmt.Errorf("unlink %v: %v", p, err)
+			}
+			continue
+		}
+		np := fmt.Sprintf("conc/shared/w%vf%v", w, i)
+		if err := Fs_link(sp(p), sp(np)); err != 0 {
+			return fmt.Errorf("link %v: %v", np, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,488 @@
+package main
+
+import "fmt"
+import "runtime"
+import "time"
+import "unsafe"
+
+// ATA disks on the two legacy IDE channels, each of which may have a master
+// and a slave disk. transfers use PIIX bus master DMA when the controller
+// supports it and fall back to PIO otherwise. the disks of a channel share
+// its registers, so each channel has a single daemon serving both disks.
+
+const(
+	ide_bsy = 0x80
+	ide_drdy = 0x40
+	ide_df = 0x20
+	ide_drq = 0x08
+	ide_err = 0x01
+
+	ide_cmd_read = 0x20
+	ide_cmd_write = 0x30
+	ide_cmd_read_dma = 0xc8
+	ide_cmd_write_dma = 0xca
+	ide_cmd_flush = 0xe7
+	ide_cmd_identify = 0xec
+
+	// command block registers, relative to the channel's base
+	ide_rdata = 0
+	ide_rerr = 1
+	ide_rcount = 2
+	ide_rsect = 3
+	ide_rclow = 4
+	ide_rchigh = 5
+	ide_rdrive = 6
+	ide_rcmd = 7
+
+	// device control register: disable interrupts
+	ide_ctl_nien = 0x02
+	// device control register: software reset of both disks on the channel
+	ide_ctl_srst = 0x04
+
+	// bus master registers of a channel, relative to the channel's bus
+	// master base
+	ide_bm_cmd = 0
+	ide_bm_status = 2
+	ide_bm_prd = 4
+	ide_bm_start = 0x01
+	// transfer from the disk to memory
+	ide_bm_read = 0x08
+	ide_bm_err = 0x02
+	ide_bm_intr = 0x04
+
+	// the most sectors transferred by one DMA command. each sector takes
+	// at most two PRD entries since a sector may straddle two pages.
+	ide_maxdma = 128
+
+	// how long a command may take before the disk is considered stuck
+	ide_timeout = 5*time.Second
+	// how many times a failed request is tried
+	ide_retries = 3
+)
+
+// I/O base of the bus master registers of the primary channel, or 0 if DMA is
+// not supported; the secondary channel's registers follow. set when the PCI
+// IDE controller is attached.
+var ide_bmbase int
+
+type ide_chan_t struct {
+	num	int
+	// the command block registers
+	base	int32
+	// the alternate status and device control register
+	ctl	int32
+	irq	int
+	// the bus master registers, or 0 if DMA is not supported
+	bm	int32
+	// the physical region descriptor table; each entry holds the physical
+	// address and length of a region of memory. regions must not cross a
+	// 64KB boundary.
+	prd	*[512]uint64
+	prdpa	int
+	// buffered so that trap_disk() never blocks on an interrupt that the
+	// daemon stopped waiting for
+	intr	chan bool
+	req	chan *idereq_t
+}
+
+// the channels at the legacy ports and IRQs, indexed by the IRQ's offset from
+// IRQ_DISK. channels in native PCI mode are not supported.
+var ide_chans = [2]*ide_chan_t{
+	{num: 0, base: 0x1f0, ctl: 0x3f6, irq: IRQ_DISK,
+	    intr: make(chan bool, 1), req: make(chan *idereq_t)},
+	{num: 1, base: 0x170, ctl: 0x376, irq: IRQ_DISK2,
+	    intr: make(chan bool, 1), req: make(chan *idereq_t)},
+}
+
+func (ch *ide_chan_t) status() int {
+	return runtime.Inb(ch.base + ide_rcmd)
+}
+
+// waits until the status masked with mask is want, returning the status and
+// false if that takes longer than ide_timeout.
+func (ch *ide_chan_t) status_wait(mask int, want int) (int, bool) {
+	var r int
+	var deadline time.Time
+	for i := 0; ; i++ {
+		r = ch.status()
+		if r & mask == want {
+			return r, true
+		}
+		// reading the clock is much slower than reading the status
+		if i % 1000 != 0 {
+			continue
+		}
+		if i == 0 {
+			deadline = time.Now().Add(ide_timeout)
+		} else if time.Now().After(deadline) {
+			return r, false
+		}
+	}
+}
+
+// waits for the selected disk to become ready, returning false if it stays
+// busy for longer than ide_timeout or, if chk, if the disk reports an error.
+func (ch *ide_chan_t) wait(chk bool) bool {
+	r, ok := ch.status_wait(ide_bsy | ide_drdy, ide_drdy)
+	if !ok {
+		fmt.Printf("IDE channel %v: disk busy, status %#x\n", ch.num, r)
+		return false
+	}
+	if chk && r & (ide_df | ide_err) != 0 {
+		return false
+	}
+	return true
+}
+
+// waits for the channel's interrupt, returning false if it doesn't arrive
+// within ide_timeout.
+func (ch *ide_chan_t) intr_wait() bool {
+	select {
+	case <- ch.intr:
+		return true
+	case <- time.After(ide_timeout):
+		fmt.Printf("IDE channel %v: interrupt timed out\n", ch.num)
+		return false
+	}
+}
+
+// drops a spurious or late interrupt so that it is not mistaken for the
+// completion of the next command
+func (ch *ide_chan_t) intr_drain() {
+	select {
+	case <- ch.intr:
+	default:
+	}
+}
+
+// resets both disks on the channel, which aborts the command in progress. the
+// disks may take a few seconds to become ready again.
+func (ch *ide_chan_t) reset() {
+	outb := runtime.Outb
+	outb(ch.ctl, ide_ctl_srst)
+	time.Sleep(time.Millisecond)
+	outb(ch.ctl, 0)
+	time.Sleep(2*time.Millisecond)
+	ch.status_wait(ide_bsy, 0)
+	ch.intr_drain()
+}
+
+// waits the 400ns the status register needs to become valid after a disk is
+// selected or a command is issued
+func (ch *ide_chan_t) delay() {
+	for i := 0; i < 4; i++ {
+		runtime.Inb(ch.ctl)
+	}
+}
+
+func (ch *ide_chan_t) selectdisk(disk int) {
+	runtime.Outb(ch.base + ide_rdrive, int32(0xe0 | (disk & 1) << 4))
+	ch.delay()
+}
+
+// an ATA disk on an IDE channel
+type ide_t struct {
+	ch	*ide_chan_t
+	// 0 for the master, 1 for the slave
+	disk	int
+	nsect	int
+}
+
+// returns the disks found on the IDE channels: the primary master, primary
+// slave, secondary master, and secondary slave, if present.
+func ide_init() []*ide_t {
+	var ret []*ide_t
+	for _, ch := range ide_chans {
+		var found []*ide_t
+		for disk := 0; disk < 2; disk++ {
+			ch.selectdisk(disk)
+			// a floating bus reads as 0xff; a missing disk reads
+			// as 0
+			if r := ch.status(); r == 0xff || r == 0 {
+				continue
+			}
+			d := &ide_t{ch: ch, disk: disk}
+			d.nsect = d.identify()
+			if d.nsect == 0 {
+				// ATAPI devices abort IDENTIFY DEVICE
+				continue
+			}
+			fmt.Printf("%v: IDE disk detected (%v sectors)\n",
+			    d.name(), d.nsect)
+			found = append(found, d)
+		}
+		if len(found) == 0 {
+			continue
+		}
+		ch.dma_init()
+		irq_unmask(ch.irq)
+		go ch.daemon()
+		ret = append(ret, found...)
+	}
+	if len(ret) == 0 {
+		fmt.Printf("no IDE disk\n")
+	}
+	return ret
+}
+
+func (ide *ide_t) name() string {
+	return fmt.Sprintf("ide%v", 2*ide.ch.num + ide.disk)
+}
+
+var ide_driver = pci_driver_t{
+	name: "ide",
+	// mass storage, IDE
+	ids: []pci_id_t{{-1, -1, 0x0101}},
+	attach: ide_attach,
+}
+
+// claims the PCI IDE controller if it is capable of bus master DMA and
+// enables bus mastering. the channels stay at the legacy ports.
+func ide_attach(d *pci_dev_t) bool {
+	if ide_bmbase != 0 || d.progif & 0x80 == 0 || !d.bars[4].io {
+		return false
+	}
+	d.command(pci_cmd_io | pci_cmd_bm, 0)
+	ide_bmbase = d.bars[4].addr
+	return true
+}
+
+func (ch *ide_chan_t) dma_init() {
+	if ide_bmbase == 0 {
+		fmt.Printf("IDE channel %v: no bus master DMA, using PIO\n",
+		    ch.num)
+		return
+	}
+	ch.bm = int32(ide_bmbase + 8*ch.num)
+	pg, pa := pg_new(make(map[int]*[512]int))
+	ch.prd = (*[512]uint64)(unsafe.Pointer(pg))
+	ch.prdpa = pa
+	if ch.prdpa + PGSIZE > 1 << 32 {
+		panic("PRD table above 4GB")
+	}
+	fmt.Printf("IDE channel %v: bus master DMA at %#x\n", ch.num, ch.bm)
+}
+
+// returns the number of sectors addressable with 28-bit LBA, or 0 on error or
+// if the device isn't an ATA disk. IDENTIFY DEVICE is polled with interrupts
+// disabled since the channel's daemon isn't running yet to consume the
+// interrupt.
+func (ide *ide_t) identify() int {
+	ch := ide.ch
+	if _, ok := ch.status_wait(ide_bsy, 0); !ok {
+		return 0
+	}
+	runtime.Outb(ch.ctl, ide_ctl_nien)
+	ch.selectdisk(ide.disk)
+	runtime.Outb(ch.base + ide_rcmd, ide_cmd_identify)
+	ch.delay()
+	r, ok := ch.status_wait(ide_bsy, 0)
+	if !ok || r & (ide_err | ide_df) != 0 || r & ide_drq == 0 {
+		return 0
+	}
+	var id [256]uint16
+	runtime.Insl(ch.base + ide_rdata, unsafe.Pointer(&id[0]), 512/4)
+	return int(id[60]) | int(id[61]) << 16
+}
+
+func (ide *ide_t) start(req *bdevreq_t) {
+	ide.ch.req <- &idereq_t{disk: ide.disk, req: req}
+}
+
+func (ide *ide_t) capacity() int {
+	return ide.nsect
+}
+
+func (ide *ide_t) sectsize() int {
+	return 512
+}
+
+// WRITE DMA FUA EXT needs 48-bit LBA, which isn't used
+func (ide *ide_t) fua() bool {
+	return false
+}
+
+type idereq_t struct {
+	disk	int
+	req	*bdevreq_t
+	// the status of the last attempt: 0 or -EIO
+	err	int
+}
+
+// issues a command for nsect sectors starting at block; 256 sectors are
+// encoded as 0. returns false if the disk is stuck busy.
+func (ch *ide_chan_t) cmd(disk int, block int32, nsect int, cmd int32) bool {
+	ch.selectdisk(disk)
+	if !ch.wait(false) {
+		return false
+	}
+	ch.intr_drain()
+	outb := runtime.Outb
+	b := ch.base
+	outb(ch.ctl, 0)
+	outb(b + ide_rcount, int32(nsect) & 0xff)
+	outb(b + ide_rsect, block & 0xff)
+	outb(b + ide_rclow, (block >> 8) & 0xff)
+	outb(b + ide_rchigh, (block >> 16) & 0xff)
+	outb(b + ide_rdrive, 0xe0 | ((int32(disk) & 1) << 4) |
+	    (block >> 24) & 0xf)
+	outb(b + ide_rcmd, cmd)
+	return true
+}
+
+// it is possible that a goroutine is context switched to a new CPU while doing
+// this port io; does this matter? doesn't seem to for qemu...
+func (ch *ide_chan_t) start(disk int, b *diskbuf_t, write bool) bool {
+	if !write {
+		return ch.cmd(disk, b.block, 1, ide_cmd_read)
+	}
+	if !ch.cmd(disk, b.block, 1, ide_cmd_write) {
+		return false
+	}
+	// the disk asks for the data once it has accepted the command
+	if !ch.wait(true) {
+		return false
+	}
+	runtime.Outsl(ch.base + ide_rdata, unsafe.Pointer(&b.data[0]), 512/4)
+	return true
+}
+
+// reads or writes one sector, returning false on error
+func (ch *ide_chan_t) rw(disk int, b *diskbuf_t, write bool) bool {
+	if !ch.start(disk, b, write) || !ch.intr_wait() {
+		return false
+	}
+	if !ch.wait(true) {
+		return false
+	}
+	if !write {
+		runtime.Insl(ch.base + ide_rdata, unsafe.Pointer(&b.data[0]),
+		    512/4)
+	}
+	return true
+}
+
+// adds PRD entries for d, returning the index of the next free entry.
+func (ch *ide_chan_t) prdadd(n int, d []uint8) int {
+	dma_regions(d, func(pa int, l int) {
+		if pa + l > 1 << 32 {
+			panic("DMA address above 4GB")
+		}
+		ch.prd[n] = uint64(pa) | uint64(l) << 32
+		n++
+	})
+	return n
+}
+
+// reads or writes a run of at most ide_maxdma consecutive sectors with a
+// single DMA command, returning false on error
+func (ch *ide_chan_t) dma(disk int, bufs []*diskbuf_t, write bool) bool {
+	if len(bufs) > ide_maxdma {
+		panic("too many sectors for DMA")
+	}
+	n := 0
+	for _, b := range bufs {
+		n = ch.prdadd(n, b.data[:])
+	}
+	// end of table
+	ch.prd[n - 1] |= 1 << 63
+
+	bm := ch.bm
+	outb := runtime.Outb
+	runtime.Outl(bm + ide_bm_prd, int32(ch.prdpa))
+	dir := int32(0)
+	cmd := int32(ide_cmd_write_dma)
+	if !write {
+		dir = ide_bm_read
+		cmd = ide_cmd_read_dma
+	}
+	outb(bm + ide_bm_cmd, dir)
+	st := int32(runtime.Inb(bm + ide_bm_status))
+	outb(bm + ide_bm_status, st | ide_bm_err | ide_bm_intr)
+
+	if !ch.cmd(disk, bufs[0].block, len(bufs), cmd) {
+		return false
+	}
+	outb(bm + ide_bm_cmd, dir | ide_bm_start)
+	intr := ch.intr_wait()
+
+	// stop the bus master even if the transfer didn't finish so that it
+	// doesn't write to the buffers after they are handed back
+	st = int32(runtime.Inb(bm + ide_bm_status))
+	outb(bm + ide_bm_cmd, dir)
+	outb(bm + ide_bm_status, st | ide_bm_err | ide_bm_intr)
+	if !intr {
+		return false
+	}
+	ok := ch.wait(true)
+	return ok && st & ide_bm_err == 0
+}
+
+// writes the disk's volatile write cache to the media, returning false on
+// error
+func (ch *ide_chan_t) flush(disk int) bool {
+	if !ch.cmd(disk, 0, 0, ide_cmd_flush) || !ch.intr_wait() {
+		return false
+	}
+	return ch.wait(true)
+}
+
+// performs the request once, setting ir.err to -EIO on failure. a failed
+// request may have transferred some of its sectors.
+func (ch *ide_chan_t) do(ir *idereq_t) {
+	req := ir.req
+	ok := true
+	switch req.cmd {
+	case BDEV_READ, BDEV_WRITE:
+		writing := req.cmd == BDEV_WRITE
+		if ch.bm == 0 {
+			for _, b := range req.bufs {
+				if !ch.rw(ir.disk, b, writing) {
+					ok = false
+					break
+				}
+			}
+			break
+		}
+		for bufs := req.bufs; ok && len(bufs) != 0; {
+			n := len(bufs)
+			if n > ide_maxdma {
+				n = ide_maxdma
+			}
+			ok = ch.dma(ir.disk, bufs[:n], writing)
+			bufs = bufs[n:]
+		}
+	case BDEV_FLUSH:
+		ok = ch.flush(ir.disk)
+	default:
+		panic("bad ide command")
+	}
+	ir.err = 0
+	if !ok {
+		ir.err = -EIO
+	}
+}
+
+// requests are retried after resetting the channel since a reset is often
+// enough to recover a disk that stopped responding. the request is failed
+// with -EIO once the retries are exhausted.
+func (ch *ide_chan_t) daemon() {
+	for {
+		ir := <- ch.req
+		for try := 0; try < ide_retries; try++ {
+			if try != 0 {
+				fmt.Printf("IDE channel %v: retrying request " +
+				    "(%v/%v)\n", ch.num, try, ide_retries - 1)
+				ch.reset()
+			}
+			ch.do(ir)
+			if ir.err == 0 {
+				break
+			}
+		}
+		if ir.err != 0 {
+			fmt.Printf("IDE channel %v: request failed\n", ch.num)
+		}
+		ir.req.ack <- ir.err
+	}
+}
@@ -54,8 +54,11 @@ const(
 	IRQ_BASE  = 32
 	IRQ_KBD = 1
 	IRQ_DISK  = 14
+	// the secondary IDE channel
+	IRQ_DISK2 = 15
 	IRQ_LAST  = IRQ_BASE + 16
 	INT_DISK  = IRQ_BASE + IRQ_DISK
+	INT_DISK2 = IRQ_BASE + IRQ_DISK2
 	INT_KBD = IRQ_BASE + IRQ_KBD
 )
 
@@ -110,11 +113,15 @@ func trapstub(tf *[TFSIZE]int, pid int) {
 	case SYSCALL, PGFAULT:
 		// yield until the syscall/fault is handled
 		runtime.Procyield()
-	case INT_DISK:
+	case INT_DISK, INT_DISK2:
 		runtime.Proccontinue()
 	case INT_KBD:
 		runtime.Proccontinue()
 	default:
+		if pci_intr_clear(trapno) {
+			runtime.Proccontinue()
+			break
+		}
 		runtime.Pnum(trapno)
 		runtime.Pnum(tf[TF_RIP])
 		runtime.Pnum(0xbadbabe)
@@ -122,6 +129,30 @@ func trapstub(tf *[TFSIZE]int, pid int) {
 	}
 }
 
+// registers the disks and their partitions as block devices and returns the
+// first one that holds a file system, or nil if there is none. a disk's
+// partitions are tried before the disk itself, which holds a file system if it
+// was made without a partition table.
+func root_find(disks []blockdev_t, names []string) blockdev_t {
+	var root blockdev_t
+	for i, d := range disks {
+		bdev_register(names[i], d)
+		for j, p := range part_scan(d, names[i]) {
+			pname := fmt.Sprintf("%vp%v", names[i], j + 1)
+			bdev_register(pname, p)
+			if root == nil && fs_probe(p) {
+				fmt.Printf("root is %v\n", pname)
+				root = p
+			}
+		}
+		if root == nil && fs_probe(d) {
+			fmt.Printf("root is %v\n", names[i])
+			root = d
+		}
+	}
+	return root
+}
+
 func trap_kbd(ts *trapstore_t) {
 	fmt.Println("KEYBOARRRRRRRRRRRRD!!!!")
 	cons.kbd_int <- true
@@ -131,6 +162,8 @@ type cons_t struct {
 	kbd_int chan bool
 	reader	chan []byte
 	reqc	chan int
+	// answers whether there is keyboard data
+	pollc	chan chan bool
 }
 
 var cons	= cons_t{}
@@ -163,9 +196,10 @@ func kbd_daemon(cons *cons_t, km map[int]byte) {
 			if l > len(data) {
 				l = len(data)
 			}
-			data = data[0:l]
-			cons.reader <- data
-			data = make([]byte, 0)
+			cons.reader <- data[0:l]
+			data = data[l:]
+		case r := <- cons.pollc:
+			r <- len(data) != 0
 		}
 		if len(data) == 0 {
 			reqc = nil
@@ -185,6 +219,13 @@ func kbd_get(cnt int) []byte {
 	return <- cons.reader
 }
 
+// returns true if kbd_get() would not block
+func kbd_ready() bool {
+	r := make(chan bool)
+	cons.pollc <- r
+	return <- r
+}
+
 
 func trap(handlers map[int]func(*trapstore_t)) {
 	for {
@@ -219,7 +260,12 @@ func trap(handlers map[int]func(*trapstore_t)) {
 }
 
 func trap_disk(ts *trapstore_t) {
-	ide_int_done <- true
+	ch := ide_chans[ts.trapno - INT_DISK]
+	// the channel's daemon may have given up on the command
+	select {
+	case ch.intr <- true:
+	default:
+	}
 }
 
 //var klock	= sync.Mutex{}
@@ -248,6 +294,7 @@ func kbd_init() {
 	cons.kbd_int = make(chan bool)
 	cons.reader = make(chan []byte)
 	cons.reqc = make(chan int)
+	cons.pollc = make(chan chan bool)
 	go kbd_daemon(&cons, km)
 	irq_unmask(IRQ_KBD)
 	// make sure kbd int is clear
@@ -304,24 +351,22 @@ type fd_t struct {
 	perms	int
 }
 
-var dummyfile	= file_t{-1}
-
-// special fds
-var fd_stdin 	= fd_t{&dummyfile, 0, 0}
-var fd_stdout 	= fd_t{&dummyfile, 0, 0}
-var fd_stderr 	= fd_t{&dummyfile, 0, 0}
 
 type proc_t struct {
 	pid	int
 	name	string
-	// all pages
+	// protects pages, upages, and pmap. the process itself reads them
+	// without it; only changes and the readers of other processes take it.
 	maplock	sync.Mutex
+	// all pages
 	pages	map[int]*[512]int
 	// physical -> user va mapping
 	upages	map[int]int
 	pmap	*[512]int
 	p_pmap	int
 	dead	bool
+	// protects fds and the offsets of the fds like maplock
+	fdl	sync.Mutex
 	fds	map[int]*fd_t
 	nextfd	int
 	cwd	string
@@ -348,7 +393,12 @@ func proc_new(name string) *proc_t {
 	ret.pid = newpid
 	ret.pages = make(map[int]*[512]int)
 	ret.upages = make(map[int]int)
-	ret.fds = map[int]*fd_t{0: &fd_stdin, 1: &fd_stdout, 2: &fd_stderr}
+	// the standard files are the console
+	ret.fds = map[int]*fd_t{
+		0: &fd_t{cons_file, 0, O_RDONLY},
+		1: &fd_t{cons_file, 0, O_WRONLY},
+		2: &fd_t{cons_file, 0, O_WRONLY},
+	}
 	ret.nextfd = len(ret.fds)
 	ret.cwd = "/"
 
@@ -365,17 +415,36 @@ func proc_get(pid int) *proc_t {
 	return p
 }
 
-func (p *proc_t) fd_new() (int, *fd_t) {
+func (p *proc_t) fd_new(file *file_t, perms int) int {
+	p.fdl.Lock()
+	defer p.fdl.Unlock()
 	fdn := p.nextfd
 	p.nextfd++
-	fd := &fd_t{}
+	fd := &fd_t{file: file, perms: perms}
 	if _, ok := p.fds[fdn]; ok {
 		panic(fmt.Sprintf("new fd exists %d", fdn))
 	}
 	p.fds[fdn] = fd
-	return fdn, fd
+	return fdn
 }
 
+// closes fd fdn. the console is shared by all processes and stays open.
+func (p *proc_t) fd_close(fdn int) int {
+	p.fdl.Lock()
+	fd, ok := p.fds[fdn]
+	if !ok {
+		p.fdl.Unlock()
+		return -EBADF
+	}
+	delete(p.fds, fdn)
+	p.fdl.Unlock()
+	if fd.file == cons_file {
+		return 0
+	}
+	return fd.file.close()
+}
+
+// the caller holds p.maplock
 func (p *proc_t) page_insert(va int, pg *[512]int, p_pg int,
     perms int, vempty bool) {
 
@@ -406,6 +475,7 @@ func (p *proc_t) page_insert(va int, pg *[512]int, p_pg int,
 	p.upages[p_pg] = va & PGMASK
 }
 
+// the caller holds p.maplock
 func (p *proc_t) page_remove(va int, pg *[512]int) {
 
 	pte := pmap_walk(p.pmap, va, false, 0, nil)
@@ -433,6 +503,13 @@ func proc_kill(pid int) {
 	proclock.Unlock()
 
 	runtime.Prockill(pid)
+	fdns := make([]int, 0, len(p.fds))
+	for fdn := range p.fds {
+		fdns = append(fdns, fdn)
+	}
+	for _, fdn := range fdns {
+		p.fd_close(fdn)
+	}
 	// XXX
 	//fmt.Printf("not cleaning up\n")
 	//return
@@ -511,11 +588,13 @@ type mpcpu_t struct {
 	bsp      bool
 }
 
+// returns the enabled CPUs listed in the MP configuration table, or nil if
+// there is none. the CPUs are only found, not started, so procfs can call it
+// too.
 func cpus_find() []mpcpu_t {
 
-	fl, base, _ := mp_scan()
-	if fl == nil {
-		fmt.Println("uniprocessor")
+	_, base, _ := mp_scan()
+	if base == nil {
 		return nil
 	}
 
@@ -527,18 +606,6 @@ func cpus_find() []mpcpu_t {
 		panic(fmt.Sprintf("weird lapic addr %#x", lapaddr))
 	}
 
-	// switch to symmetric mode interrupts if we are in PIC mode
-	mpfeat := readn(fl, 4, 12)
-	imcrp := 1 << 7
-	if mpfeat & imcrp != 0 {
-		fmt.Printf("entering symmetric mode\n")
-		// select imcr
-		runtime.Outb(0x22, 0x70)
-		// "writing a value of 01h forces the NMI and 8259 INTR signals
-		// to pass through the APIC."
-		runtime.Outb(0x23, 0x1)
-	}
-
 	ecount := readn(base, 2, 0x22)
 	entries := base[44:]
 	idx := 0
@@ -581,8 +648,28 @@ func cpus_stack_init(apcnt int, stackstart int) {
 	}
 }
 
+// switches to symmetric mode interrupts if we are in PIC mode
+func mp_symmetric() {
+	fl, _, _ := mp_scan()
+	mpfeat := readn(fl, 4, 12)
+	imcrp := 1 << 7
+	if mpfeat & imcrp != 0 {
+		fmt.Printf("entering symmetric mode\n")
+		// select imcr
+		runtime.Outb(0x22, 0x70)
+		// "writing a value of 01h forces the NMI and 8259 INTR signals
+		// to pass through the APIC."
+		runtime.Outb(0x23, 0x1)
+	}
+}
+
 func cpus_start() {
 	cpus := cpus_find()
+	if cpus == nil {
+		fmt.Println("uniprocessor")
+		return
+	}
+	mp_symmetric()
 	apcnt := len(cpus) - 1
 	fmt.Printf("found %v CPUs\n", len(cpus))
 
@@ -820,17 +907,68 @@ func main() {
 	     PGFAULT: trap_pgfault,
 	     SYSCALL: trap_syscall,
 	     INT_DISK: trap_disk,
+	     INT_DISK2: trap_disk,
 	     INT_KBD: trap_kbd,
 	     }
+	pci_register(&ahci_driver)
+	pci_register(&vio_driver)
+	pci_register(&ide_driver)
+	pci_init()
+	// the interrupt vectors of PCI devices are only known once they are
+	// found
+	sata := ahci_disks()
+	if sata != nil {
+		handlers[ahci_int] = trap_pci
+	}
+	vdisks := vio_disks
+	for _, d := range vdisks {
+		handlers[d.vec] = trap_pci
+	}
 	go trap(handlers)
 
 	init_8259()
 	//cpus_start()
 	kbd_init()
-	if !ide_init() {
-		panic("no IDE disk")
+	if sata != nil {
+		ahci_start()
+	}
+	vio_start()
+	// prefer a virtio disk for root since it is the fastest
+	var disks []blockdev_t
+	var names []string
+	for i, d := range vdisks {
+		disks = append(disks, d)
+		names = append(names, fmt.Sprintf("virtio%v", i))
+	}
+	for _, d := range ide_init() {
+		disks = append(disks, d)
+		names = append(names, d.name())
+	}
+	for _, d := range sata {
+		disks = append(disks, d)
+		names = append(names, fmt.Sprintf("ahci%v", d.num))
+	}
+	root := root_find(disks, names)
+	if root == nil {
+		fmt.Printf("using RAM disk as root\n")
+		root = ramdisk_new(allbins["ramfs.img"].data, RAMFS_BLKS)
+	}
+	fstype_register(&bfs_type)
+	fstype_register(&tmpfs_type)
+	fstype_register(&procfs_type)
+	fstype_register(&devfs_type)
+	fstype_register(&fat_type)
+	fstype_register(&ext2_type)
+	fstype_register(&ufs_type)
+	dev_init()
+	vfs_mountroot("biscuit", root)
+	if err := vfs_mount("proc", []string{"proc"}, "proc", 0, ""); err != 0 {
+		fmt.Printf("cannot mount /proc: %v\n", err)
+	}
+	if err := vfs_mount("dev", []string{"dev"}, "devfs", 0, ""); err != 0 {
+		fmt.Printf("cannot mount /dev: %v\n", err)
 	}
-	fs_init()
+	cons_init()
 	fmt.Printf("morimolymoly was here!\n")
 	exec := func(cmd string) {
 		path := strings.Split(cmd, "/")
@@ -851,6 +989,7 @@ func main() {
 	//exec("bin/fsmkdir")
 	//exec("bin/fscreat")
 	//exec("bin/getpid")
+	//exec("bin/fssync")
 
 	//ide_test()
 	//bc_test()
@@ -865,21 +1004,18 @@ func main() {
 }
 
 func ide_test() {
-	req := idereq_new(0, false, nil)
-	ide_request <- req
-	<- req.ack
-	fmt.Printf("read of block %v finished!\n", req.buf.block)
-	for _, c := range req.buf.data {
+	buf := &diskbuf_t{block: 0}
+	bdev_read(fsdev, []*diskbuf_t{buf})
+	fmt.Printf("read of block %v finished!\n", buf.block)
+	for _, c := range buf.data {
 		fmt.Printf("%x ", c)
 	}
 	fmt.Printf("\n")
-	fmt.Printf("will overwrite block %v now...\n", req.buf.block)
-	req.write = true
-	for i := range req.buf.data {
-		req.buf.data[i] = 0xcc
+	fmt.Printf("will overwrite block %v now...\n", buf.block)
+	for i := range buf.data {
+		buf.data[i] = 0xcc
 	}
-	ide_request <- req
-	<- req.ack
+	bdev_write(fsdev, []*diskbuf_t{buf})
 	fmt.Printf("done!\n")
 }
 
@@ -3,17 +3,21 @@
 # this script takes as input the filenames of the boot and kernel images and
 # creates a disk filled with the contents of the provided skel dir directory,
 # poking the block number of the first free block into the mbr of the disk
-# image.
+# image. RAM disk images are made with an empty kernel image and -t, which
+# omits the free blocks at the end of the disk from the image.
 
+import getopt
 import os
 import sys
 
 blocksz = 512
 hdsize = 20 * 1024 * 1024
 # number of inode direct addresses
-iaddrs = 10
+iaddrs = 9
 # number of inode indirect addresses
 indaddrs = 63
+# metadata blocks end with a crc32c checksum of the preceding bytes
+cksumoff = blocksz - 4
 
 class Balloc:
   def __init__(self, ff):
@@ -37,6 +41,8 @@ class Datab:
   # holds raw block data
   def __init__(self, bn, cont=''):
     self.bn, self.cont = bn, cont
+    # directory blocks are checksummed
+    self.meta = False
     if len(cont) > blocksz:
       raise ValueError('block too large')
   def append(self, cont):
@@ -47,6 +53,9 @@ class Datab:
     return len(self.cont)
 
   def writeto(self, of):
+    if self.meta:
+      of.write(cksummed(self.cont))
+      return
     l = len(self.cont)
     of.write(self.cont)
     of.write('\0'*(blocksz - l))
@@ -84,13 +93,8 @@ class Dirb:
     direntrysz = 22
     if self.curblk is not None and blocksz - self.curblk.len() >= direntrysz:
       return self.curblk
-    # allocate new directory entry block, padding old block to block size
-    # (since blocksize does not divide by (dirent count * dirent size))
-    if self.curblk is not None:
-      direntsz = 22
-      slop = (blocksz - (blocksz/direntsz)*direntsz)
-      self.curblk.append('\0'*slop)
-
+    # allocate new directory entry block; the old block is padded when it is
+    # written along with its checksum
     self.size += blocksz
     # use indirect block?
     if len(self.blks) == iaddrs:
@@ -103,6 +107,7 @@ class Dirb:
         self.curblk = Datab(nb)
         self.ba.pair(nb, self.curblk)
         self.blks.append(nb)
+    self.curblk.meta = True
     return self.curblk
 
   def itype(self):
@@ -182,6 +187,8 @@ class Inodeb:
     self.icur = 0
     self.itop = 4
     self.imap = {}
+    # maps each unallocated inode slot to the next inode on the free list
+    self.freenext = {}
 
   def getfree(self):
     if self.icur >= self.itop:
@@ -197,9 +204,10 @@ class Inodeb:
       raise ValueError('islot already allocated')
     self.imap[islot] = itype
 
-  def iwrite(self, of, blk):
+  def iwrite(self, blk):
+    ret = []
     def wrnum(num):
-      of.write(le8(num))
+      ret.append(le8(num))
     # inode type
     wrnum(blk.itype())
     # link count
@@ -217,16 +225,22 @@ class Inodeb:
       wrnum(i)
     for i in range(iaddrs - len(blk.blks)):
       wrnum(0)
+    return ''.join(ret)
 
   def writeto(self, of):
+    d = ''
     sortedinodes = sorted(self.imap.keys())
     for i in sortedinodes:
       blk = self.imap[i]
-      self.iwrite(of, blk)
-    # write unallocated inodes
+      d += self.iwrite(blk)
+    # write unallocated inodes: type 0 and the next free inode in the link
+    # count field
     isize = (6 + iaddrs)*8
-    for i in range(self.itop - len(self.imap)):
-      of.write('\0'*isize)
+    for i in range(len(self.imap), self.itop):
+      d += le8(0)
+      d += le8(self.freenext.get(i, 0))
+      d += '\0'*(isize - 2*8)
+    of.write(cksummed(d))
 
 class Fsrep:
   # class for representing the whole file system
@@ -295,10 +309,22 @@ class Fsrep:
       newdn = os.path.join(dirname, d.dirpart)
       self.recursedir(d, newdn)
 
+  def ifreelist(self):
+    # chains the unallocated inodes of the last inode block into the free inode
+    # list; returns the head of the list
+    head = 0
+    if self.indf is None:
+      return head
+    indfb = self.ba.blkget(self.indf)
+    for i in reversed(range(indfb.icur, indfb.itop)):
+      indfb.freenext[i] = head
+      head = biencode(self.indf, i)
+    return head
+
   def rooti(self):
     return self.rootinode, self.rootioff
 
-  def writeto(self, of, remaining):
+  def writeto(self, of, remaining, trunc):
     ab = self.ba.allblocks
     if len(ab) > remaining:
       raise ValueError('skeldir too big/out of blocks')
@@ -312,6 +338,8 @@ class Fsrep:
       #  print '**** object', type(ab[b]), 'didnt write a whole block'
       #print 'wrote %d bytes' % (diff)
     # free space
+    if trunc:
+      return
     for i in range(remaining - len(ab)):
       of.write('\0'*blocksz)
 
@@ -353,6 +381,38 @@ def le8(num):
 def biencode(block, ioff):
   return (block << 2) | ioff
 
+def mkcrctab():
+  # crc32c (castagnoli), reflected
+  tab = []
+  for i in range(256):
+    c = i
+    for j in range(8):
+      if c & 1:
+        c = (c >> 1) ^ 0x82f63b78
+      else:
+        c >>= 1
+    tab.append(c)
+  return tab
+
+crctab = mkcrctab()
+
+def crc32c(data):
+  c = 0xffffffff
+  for ch in data:
+    c = crctab[(c ^ ord(ch)) & 0xff] ^ (c >> 8)
+  return c ^ 0xffffffff
+
+def le4(num):
+  l = [chr((num >> i*8) & 0xff) for i in range(4)]
+  return ''.join(l)
+
+def cksummed(d):
+  # pads d and appends its checksum, returning a whole metadata block
+  if len(d) > cksumoff:
+    raise ValueError('metadata block too large')
+  d += '\0'*(cksumoff - len(d))
+  return d + le4(crc32c(d))
+
 def dofree(of, allocblocks, freeblock, freeblocklen):
   for i in range(allocblocks/8):
     of.write(chr(0xff))
@@ -372,7 +432,8 @@ def dofree(of, allocblocks, freeblock, freeblocklen):
   for i in range(remaining):
     of.write('\0'*blocksz)
 
-def dofs(of, freeblock, freeblocklen, loglen, lastblock, remaining, skeldir):
+def dofs(of, freeblock, freeblocklen, loglen, lastblock, remaining, skeldir,
+    trunc):
   ff = freeblock + freeblocklen + loglen
   ba = Balloc(ff)
 
@@ -383,9 +444,9 @@ def dofs(of, freeblock, freeblocklen, loglen, lastblock, remaining, skeldir):
     raise ValueError('ruh roh')
 
   # start superblock: freeblock start, freeblock length, log length, and
-  of.write(le8(freeblock))
-  of.write(le8(freeblocklen))
-  of.write(le8(loglen))
+  sb = le8(freeblock)
+  sb += le8(freeblocklen)
+  sb += le8(loglen)
 
   fsrep = Fsrep(skeldir, ba)
   #fsrep.pr()
@@ -393,10 +454,12 @@ def dofs(of, freeblock, freeblocklen, loglen, lastblock, remaining, skeldir):
   rootinode, rootioff = fsrep.rooti()
 
   # write root inode to superblock
-  of.write(le8(biencode(rootinode, rootioff)))
+  sb += le8(biencode(rootinode, rootioff))
   # last block
-  of.write(le8(lastblock))
-  of.write('\0'*(blocksz - 5*8))
+  sb += le8(lastblock)
+  # free inode list
+  sb += le8(fsrep.ifreelist())
+  of.write(cksummed(sb))
 
   # super block is done, write free bitmap
   dofree(of, ba.cblock, freeblock, freeblocklen)
@@ -406,20 +469,45 @@ def dofs(of, freeblock, freeblocklen, loglen, lastblock, remaining, skeldir):
     of.write('\0'*blocksz)
 
   # finally, write fs
-  fsrep.writeto(of, remaining)
+  fsrep.writeto(of, remaining, trunc)
+
+def usage():
+  print >> sys.stderr, 'usage: %s [-s <disk blocks>] [-l <log blocks>] [-t] <boot image> <kernel image> <output image> <skel dir>' % (sys.argv[0])
+  sys.exit(-1)
 
 if __name__ == '__main__':
-  if len(sys.argv) != 5:
-    print >> sys.stderr, 'usage: %s <boot image> <kernel image> <output image> <skel dir>' % (sys.argv[0])
+  try:
+    opts, args = getopt.getopt(sys.argv[1:], 's:l:t')
+  except getopt.GetoptError:
+    usage()
+  if len(args) != 4:
+    usage()
+
+  hdblocks = roundup(hdsize, blocksz) / blocksz
+  trunc = False
+  # the commit record, the descriptor blocks, and the logged blocks. a
+  # descriptor block describes 63 logged blocks.
+  loglen = 31
+  for o, a in opts:
+    if o == '-s':
+      hdblocks = int(a)
+    elif o == '-l':
+      loglen = int(a)
+    elif o == '-t':
+      trunc = True
+
+  # the kernel needs room for a write of at least one block
+  if loglen < 14:
+    print >> sys.stderr, 'the log needs at least 14 blocks'
     sys.exit(-1)
 
-  bfn = sys.argv[1]
-  kfn = sys.argv[2]
-  ofn = sys.argv[3]
-  skeldir = sys.argv[4]
+  bfn = args[0]
+  kfn = args[1]
+  ofn = args[2]
+  skeldir = args[3]
 
-  hdblocks = roundup(hdsize, blocksz) / blocksz
-  usedblocks = fblocks(bfn)
+  # the boot block holds the start of the fs even without a boot image
+  usedblocks = max(fblocks(bfn), 1)
   usedblocks += fblocks(kfn)
   remaining = hdblocks - usedblocks
 
@@ -429,6 +517,7 @@ if __name__ == '__main__':
 
   with open(bfn, 'r') as bf, open(kfn, 'r') as kf, open(ofn, 'w') as of:
     bfdata = list(bf.read())
+    bfdata += ['\0']*(blocksz - len(bfdata))
     kfdata = kf.read()
     poke(bfdata, FSOFF, usedblocks)
 
@@ -439,8 +528,8 @@ if __name__ == '__main__':
     of.write('\0'*(lim - len(kfdata)))
 
     fblen = 10
-    loglen = 31
-    dofs(of, usedblocks + 1, fblen, loglen, hdblocks, remaining, skeldir)
+    dofs(of, usedblocks + 1, fblen, loglen, hdblocks, remaining, skeldir,
+        trunc)
 
   print >> sys.stderr, 'created "%s" of length %d blocks' % (ofn, hdblocks)
   print >> sys.stderr, '(fs starts at %#x in "%s")' % (usedblocks*blocksz, ofn)
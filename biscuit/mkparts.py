@@ -0,0 +1,59 @@
+#!/usr/bin/env python
+
+# this script creates a disk image with an MBR partition table holding one
+# primary partition for each of the given images, in order. partitions start
+# at 1MB boundaries, like those made by fdisk.
+
+import sys
+
+blocksz = 512
+align = 2048
+# "reserved for individual or local use"; the kernel ignores partition types
+parttype = 0x7f
+
+def le4(num):
+  l = [chr((num >> i*8) & 0xff) for i in range(4)]
+  return ''.join(l)
+
+def roundup(n, to):
+  ret = n + to - 1
+  return ret - (ret % to)
+
+def usage():
+  print >> sys.stderr, 'usage: %s <output image> <partition image>...' % (sys.argv[0])
+  sys.exit(-1)
+
+if __name__ == '__main__':
+  if len(sys.argv) < 3 or len(sys.argv) > 6:
+    usage()
+  ofn = sys.argv[1]
+  parts = []
+  for fn in sys.argv[2:]:
+    with open(fn, 'r') as f:
+      parts.append(f.read())
+
+  mbr = ['\0']*blocksz
+  start = align
+  layout = []
+  for i, d in enumerate(parts):
+    nsect = roundup(len(d), blocksz) / blocksz
+    ent = '\0'*4 + chr(parttype) + '\0'*3 + le4(start) + le4(nsect)
+    off = 446 + 16*i
+    mbr[off:off + 16] = list(ent)
+    layout.append((start, d))
+    start = roundup(start + nsect, align)
+  mbr[510] = chr(0x55)
+  mbr[511] = chr(0xaa)
+
+  with open(ofn, 'w') as of:
+    of.write(''.join(mbr))
+    for s, d in layout:
+      of.seek(s*blocksz)
+      of.write(d)
+    # pad out the last partition
+    of.seek(start*blocksz - 1)
+    of.write('\0')
+
+  for i, (s, d) in enumerate(layout):
+    print >> sys.stderr, 'partition %d: %d blocks at %d' % (i + 1,
+        roundup(len(d), blocksz) / blocksz, s)
@@ -0,0 +1,260 @@
+package main
+
+import "fmt"
+import "hash/crc32"
+
+// partitions of a block device, found in an MBR or GPT partition table. each
+// partition is a blockdev_t of its own whose sectors are numbered from the
+// start of the partition.
+
+const(
+	mbr_sig = 510
+	mbr_parts = 446
+	mbr_entsz = 16
+	// partition types of extended partitions, which hold a chain of
+	// extended boot records describing logical partitions
+	mbr_ext_chs = 0x05
+	mbr_ext_lba = 0x0f
+	mbr_ext_linux = 0x85
+	// the protective partition of a disk with a GPT
+	mbr_gpt = 0xee
+
+	gpt_hdrsize = 12
+	gpt_hdrcrc = 16
+	gpt_ents = 72
+	gpt_nents = 80
+	gpt_entsz = 84
+	gpt_entscrc = 88
+	gpt_ent_first = 32
+	gpt_ent_last = 40
+	// bounds an entry table read from disk
+	gpt_maxents = 256
+	// the number of extended boot records followed
+	mbr_maxlogical = 128
+)
+
+type part_t struct {
+	dev	blockdev_t
+	// the first sector of the partition on dev
+	first	int
+	nsect	int
+}
+
+// the partition's sectors are copied to and from buffers addressed to dev so
+// that requesters never see their buffers' block numbers change.
+func (p *part_t) start(req *bdevreq_t) {
+	if !bdev_inrange(p, req.bufs) {
+		req.ack <- -EINVAL
+		return
+	}
+	shadows := make([]*diskbuf_t, len(req.bufs))
+	for i, b := range req.bufs {
+		shadows[i] = &diskbuf_t{block: b.block + int32(p.first)}
+		if req.cmd == BDEV_WRITE {
+			shadows[i].data = b.data
+		}
+	}
+	sreq := bdevreq_new(req.cmd, shadows)
+	sreq.fua = req.fua
+	p.dev.start(sreq)
+	go func() {
+		err := <- sreq.ack
+		if err == 0 && req.cmd == BDEV_READ {
+			for i, b := range req.bufs {
+				b.data = shadows[i].data
+			}
+		}
+		req.ack <- err
+	}()
+}
+
+func (p *part_t) capacity() int {
+	return p.nsect
+}
+
+func (p *part_t) sectsize() int {
+	return p.dev.sectsize()
+}
+
+func (p *part_t) fua() bool {
+	return p.dev.fua()
+}
+
+// returns the partitions of d, or nil if d has no partition table. name is
+// only used in messages. partitions that don't lie on d are skipped.
+func part_scan(d blockdev_t, name string) []*part_t {
+	if d.sectsize() != 512 {
+		return nil
+	}
+	mbr := &diskbuf_t{block: 0}
+	if bdev_read(d, []*diskbuf_t{mbr}) != 0 {
+		return nil
+	}
+	if readn(mbr.data[:], 2, mbr_sig) != 0xaa55 {
+		return nil
+	}
+	// the boot sector of a disk without a partition table may have
+	// anything at the partition entries; reject those with bogus status
+	// bytes
+	for i := 0; i < 4; i++ {
+		st := mbr.data[mbr_parts + i*mbr_entsz]
+		if st != 0 && st != 0x80 {
+			return nil
+		}
+	}
+
+	var ret []*part_t
+	add := func(first, nsect int) {
+		if nsect == 0 {
+			return
+		}
+		if first <= 0 || first + nsect > d.capacity() {
+			fmt.Printf("%v: partition %v at %v with %v sectors " +
+			    "is not on the disk\n", name, len(ret) + 1, first,
+			    nsect)
+			return
+		}
+		ret = append(ret, &part_t{dev: d, first: first, nsect: nsect})
+	}
+	for i := 0; i < 4; i++ {
+		typ, first, nsect := mbr_entry(mbr, i)
+		switch typ {
+		case 0:
+		case mbr_gpt:
+			return gpt_scan(d, name)
+		case mbr_ext_chs, mbr_ext_lba, mbr_ext_linux:
+			for _, l := range mbr_logical(d, first) {
+				add(l[0], l[1])
+			}
+		default:
+			add(first, nsect)
+		}
+	}
+	for i, p := range ret {
+		fmt.Printf("%vp%v: %v sectors at %v\n", name, i + 1, p.nsect,
+		    p.first)
+	}
+	return ret
+}
+
+// returns the type, first sector, and number of sectors of the ith entry of
+// the MBR or EBR in b
+func mbr_entry(b *diskbuf_t, i int) (int, int, int) {
+	off := mbr_parts + i*mbr_entsz
+	typ := int(b.data[off + 4])
+	first := readn(b.data[:], 4, off + 8)
+	nsect := readn(b.data[:], 4, off + 12)
+	return typ, first, nsect
+}
+
+// follows the chain of extended boot records of the extended partition
+// starting at sector ext, returning the first sector and length of each
+// logical partition. the first entry of an EBR describes a logical partition
+// relative to the EBR; the second points to the next EBR relative to ext.
+func mbr_logical(d blockdev_t, ext int) [][2]int {
+	var ret [][2]int
+	ebrn := ext
+	for i := 0; i < mbr_maxlogical; i++ {
+		if ebrn <= 0 || ebrn >= d.capacity() {
+			break
+		}
+		ebr := &diskbuf_t{block: int32(ebrn)}
+		if bdev_read(d, []*diskbuf_t{ebr}) != 0 ||
+		    readn(ebr.data[:], 2, mbr_sig) != 0xaa55 {
+			break
+		}
+		typ, first, nsect := mbr_entry(ebr, 0)
+		if typ != 0 {
+			ret = append(ret, [2]int{ebrn + first, nsect})
+		}
+		typ, first, _ = mbr_entry(ebr, 1)
+		if typ == 0 || first == 0 {
+			break
+		}
+		ebrn = ext + first
+	}
+	return ret
+}
+
+// parses the GPT whose header is in sector 1 of d. only the primary header
+// and entry table are used; the backup copies at the end of the disk are
+// ignored.
+func gpt_scan(d blockdev_t, name string) []*part_t {
+	hdr := &diskbuf_t{block: 1}
+	if bdev_read(d, []*diskbuf_t{hdr}) != 0 {
+		return nil
+	}
+	h := hdr.data[:]
+	if string(h[:8]) != "EFI PART" {
+		fmt.Printf("%v: no GPT header\n", name)
+		return nil
+	}
+	hsz := readn(h, 4, gpt_hdrsize)
+	if hsz < 92 || hsz > 512 {
+		fmt.Printf("%v: bad GPT header size\n", name)
+		return nil
+	}
+	// the header's CRC is computed with the CRC field zeroed
+	want := uint32(readn(h, 4, gpt_hdrcrc))
+	writen(h, 4, gpt_hdrcrc, 0)
+	if crc32.ChecksumIEEE(h[:hsz]) != want {
+		fmt.Printf("%v: bad GPT header checksum\n", name)
+		return nil
+	}
+	entlba := readn(h, 8, gpt_ents)
+	nents := readn(h, 4, gpt_nents)
+	esz := readn(h, 4, gpt_entsz)
+	if nents > gpt_maxents || esz < 128 || esz > 512 || esz % 8 != 0 {
+		fmt.Printf("%v: unsupported GPT entry table\n", name)
+		return nil
+	}
+	tsz := nents*esz
+	nsect := roundup(tsz, 512)/512
+	if entlba <= 1 || entlba + nsect > d.capacity() {
+		fmt.Printf("%v: GPT entry table is not on the disk\n", name)
+		return nil
+	}
+	bufs := make([]*diskbuf_t, nsect)
+	for i := range bufs {
+		bufs[i] = &diskbuf_t{block: int32(entlba + i)}
+	}
+	if bdev_read(d, bufs) != 0 {
+		return nil
+	}
+	tab := make([]uint8, 0, nsect*512)
+	for _, b := range bufs {
+		tab = append(tab, b.data[:]...)
+	}
+	if crc32.ChecksumIEEE(tab[:tsz]) != uint32(readn(h, 4, gpt_entscrc)) {
+		fmt.Printf("%v: bad GPT entry table checksum\n", name)
+		return nil
+	}
+
+	var ret []*part_t
+	for i := 0; i < nents; i++ {
+		e := tab[i*esz:(i + 1)*esz]
+		// unused entries have a zero type GUID
+		used := false
+		for _, c := range e[:16] {
+			if c != 0 {
+				used = true
+				break
+			}
+		}
+		if !used {
+			continue
+		}
+		first := readn(e, 8, gpt_ent_first)
+		last := readn(e, 8, gpt_ent_last)
+		if first <= 1 || last < first || last >= d.capacity() {
+			fmt.Printf("%v: GPT partition %v is not on the disk\n",
+			    name, i + 1)
+			continue
+		}
+		p := &part_t{dev: d, first: first, nsect: last - first + 1}
+		ret = append(ret, p)
+		fmt.Printf("%vp%v: %v sectors at %v\n", name, len(ret),
+		    p.nsect, p.first)
+	}
+	return ret
+}
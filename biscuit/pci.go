@@ -0,0 +1,359 @@
+package main
+
+import "fmt"
+import "runtime"
+
+// PCI configuration space access through configuration mechanism #1,
+// enumeration of the functions on all buses reachable from bus 0, and
+// attachment of registered drivers to the functions they match.
+
+const(
+	pci_addr = 0xcf8
+	pci_data = 0xcfc
+
+	// configuration space registers
+	pci_id = 0x00
+	pci_cmd = 0x04
+	pci_class = 0x08
+	pci_hdr = 0x0c
+	pci_bar0 = 0x10
+	pci_bus = 0x18
+	pci_capptr = 0x34
+	pci_intr = 0x3c
+
+	// command register bits
+	pci_cmd_io = 1 << 0
+	pci_cmd_mem = 1 << 1
+	pci_cmd_bm = 1 << 2
+	pci_cmd_intxdis = 1 << 10
+	// status register bit: the capability list is valid
+	pci_st_caps = 1 << 4
+
+	// the class and subclass of PCI-to-PCI bridges
+	pci_class_bridge = 0x0604
+	pci_nbars = 6
+	// the vendor specific capability
+	pci_cap_vendor = 0x09
+)
+
+func pci_cfgaddr(bus, dev, fn, reg int) int32 {
+	if reg & 3 != 0 {
+		panic("unaligned pci register")
+	}
+	return int32(1 << 31 | bus << 16 | dev << 11 | fn << 8 | reg)
+}
+
+// reads a 32-bit register from the configuration space of a PCI function
+func pci_read(bus, dev, fn, reg int) int {
+	runtime.Outl(pci_addr, pci_cfgaddr(bus, dev, fn, reg))
+	return runtime.Inl(pci_data) & 0xffffffff
+}
+
+func pci_write(bus, dev, fn, reg, val int) {
+	runtime.Outl(pci_addr, pci_cfgaddr(bus, dev, fn, reg))
+	runtime.Outl(pci_data, int32(val))
+}
+
+type pci_bar_t struct {
+	addr	int
+	size	int
+	io	bool
+}
+
+type pci_cap_t struct {
+	id	int
+	// the capability's offset in configuration space
+	off	int
+}
+
+type pci_dev_t struct {
+	bus	int
+	dev	int
+	fn	int
+	vendor	int
+	device	int
+	class	int
+	subclass	int
+	progif	int
+	rev	int
+	// the header type, without the multi-function bit
+	htype	int
+	// the second register of a 64-bit BAR is folded into the first
+	bars	[pci_nbars]pci_bar_t
+	// the legacy interrupt line, or -1 if the function doesn't interrupt
+	// or was not assigned a line
+	irq	int
+	caps	[]pci_cap_t
+	// the driver that claimed the function, or nil
+	driver	*pci_driver_t
+}
+
+func (d *pci_dev_t) rd(reg int) int {
+	return pci_read(d.bus, d.dev, d.fn, reg)
+}
+
+func (d *pci_dev_t) wr(reg int, v int) {
+	pci_write(d.bus, d.dev, d.fn, reg, v)
+}
+
+// sets and clears bits of the command register without clearing bits of
+// the status register, which are cleared by writing ones
+func (d *pci_dev_t) command(set int, clear int) {
+	cmd := d.rd(pci_cmd) & 0xffff
+	d.wr(pci_cmd, (cmd | set) &^ clear)
+}
+
+func (d *pci_dev_t) name() string {
+	return fmt.Sprintf("%02x:%02x.%x", d.bus, d.dev, d.fn)
+}
+
+// decodes the addresses and sizes of the first n BARs. a BAR's size is found
+// by writing all ones to it and reading back which bits stuck; decoding is
+// disabled meanwhile so the device doesn't claim bogus addresses.
+func (d *pci_dev_t) decodebars(n int) {
+	cmd := d.rd(pci_cmd) & 0xffff
+	d.wr(pci_cmd, cmd &^ (pci_cmd_io | pci_cmd_mem))
+	probe := func(reg int) (int, int) {
+		v := d.rd(reg)
+		d.wr(reg, 0xffffffff)
+		m := d.rd(reg)
+		d.wr(reg, v)
+		return v, m
+	}
+	for i := 0; i < n; i++ {
+		v, m := probe(pci_bar0 + 4*i)
+		if m == 0 {
+			continue
+		}
+		b := &d.bars[i]
+		if v & 1 != 0 {
+			b.io = true
+			b.addr = v &^ 3
+			b.size = (^(m &^ 3) + 1) & 0xffff
+			continue
+		}
+		b.addr = v &^ 0xf
+		mask := m &^ 0xf | -1 << 32
+		if (v >> 1) & 3 == 2 && i + 1 < n {
+			hv, hm := probe(pci_bar0 + 4*(i + 1))
+			b.addr |= hv << 32
+			mask = mask & 0xffffffff | hm << 32
+			i++
+		}
+		b.size = -mask
+	}
+	d.wr(pci_cmd, cmd)
+}
+
+// reads the capability list
+func (d *pci_dev_t) decodecaps() {
+	if (d.rd(pci_cmd) >> 16) & pci_st_caps == 0 {
+		return
+	}
+	// a malformed list may loop
+	c := d.rd(pci_capptr) & 0xfc
+	for i := 0; c != 0 && i < 48; i++ {
+		hdr := d.rd(c)
+		d.caps = append(d.caps, pci_cap_t{hdr & 0xff, c})
+		c = (hdr >> 8) & 0xfc
+	}
+}
+
+// returns the function at bus, dev, fn, or nil if there is none
+func pci_probe(bus, dev, fn int) *pci_dev_t {
+	id := pci_read(bus, dev, fn, pci_id)
+	if id & 0xffff == 0xffff {
+		return nil
+	}
+	d := &pci_dev_t{bus: bus, dev: dev, fn: fn}
+	d.vendor = id & 0xffff
+	d.device = id >> 16
+	class := d.rd(pci_class)
+	d.rev = class & 0xff
+	d.progif = (class >> 8) & 0xff
+	d.subclass = (class >> 16) & 0xff
+	d.class = class >> 24
+	d.htype = (d.rd(pci_hdr) >> 16) & 0x7f
+	switch d.htype {
+	case 0:
+		d.decodebars(pci_nbars)
+	case 1:
+		d.decodebars(2)
+	}
+	intr := d.rd(pci_intr)
+	line, pin := intr & 0xff, (intr >> 8) & 0xff
+	d.irq = -1
+	if pin != 0 && line < 16 {
+		d.irq = line
+	}
+	d.decodecaps()
+	return d
+}
+
+// all PCI functions, in bus order
+var pci_devs	[]*pci_dev_t
+
+// adds the functions on bus and on the buses behind its bridges to pci_devs
+func pci_scan(bus int, seen *[256]bool) {
+	if seen[bus] {
+		return
+	}
+	seen[bus] = true
+	for dev := 0; dev < 32; dev++ {
+		for fn := 0; fn < 8; fn++ {
+			d := pci_probe(bus, dev, fn)
+			if d == nil {
+				if fn == 0 {
+					break
+				}
+				continue
+			}
+			pci_devs = append(pci_devs, d)
+			if d.htype == 1 &&
+			    d.class << 8 | d.subclass == pci_class_bridge {
+				sec := (d.rd(pci_bus) >> 8) & 0xff
+				pci_scan(sec, seen)
+			}
+			// single function device?
+			if fn == 0 && (d.rd(pci_hdr) >> 16) & 0x80 == 0 {
+				break
+			}
+		}
+	}
+}
+
+// matches devices by vendor and device ID and by class and subclass; -1
+// matches anything
+type pci_id_t struct {
+	vendor	int
+	device	int
+	class	int
+}
+
+type pci_driver_t struct {
+	name	string
+	ids	[]pci_id_t
+	// claims the device, returning false if the driver can't drive it
+	attach	func(*pci_dev_t) bool
+}
+
+var pci_drivers	[]*pci_driver_t
+
+// drivers must be registered before pci_init() to be offered devices
+func pci_register(drv *pci_driver_t) {
+	pci_drivers = append(pci_drivers, drv)
+}
+
+func (id *pci_id_t) matches(d *pci_dev_t) bool {
+	return (id.vendor == -1 || id.vendor == d.vendor) &&
+	    (id.device == -1 || id.device == d.device) &&
+	    (id.class == -1 || id.class == d.class << 8 | d.subclass)
+}
+
+// enumerates the PCI functions and offers each to the registered drivers
+// that match it, in the order they were registered, until one claims it.
+func pci_init() {
+	var seen [256]bool
+	pci_scan(0, &seen)
+	for _, d := range pci_devs {
+		for _, drv := range pci_drivers {
+			matched := false
+			for i := range drv.ids {
+				if drv.ids[i].matches(d) {
+					matched = true
+					break
+				}
+			}
+			if matched && drv.attach(d) {
+				d.driver = drv
+				break
+			}
+		}
+		drvname := "none"
+		if d.driver != nil {
+			drvname = d.driver.name
+		}
+		fmt.Printf("pci %v: %04x:%04x class %02x%02x irq %v " +
+		    "driver %v\n", d.name(), d.vendor, d.device, d.class,
+		    d.subclass, d.irq, drvname)
+	}
+}
+
+// the layout of the records describing a function to user space:
+//	uint8	bus, dev, fn, irq (0xff if none)
+//	uint16	vendor, device
+//	uint8	class, subclass, progif, rev, ncaps, pad[3]
+//	struct { uint64 addr; uint64 size; } bars[6]; addr has bit 0 set
+//	    for I/O space
+//	uint8	caps[16], the IDs of the first capabilities
+//	char	driver[16], NUL terminated
+const(
+	PCIREC_BARS	= 16
+	PCIREC_CAPS	= PCIREC_BARS + pci_nbars*16
+	PCIREC_MAXCAPS	= 16
+	PCIREC_DRIVER	= PCIREC_CAPS + PCIREC_MAXCAPS
+	PCIREC_NAMELEN	= 16
+	PCIREC_SIZE	= PCIREC_DRIVER + PCIREC_NAMELEN
+)
+
+func (d *pci_dev_t) record(b []uint8) {
+	for i := range b[:PCIREC_SIZE] {
+		b[i] = 0
+	}
+	b[0] = uint8(d.bus)
+	b[1] = uint8(d.dev)
+	b[2] = uint8(d.fn)
+	b[3] = uint8(d.irq)
+	writen(b, 2, 4, d.vendor)
+	writen(b, 2, 6, d.device)
+	b[8] = uint8(d.class)
+	b[9] = uint8(d.subclass)
+	b[10] = uint8(d.progif)
+	b[11] = uint8(d.rev)
+	b[12] = uint8(len(d.caps))
+	for i, bar := range d.bars {
+		addr := bar.addr
+		if bar.io {
+			addr |= 1
+		}
+		writen(b, 8, PCIREC_BARS + 16*i, addr)
+		writen(b, 8, PCIREC_BARS + 16*i + 8, bar.size)
+	}
+	for i, c := range d.caps {
+		if i == PCIREC_MAXCAPS {
+			break
+		}
+		b[PCIREC_CAPS + i] = uint8(c.id)
+	}
+	if d.driver != nil {
+		name := []uint8(d.driver.name)
+		if len(name) >= PCIREC_NAMELEN {
+			name = name[:PCIREC_NAMELEN - 1]
+		}
+		copy(b[PCIREC_DRIVER:], name)
+	}
+}
+
+// PCI interrupts are level-triggered and may be shared by several devices.
+// trapstub calls pci_intr_clear() to deassert the interrupts of every device
+// on the vector before interrupts are enabled again; trap_pci() then wakes
+// the devices' daemons. returns false if no PCI device uses the vector.
+//go:nosplit
+func pci_intr_clear(trapno int) bool {
+	ret := false
+	if trapno == ahci_int {
+		ahci_intr_clear()
+		ret = true
+	}
+	if vio_intr_clear(trapno) {
+		ret = true
+	}
+	return ret
+}
+
+func trap_pci(ts *trapstore_t) {
+	if ts.trapno == ahci_int {
+		trap_ahci(ts)
+	}
+	trap_vio(ts)
+}
@@ -330,6 +330,46 @@ func is_mapped_str(pmap *[512]int, va int, lenmax int) (string, bool, bool) {
 	}
 }
 
+// copies src to the user address va of proc, copying copy-on-write pages
+// first. returns false if the destination is not mapped writable.
+func copyout(proc *proc_t, va int, src []uint8) bool {
+	proc.maplock.Lock()
+	defer proc.maplock.Unlock()
+	for len(src) != 0 {
+		pte := pmap_walk(proc.pmap, va, false, 0, nil)
+		if pte == nil || *pte & (PTE_P | PTE_U) != PTE_P | PTE_U {
+			return false
+		}
+		if *pte & PTE_COW != 0 {
+			proc.cow_break(pte, va)
+		}
+		if *pte & PTE_W == 0 {
+			return false
+		}
+		dst := dmap8(*pte & PTE_ADDR + va & PGOFFSET)
+		n := copy(dst, src)
+		src = src[n:]
+		va += n
+	}
+	return true
+}
+
+// copies len(dst) bytes from the user address va to dst. returns false if the
+// source is not mapped.
+func copyin(pmap *[512]int, va int, dst []uint8) bool {
+	for len(dst) != 0 {
+		pte := pmap_walk(pmap, va, false, 0, nil)
+		if pte == nil || *pte & (PTE_P | PTE_U) != PTE_P | PTE_U {
+			return false
+		}
+		src := dmap8(*pte & PTE_ADDR + va & PGOFFSET)
+		n := copy(dst, src)
+		dst = dst[n:]
+		va += n
+	}
+	return true
+}
+
 func invlpg(va int) {
 	dur := unsafe.Pointer(uintptr(va))
 	runtime.Invlpg(dur)
@@ -0,0 +1,374 @@
+package main
+
+import "fmt"
+import "runtime"
+import "sort"
+import "strconv"
+import "strings"
+
+import "./fs"
+
+// procfs presents processes and kernel state as read-only text files. a
+// file's contents are generated when it is opened, so reading an open file
+// returns the state at the time of the open. directories read as the names
+// of their entries, one per line.
+//
+//	/proc/meminfo		memory use
+//	/proc/cpuinfo		the CPUs
+//	/proc/mounts		the mounted file systems
+//	/proc/<pid>/status	the name, state, and memory use of a process
+//	/proc/<pid>/cmdline	the command it runs
+//	/proc/<pid>/maps	its user memory mappings
+//	/proc/<pid>/cwd		its working directory
+//	/proc/<pid>/fd/<n>	its open file n
+
+var procfs_type	= fstype_t{name: "proc", mount: procfs_mount}
+
+type procfs_t struct {
+	// the CPUs don't change, and finding them scans the BIOS
+	cpus	[]mpcpu_t
+}
+
+func procfs_mount(dev blockdev_t, flags int, data string) (fs_t, int) {
+	if data != "" {
+		return nil, -EINVAL
+	}
+	return &procfs_t{cpus: cpus_find()}, 0
+}
+
+// the entries of a process's directory
+var procfs_pident	= []string{"cmdline", "cwd", "fd", "maps", "status"}
+
+// the entries of the root directory besides the processes
+var procfs_rootent	= []string{"cpuinfo", "meminfo", "mounts"}
+
+// an open procfs file or directory
+type pfile_t struct {
+	data	[]uint8
+	dir	bool
+	ino	int
+}
+
+// returns the process whose pid is name
+func procfs_proc(name string) (*proc_t, bool) {
+	pid, err := strconv.Atoi(name)
+	if err != nil {
+		return nil, false
+	}
+	proclock.Lock()
+	p, ok := allprocs[pid]
+	proclock.Unlock()
+	return p, ok
+}
+
+// returns the directory listing of names
+func procfs_ls(names []string) []uint8 {
+	return []uint8(strings.Join(names, "\n") + "\n")
+}
+
+func procfs_pids() []int {
+	proclock.Lock()
+	defer proclock.Unlock()
+	pids := make([]int, 0, len(allprocs))
+	for pid := range allprocs {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	return pids
+}
+
+func (pf *procfs_t) open(path []string, flags int, mode int) (fops_t, int) {
+	if flags & (O_CREAT | O_TRUNC | O_WRONLY | O_RDWR) != 0 {
+		return nil, -EPERM
+	}
+	f := pf.lookup(path)
+	if f == nil {
+		return nil, -ENOENT
+	}
+	return f, 0
+}
+
+// generates the file at path, or returns nil if there is none
+func (pf *procfs_t) lookup(path []string) *pfile_t {
+	if len(path) == 0 {
+		var names []string
+		for _, pid := range procfs_pids() {
+			names = append(names, strconv.Itoa(pid))
+		}
+		names = append(names, procfs_rootent...)
+		return &pfile_t{data: procfs_ls(names), dir: true, ino: 1}
+	}
+	switch path[0] {
+	case "meminfo":
+		if len(path) != 1 {
+			return nil
+		}
+		return &pfile_t{data: procfs_meminfo(), ino: 2}
+	case "cpuinfo":
+		if len(path) != 1 {
+			return nil
+		}
+		return &pfile_t{data: pf.cpuinfo(), ino: 3}
+	case "mounts":
+		if len(path) != 1 {
+			return nil
+		}
+		return &pfile_t{data: procfs_mounts(), ino: 4}
+	}
+	p, ok := procfs_proc(path[0])
+	if !ok {
+		return nil
+	}
+	return procfs_pid(p, path[1:])
+}
+
+// generates the file at path in the directory of process p. inode numbers of
+// a process's files hold its pid above the number of the file.
+func procfs_pid(p *proc_t, path []string) *pfile_t {
+	ino := p.pid << 16
+	if len(path) == 0 {
+		return &pfile_t{data: procfs_ls(procfs_pident), dir: true,
+		    ino: ino}
+	}
+	if path[0] == "fd" {
+		return procfs_fd(p, path[1:], ino | 1 << 8)
+	}
+	if len(path) != 1 {
+		return nil
+	}
+	var data []uint8
+	switch path[0] {
+	case "cmdline":
+		data = []uint8(p.name + "\n")
+	case "cwd":
+		data = []uint8(p.cwd + "\n")
+	case "maps":
+		data = procfs_maps(p)
+	case "status":
+		data = procfs_status(p)
+	default:
+		return nil
+	}
+	for i, n := range procfs_pident {
+		if n == path[0] {
+			ino |= i + 2
+		}
+	}
+	return &pfile_t{data: data, ino: ino}
+}
+
+func procfs_status(p *proc_t) []uint8 {
+	state := "running"
+	if p.dead {
+		state = "dead"
+	}
+	p.maplock.Lock()
+	npages, nupages := len(p.pages), len(p.upages)
+	p.maplock.Unlock()
+	p.fdl.Lock()
+	nfds := len(p.fds)
+	p.fdl.Unlock()
+	s := fmt.Sprintf("Name:\t%v\n", p.name)
+	s += fmt.Sprintf("Pid:\t%v\n", p.pid)
+	s += fmt.Sprintf("State:\t%v\n", state)
+	// pages holds the user pages and the page map pages
+	s += fmt.Sprintf("Pages:\t%v\n", npages)
+	s += fmt.Sprintf("UserPages:\t%v\n", nupages)
+	s += fmt.Sprintf("FDs:\t%v\n", nfds)
+	return []uint8(s)
+}
+
+// lists runs of user pages that are mapped consecutively with the same
+// permissions. the last column is "w" for writable pages and "c" for
+// copy-on-write pages.
+func procfs_maps(p *proc_t) []uint8 {
+	p.maplock.Lock()
+	defer p.maplock.Unlock()
+	vas := make([]int, 0, len(p.upages))
+	for _, va := range p.upages {
+		vas = append(vas, va)
+	}
+	sort.Ints(vas)
+	perm := func(va int) string {
+		pte := pmap_walk(p.pmap, va, false, 0, nil)
+		if pte == nil {
+			return "-"
+		}
+		switch {
+		case *pte & PTE_W != 0:
+			return "w"
+		case *pte & PTE_COW != 0:
+			return "c"
+		}
+		return "-"
+	}
+	s := ""
+	for i := 0; i < len(vas); {
+		start := vas[i]
+		pr := perm(start)
+		end := start + PGSIZE
+		i++
+		for i < len(vas) && vas[i] == end && perm(vas[i]) == pr {
+			end += PGSIZE
+			i++
+		}
+		s += fmt.Sprintf("%016x-%016x r%v\n", start, end, pr)
+	}
+	return []uint8(s)
+}
+
+// the fd directory lists the open file descriptors; each file describes one
+func procfs_fd(p *proc_t, path []string, ino int) *pfile_t {
+	p.fdl.Lock()
+	defer p.fdl.Unlock()
+	if len(path) == 0 {
+		fdns := make([]int, 0, len(p.fds))
+		for fdn := range p.fds {
+			fdns = append(fdns, fdn)
+		}
+		sort.Ints(fdns)
+		names := make([]string, len(fdns))
+		for i, fdn := range fdns {
+			names[i] = strconv.Itoa(fdn)
+		}
+		return &pfile_t{data: procfs_ls(names), dir: true, ino: ino}
+	}
+	if len(path) != 1 {
+		return nil
+	}
+	fdn, err := strconv.Atoi(path[0])
+	if err != nil {
+		return nil
+	}
+	fd, ok := p.fds[fdn]
+	if !ok {
+		return nil
+	}
+	// the console may have been opened without /dev
+	mnt := "none"
+	if fd.file.mnt != nil {
+		mnt = "/" + strings.Join(fd.file.mnt.path, "/")
+		if fd.file.mnt.gone {
+			mnt += " (unmounted)"
+		}
+	}
+	s := fmt.Sprintf("pos:\t%v\nflags:\t%#x\nmnt:\t%v\n", fd.offset,
+	    fd.perms, mnt)
+	return &pfile_t{data: []uint8(s), ino: ino | fdn & 0xff}
+}
+
+func procfs_meminfo() []uint8 {
+	upgs := 0
+	proclock.Lock()
+	nprocs := len(allprocs)
+	for _, p := range allprocs {
+		p.maplock.Lock()
+		upgs += len(p.upages)
+		p.maplock.Unlock()
+	}
+	proclock.Unlock()
+	kb := PGSIZE/1024
+	s := fmt.Sprintf("MemFree:\t%v kB\n", runtime.Pgsavail()*kb)
+	s += fmt.Sprintf("UserPages:\t%v kB\n", upgs*kb)
+	s += fmt.Sprintf("BlockCacheMax:\t%v kB\n", fs.Bc_nbufs()*512/1024)
+	s += fmt.Sprintf("Processes:\t%v\n", nprocs)
+	return []uint8(s)
+}
+
+// the boot CPU is the only one without an MP configuration table
+func (pf *procfs_t) cpuinfo() []uint8 {
+	cpus := pf.cpus
+	if cpus == nil {
+		cpus = []mpcpu_t{{0, true}}
+	}
+	s := ""
+	for i, c := range cpus {
+		bsp := "no"
+		if c.bsp {
+			bsp = "yes"
+		}
+		s += fmt.Sprintf("processor:\t%v\napicid:\t%v\nbsp:\t%v\n\n",
+		    i, c.lapid, bsp)
+	}
+	return []uint8(s)
+}
+
+func procfs_mounts() []uint8 {
+	mountl.Lock()
+	defer mountl.Unlock()
+	s := ""
+	for _, m := range mounts {
+		if m.busy {
+			continue
+		}
+		opt := "rw"
+		if m.flags & MS_RDONLY != 0 {
+			opt = "ro"
+		}
+		s += fmt.Sprintf("%v /%v %v %v\n", m.src,
+		    strings.Join(m.path, "/"), m.typ.name, opt)
+	}
+	return []uint8(s)
+}
+
+func (pf *procfs_t) mkdir(path []string, mode int) int {
+	return -EPERM
+}
+
+func (pf *procfs_t) mknod(path []string, major int, minor int) int {
+	return -EPERM
+}
+
+func (pf *procfs_t) link(oldp []string, newp []string) int {
+	return -EPERM
+}
+
+func (pf *procfs_t) unlink(path []string) int {
+	return -EPERM
+}
+
+func (pf *procfs_t) sync() int {
+	return 0
+}
+
+func (pf *procfs_t) unmount() int {
+	return 0
+}
+
+func (f *pfile_t) read(dsts [][]uint8, offset int) (int, int) {
+	c := 0
+	for _, dst := range dsts {
+		if offset + c >= len(f.data) {
+			break
+		}
+		c += copy(dst, f.data[offset + c:])
+	}
+	return c, 0
+}
+
+func (f *pfile_t) write(srcs [][]uint8, offset int, append bool) (int, int) {
+	return 0, -EPERM
+}
+
+func (f *pfile_t) fsync() int {
+	return 0
+}
+
+func (f *pfile_t) truncate(newlen int) int {
+	return -EPERM
+}
+
+func (f *pfile_t) stat(st *stat_t) int {
+	st.ino = f.ino
+	st.mode = S_IFREG
+	if f.dir {
+		st.mode = S_IFDIR
+	}
+	st.nlink = 1
+	st.size = len(f.data)
+	return 0
+}
+
+func (f *pfile_t) close() int {
+	return 0
+}
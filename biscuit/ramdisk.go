@@ -0,0 +1,55 @@
+package main
+
+import "sync"
+
+// the number of sectors of the RAM disk seeded from the embedded ramfs.img.
+// the Makefile reads this line to make ramfs.img.
+const RAMFS_BLKS = 8192
+
+// a block device backed by memory
+type ramdisk_t struct {
+	sync.Mutex
+	data	[]uint8
+}
+
+// returns a RAM disk of nsect sectors whose first sectors hold a copy of img.
+func ramdisk_new(img []uint8, nsect int) *ramdisk_t {
+	if len(img) > nsect*512 {
+		panic("image larger than RAM disk")
+	}
+	ret := &ramdisk_t{}
+	ret.data = make([]uint8, nsect*512)
+	copy(ret.data, img)
+	return ret
+}
+
+func (rd *ramdisk_t) start(req *bdevreq_t) {
+	go func() {
+		rd.Lock()
+		for _, b := range req.bufs {
+			off := int(b.block)*512
+			sect := rd.data[off:off + 512]
+			switch req.cmd {
+			case BDEV_READ:
+				copy(b.data[:], sect)
+			case BDEV_WRITE:
+				copy(sect, b.data[:])
+			}
+		}
+		rd.Unlock()
+		req.ack <- 0
+	}()
+}
+
+func (rd *ramdisk_t) capacity() int {
+	return len(rd.data)/512
+}
+
+func (rd *ramdisk_t) sectsize() int {
+	return 512
+}
+
+// writes are stable once they are done
+func (rd *ramdisk_t) fua() bool {
+	return true
+}
@@ -3,6 +3,7 @@ package main
 import "fmt"
 import "runtime"
 import "strings"
+import "time"
 import "unsafe"
 
 const(
@@ -27,13 +28,26 @@ const(
 const(
   EPERM        = 1
   ENOENT       = 2
+  EIO          = 5
+  ENXIO        = 6
   EBADF        = 9
   EFAULT       = 14
+  EBUSY        = 16
   EEXIST       = 17
+  EXDEV        = 18
+  ENODEV       = 19
   ENOTDIR      = 20
+  EISDIR       = 21
   EINVAL       = 22
+  ENOTTY       = 25
+  EFBIG        = 27
+  ENOSPC       = 28
+  EROFS        = 30
   ENAMETOOLONG = 36
   ENOSYS       = 38
+  ENOTEMPTY    = 39
+  ENOTCONN     = 107
+  ETIMEDOUT    = 110
 )
 
 const(
@@ -44,13 +58,27 @@ const(
     O_WRONLY      = 1
     O_RDWR        = 2
     O_CREAT       = 0x80
+    O_TRUNC       = 0x200
     O_APPEND      = 0x400
+  SYS_CLOSE    = 3
+  SYS_FSTAT    = 5
+  SYS_POLL     = 7
+  SYS_IOCTL    = 16
   SYS_GETPID   = 39
   SYS_FORK     = 57
   SYS_EXIT     = 60
+  SYS_FSYNC    = 74
+  SYS_FDATASYNC = 75
+  SYS_FTRUNCATE = 77
   SYS_MKDIR    = 83
   SYS_LINK     = 86
   SYS_UNLINK   = 87
+  SYS_MKNOD    = 133
+  SYS_SYNC     = 162
+  SYS_MOUNT    = 165
+  SYS_UMOUNT2  = 166
+  // biscuit specific
+  SYS_PCILIST  = 500
 )
 
 // lowest userspace address
@@ -68,8 +96,8 @@ func syscall(pid int, tf *[TFSIZE]int) {
 	a1 := tf[TF_RDI]
 	a2 := tf[TF_RSI]
 	a3 := tf[TF_RDX]
-	//a4 := tf[TF_RCX]
-	//a5 := tf[TF_R8]
+	a4 := tf[TF_RCX]
+	a5 := tf[TF_R8]
 
 	ret := -ENOSYS
 	switch trap {
@@ -79,6 +107,14 @@ func syscall(pid int, tf *[TFSIZE]int) {
 		ret = sys_write(p, a1, a2, a3)
 	case SYS_OPEN:
 		ret = sys_open(p, a1, a2, a3)
+	case SYS_CLOSE:
+		ret = sys_close(p, a1)
+	case SYS_FSTAT:
+		ret = sys_fstat(p, a1, a2)
+	case SYS_POLL:
+		ret = sys_poll(p, a1, a2, a3)
+	case SYS_IOCTL:
+		ret = sys_ioctl(p, a1, a2, a3)
 	case SYS_GETPID:
 		ret = sys_getpid(p)
 	case SYS_FORK:
@@ -91,6 +127,22 @@ func syscall(pid int, tf *[TFSIZE]int) {
 		ret = sys_link(p, a1, a2)
 	case SYS_UNLINK:
 		ret = sys_unlink(p, a1)
+	case SYS_MKNOD:
+		ret = sys_mknod(p, a1, a2, a3)
+	case SYS_FSYNC:
+		ret = sys_fsync(p, a1)
+	case SYS_FDATASYNC:
+		ret = sys_fdatasync(p, a1)
+	case SYS_FTRUNCATE:
+		ret = sys_ftruncate(p, a1, a2)
+	case SYS_SYNC:
+		ret = sys_sync(p)
+	case SYS_MOUNT:
+		ret = sys_mount(p, a1, a2, a3, a4, a5)
+	case SYS_UMOUNT2:
+		ret = sys_umount2(p, a1, a2)
+	case SYS_PCILIST:
+		ret = sys_pcilist(p, a1, a2)
 	}
 
 	tf[TF_RAX] = ret
@@ -134,11 +186,13 @@ func sys_read(proc *proc_t, fdn int, bufp int, sz int) int {
 		c += len(dst)
 	}
 
-	ret, err := fs_read(dsts, fd.file.priv, fd.offset)
+	ret, err := fd.file.read(dsts, fd.offset)
 	if err != 0 {
 		return err
 	}
+	proc.fdl.Lock()
 	fd.offset += ret
+	proc.fdl.Unlock()
 	return ret
 }
 
@@ -160,23 +214,6 @@ func sys_write(proc *proc_t, fdn int, bufp int, sz int) int {
 		ret += va & PGOFFSET
 		return ret
 	}
-	wrappy := fs_write
-	// stdout/stderr hack
-	if fd == &fd_stdout || fd == &fd_stderr {
-		wrappy = func(srcs [][]uint8, priv inum, off int,
-		    ap bool) (int, int) {
-			utext := int8(0x17)
-			c := 0
-			for _, s := range srcs {
-				for _, c := range s {
-					runtime.Putcha(int8(c), utext)
-				}
-				c += len(s)
-			}
-			return c, 0
-		}
-	}
-
 	apnd := fd.perms & O_APPEND != 0
 	c := 0
 	srcs := make([][]uint8, 1)
@@ -191,14 +228,46 @@ func sys_write(proc *proc_t, fdn int, bufp int, sz int) int {
 		srcs = append(srcs, src)
 		c += len(src)
 	}
-	ret, err := wrappy(srcs, fd.file.priv, fd.offset, apnd)
+	ret, err := fd.file.write(srcs, fd.offset, apnd)
 	if err != 0 {
 		return err
 	}
+	proc.fdl.Lock()
 	fd.offset += ret
+	proc.fdl.Unlock()
 	return ret
 }
 
+const NAME_MAX    int = 512
+
+// resolves "." and ".." by name so that ".." of a mount point's root leads
+// to the directory holding the mount point.
+func path_sanitize(cwd, path string) ([]string, bool) {
+	if path == "" {
+		return nil, true
+	}
+	if path[0] != '/' {
+		path = cwd + path
+	}
+	sp := strings.Split(path, "/")
+	nn := []string{}
+	for _, s := range sp {
+		switch s {
+		case "", ".":
+		case "..":
+			if len(nn) > 0 {
+				nn = nn[:len(nn) - 1]
+			}
+		default:
+			nn = append(nn, s)
+		}
+	}
+	if len(nn) == 0 {
+		return nil, true
+	}
+	return nn, false
+}
+
 func sys_open(proc *proc_t, pathn int, flags int, mode int) int {
 	path, ok, toolong := is_mapped_str(proc.pmap, pathn, NAME_MAX)
 	if !ok {
@@ -215,18 +284,20 @@ func sys_open(proc *proc_t, pathn int, flags int, mode int) int {
 	if badp {
 		return -ENOENT
 	}
-	file, err := fs_open(parts, flags, mode)
+	file, err := vfs_open(parts, flags, mode)
 	if err != 0 {
 		return err
 	}
-	fdn, fd := proc.fd_new()
-	fd.perms = temp
+	perms := temp
 	switch {
 	case flags & O_APPEND != 0:
-		fd.perms |= O_APPEND
+		perms |= O_APPEND
 	}
-	fd.file = file
-	return fdn
+	return proc.fd_new(file, perms)
+}
+
+func sys_close(proc *proc_t, fdn int) int {
+	return proc.fd_close(fdn)
 }
 
 func sys_mkdir(proc *proc_t, pathn int, mode int) int {
@@ -241,7 +312,81 @@ func sys_mkdir(proc *proc_t, pathn int, mode int) int {
 	if badp {
 		return -ENOENT
 	}
-	return fs_mkdir(parts, mode)
+	return vfs_mkdir(parts, mode)
+}
+
+// only character devices can be made; dev is made by mkdev
+func sys_mknod(proc *proc_t, pathn int, mode int, dev int) int {
+	path, ok, toolong := is_mapped_str(proc.pmap, pathn, NAME_MAX)
+	if !ok {
+		return -EFAULT
+	}
+	if toolong {
+		return -ENAMETOOLONG
+	}
+	if mode & S_IFMT != S_IFCHR {
+		return -EINVAL
+	}
+	parts, badp := path_sanitize(proc.cwd, path)
+	if badp {
+		return -EEXIST
+	}
+	major, minor := unmkdev(dev)
+	return vfs_mknod(parts, major, minor)
+}
+
+func sys_ioctl(proc *proc_t, fdn int, cmd int, arg int) int {
+	fd, ok := proc.fds[fdn]
+	if !ok {
+		return -EBADF
+	}
+	return fd.file.ioctl(cmd, arg)
+}
+
+// the size of a struct pollfd: the fd, the events to wait for, and the events
+// that happened
+const POLLFD_SIZE = 8
+
+// waits until one of the n file descriptors in the array at fdsn has one of
+// the events it waits for, or for timeout milliseconds if timeout is not
+// negative. returns the number of descriptors with events.
+func sys_poll(proc *proc_t, fdsn int, n int, timeout int) int {
+	if n < 0 || n > 1024 {
+		return -EINVAL
+	}
+	buf := make([]uint8, n*POLLFD_SIZE)
+	if !copyin(proc.pmap, fdsn, buf) {
+		return -EFAULT
+	}
+	var deadline time.Time
+	if timeout >= 0 {
+		deadline = time.Now().Add(time.Duration(timeout)*time.Millisecond)
+	}
+	for {
+		ready := 0
+		for i := 0; i < n; i++ {
+			pfd := buf[i*POLLFD_SIZE:]
+			fdn := int(int32(readn(pfd, 4, 0)))
+			events := readn(pfd, 2, 4)
+			revents := 0
+			if fd, ok := proc.fds[fdn]; ok {
+				revents = fd.file.poll(events)
+			} else if fdn >= 0 {
+				revents = POLLNVAL
+			}
+			writen(pfd, 2, 6, revents)
+			if revents != 0 {
+				ready++
+			}
+		}
+		if ready != 0 || (timeout >= 0 && !time.Now().Before(deadline)) {
+			if !copyout(proc, fdsn, buf) {
+				return -EFAULT
+			}
+			return ready
+		}
+		time.Sleep(10*time.Millisecond)
+	}
 }
 
 func sys_link(proc *proc_t, oldn int, newn int) int {
@@ -258,7 +403,7 @@ func sys_link(proc *proc_t, oldn int, newn int) int {
 	if badp1 || badp2 {
 		return -ENOENT
 	}
-	return fs_link(opath, npath)
+	return vfs_link(opath, npath)
 }
 
 func sys_unlink(proc *proc_t, pathn int) int {
@@ -273,7 +418,118 @@ func sys_unlink(proc *proc_t, pathn int) int {
 	if badp {
 		return -ENOENT
 	}
-	return fs_unlink(parts)
+	return vfs_unlink(parts)
+}
+
+func sys_fsync(proc *proc_t, fdn int) int {
+	fd, ok := proc.fds[fdn]
+	if !ok {
+		return -EBADF
+	}
+	return fd.file.fsync()
+}
+
+// no file system keeps data apart from metadata, so there is nothing cheaper
+// to do than fsync.
+func sys_fdatasync(proc *proc_t, fdn int) int {
+	return sys_fsync(proc, fdn)
+}
+
+func sys_ftruncate(proc *proc_t, fdn int, newlen int) int {
+	fd, ok := proc.fds[fdn]
+	if !ok {
+		return -EBADF
+	}
+	if fd.perms & (O_WRONLY | O_RDWR) == 0 {
+		return -EBADF
+	}
+	if newlen < 0 {
+		return -EINVAL
+	}
+	return fd.file.truncate(newlen)
+}
+
+func sys_fstat(proc *proc_t, fdn int, statn int) int {
+	fd, ok := proc.fds[fdn]
+	if !ok {
+		return -EBADF
+	}
+	st := &stat_t{}
+	if err := fd.file.stat(st); err != 0 {
+		return err
+	}
+	buf := make([]uint8, STAT_SIZE)
+	st.record(buf)
+	if !copyout(proc, statn, buf) {
+		return -EFAULT
+	}
+	return 0
+}
+
+func sys_sync(proc *proc_t) int {
+	return vfs_sync()
+}
+
+// datan may be 0 if the file system type takes no options
+func sys_mount(proc *proc_t, srcn int, tgtn int, typn int, flags int,
+    datan int) int {
+	src, ok1, toolong1 := is_mapped_str(proc.pmap, srcn, NAME_MAX)
+	tgt, ok2, toolong2 := is_mapped_str(proc.pmap, tgtn, NAME_MAX)
+	typ, ok3, toolong3 := is_mapped_str(proc.pmap, typn, NAME_MAX)
+	if !ok1 || !ok2 || !ok3 {
+		return -EFAULT
+	}
+	if toolong1 || toolong2 || toolong3 {
+		return -ENAMETOOLONG
+	}
+	data := ""
+	if datan != 0 {
+		var ok, toolong bool
+		data, ok, toolong = is_mapped_str(proc.pmap, datan, NAME_MAX)
+		if !ok {
+			return -EFAULT
+		}
+		if toolong {
+			return -ENAMETOOLONG
+		}
+	}
+	parts, badp := path_sanitize(proc.cwd, tgt)
+	if badp {
+		// the root is always mounted
+		return -EBUSY
+	}
+	return vfs_mount(src, parts, typ, flags, data)
+}
+
+func sys_umount2(proc *proc_t, tgtn int, flags int) int {
+	tgt, ok, toolong := is_mapped_str(proc.pmap, tgtn, NAME_MAX)
+	if !ok {
+		return -EFAULT
+	}
+	if toolong {
+		return -ENAMETOOLONG
+	}
+	parts, _ := path_sanitize(proc.cwd, tgt)
+	return vfs_umount(parts, flags)
+}
+
+// copies records describing up to n PCI functions to bufp and returns the
+// number of functions, which may be larger than n.
+func sys_pcilist(proc *proc_t, bufp int, n int) int {
+	if n < 0 {
+		return -EINVAL
+	}
+	if n > len(pci_devs) {
+		n = len(pci_devs)
+	}
+	buf := make([]uint8, n*PCIREC_SIZE)
+	for i := 0; i < n; i++ {
+		pci_devs[i].record(buf[i*PCIREC_SIZE:])
+	}
+	if !copyout(proc, bufp, buf) {
+		return -EFAULT
+	}
+	return len(pci_devs)
 }
 
 func sys_getpid(proc *proc_t) int {
@@ -284,6 +540,24 @@ func sys_fork(parent *proc_t, ptf *[TFSIZE]int) int {
 
 	child := proc_new(fmt.Sprintf("%s's child", parent.name))
 
+	// the child shares the parent's open files
+	child.fdl.Lock()
+	child.fds = make(map[int]*fd_t, len(parent.fds))
+	for fdn, fd := range parent.fds {
+		if fd.file != cons_file {
+			fd.file.dup()
+		}
+		nfd := *fd
+		child.fds[fdn] = &nfd
+	}
+	child.nextfd = parent.nextfd
+	child.fdl.Unlock()
+
+	parent.maplock.Lock()
+	defer parent.maplock.Unlock()
+	child.maplock.Lock()
+	defer child.maplock.Unlock()
+
 	// mark writable entries as read-only and cow
 	mk_cow := func(pte int) (int, int) {
 
@@ -330,9 +604,11 @@ func sys_fork(parent *proc_t, ptf *[TFSIZE]int) int {
 	return child.pid
 }
 
-func sys_pgfault(proc *proc_t, pte *int, faultaddr int, tf *[TFSIZE]int) {
+// replaces the copy-on-write page that pte maps at va with a writable copy.
+// the caller holds p.maplock.
+func (p *proc_t) cow_break(pte *int, va int) {
 	// copy page
-	dst, p_dst := pg_new(proc.pages)
+	dst, p_dst := pg_new(p.pages)
 	p_src := *pte & PTE_ADDR
 	src := dmap(p_src)
 	for i, c := range src {
@@ -340,10 +616,15 @@ func sys_pgfault(proc *proc_t, pte *int, faultaddr int, tf *[TFSIZE]int) {
 	}
 
 	// insert new page into pmap
-	va := faultaddr & PGMASK
 	perms := (*pte & PTE_FLAGS) & ^PTE_COW
 	perms |= PTE_W
-	proc.page_insert(va, dst, p_dst, perms, false)
+	p.page_insert(va & PGMASK, dst, p_dst, perms, false)
+}
+
+func sys_pgfault(proc *proc_t, pte *int, faultaddr int, tf *[TFSIZE]int) {
+	proc.maplock.Lock()
+	proc.cow_break(pte, faultaddr)
+	proc.maplock.Unlock()
 
 	// set process as runnable again
 	runtime.Procrunnable(proc.pid, nil)
@@ -504,6 +785,7 @@ func sys_test(program string) {
 	var tf [23]int
 
 	proc := proc_new(program + "test")
+	proc.maplock.Lock()
 
 	elf, ok := allbins[program]
 	if !ok {
@@ -528,6 +810,7 @@ func sys_test(program string) {
 	    p_stack, PTE_U | PTE_W, true)
 
 	elf_load(proc, elf)
+	proc.maplock.Unlock()
 
 	proc.sched_add(&tf)
 }
@@ -536,7 +819,7 @@ func sys_execv(path []string, args []string) int {
 	if len(args) != 0 {
 		panic("no imp")
 	}
-	file, err := fs_open(path, O_RDONLY, 0)
+	file, err := vfs_open(path, O_RDONLY, 0)
 	if err != 0 {
 		return err
 	}
@@ -545,17 +828,20 @@ func sys_execv(path []string, args []string) int {
 	ret := 1
 	c := 0
 	for ret != 0 {
-		ret, err = fs_read([][]uint8{add}, file.priv, c)
+		ret, err = file.read([][]uint8{add}, c)
 		c += ret
 		if err != 0 {
+			file.close()
 			return err
 		}
 		valid := add[0:ret]
 		eobj = append(eobj, valid...)
 	}
+	file.close()
 
 	cmd := "/" + strings.Join(path, "/") + strings.Join(args, " ")
 	proc := proc_new(cmd)
+	proc.maplock.Lock()
 
 	elf := &elf_t{eobj}
 
@@ -576,6 +862,7 @@ func sys_execv(path []string, args []string) int {
 	proc.page_insert(stackva - PGSIZE, stack, p_stack, PTE_U | PTE_W, true)
 
 	elf_load(proc, elf)
+	proc.maplock.Unlock()
 	proc.sched_add(&tf)
 
 	return 0
@@ -0,0 +1,440 @@
+package main
+
+import "strconv"
+import "strings"
+import "sync"
+import "unsafe"
+
+// tmpfs keeps files in pages of memory; nothing reaches a disk or the
+// journal and everything is lost on reboot. a tmpfs holds at most a fixed
+// number of data pages, set by the "size=" mount option in bytes with an
+// optional k, m, or g suffix. no file is larger than the file system, even
+// one with holes.
+
+// the default size limit in pages
+const TMPFS_DEFPAGES = 4096
+
+var tmpfs_type	= fstype_t{name: "tmpfs", mount: tmpfs_mount}
+
+type tmpfs_t struct {
+	// protects the whole file system: its names, its nodes, and their
+	// data
+	sync.Mutex
+	root	*tnode_t
+	// the page limit and the number of data pages in use
+	maxpgs	int
+	npgs	int
+	// the physical addresses of the data pages, as required by pg_new
+	pages	map[int]*[512]int
+	nextino	int
+}
+
+// a file or directory of a tmpfs
+type tnode_t struct {
+	ino	int
+	itype	int
+	links	int
+	// the open files of the node
+	opens	int
+	size	int
+	// a file's data pages; nil entries are holes, which read as zeros
+	data	[]*[PGSIZE]uint8
+	pas	[]int
+	// a directory's entries
+	ents	map[string]*tnode_t
+	// a device file's device
+	major	int
+	minor	int
+}
+
+// parses the mount options, a comma-separated list
+func tmpfs_opts(data string) (int, int) {
+	pgs := TMPFS_DEFPAGES
+	for _, o := range strings.Split(data, ",") {
+		if o == "" {
+			continue
+		}
+		if !strings.HasPrefix(o, "size=") {
+			return 0, -EINVAL
+		}
+		v := o[len("size="):]
+		mul := 1
+		if v != "" {
+			switch v[len(v) - 1] {
+			case 'k', 'K':
+				mul = 1 << 10
+			case 'm', 'M':
+				mul = 1 << 20
+			case 'g', 'G':
+				mul = 1 << 30
+			}
+			if mul != 1 {
+				v = v[:len(v) - 1]
+			}
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return 0, -EINVAL
+		}
+		pgs = roundup(n*mul, PGSIZE)/PGSIZE
+	}
+	return pgs, 0
+}
+
+func tmpfs_mount(dev blockdev_t, flags int, data string) (fs_t, int) {
+	pgs, err := tmpfs_opts(data)
+	if err != 0 {
+		return nil, err
+	}
+	t := &tmpfs_t{maxpgs: pgs}
+	t.pages = make(map[int]*[512]int)
+	t.root = t.node(I_DIR)
+	return t, 0
+}
+
+func (t *tmpfs_t) node(itype int) *tnode_t {
+	t.nextino++
+	ret := &tnode_t{ino: t.nextino, itype: itype, links: 1}
+	if itype == I_DIR {
+		ret.ents = make(map[string]*tnode_t)
+	}
+	return ret
+}
+
+// returns the node at path
+func (t *tmpfs_t) walk(path []string) (*tnode_t, int) {
+	n := t.root
+	for _, name := range path {
+		if n.itype != I_DIR {
+			return nil, -ENOTDIR
+		}
+		next, ok := n.ents[name]
+		if !ok {
+			return nil, -ENOENT
+		}
+		n = next
+	}
+	return n, 0
+}
+
+// returns the directory holding the last element of path
+func (t *tmpfs_t) parent(path []string) (*tnode_t, string, int) {
+	l := len(path) - 1
+	dir, err := t.walk(path[:l])
+	if err != 0 {
+		return nil, "", err
+	}
+	if dir.itype != I_DIR {
+		return nil, "", -ENOTDIR
+	}
+	return dir, path[l], 0
+}
+
+// releases the data pages of n from index pg on
+func (t *tmpfs_t) pgfree(n *tnode_t, pg int) {
+	for i := pg; i < len(n.data); i++ {
+		if n.data[i] != nil {
+			delete(t.pages, n.pas[i])
+			t.npgs--
+		}
+	}
+	if pg < len(n.data) {
+		n.data = n.data[:pg]
+		n.pas = n.pas[:pg]
+	}
+}
+
+// drops a link to n
+func (t *tmpfs_t) unref(n *tnode_t) {
+	n.links--
+	if n.links < 0 {
+		panic("ref count is negative")
+	}
+	t.release(n)
+}
+
+// frees the data of n once it has neither links nor open files
+func (t *tmpfs_t) release(n *tnode_t) {
+	if n.links == 0 && n.opens == 0 {
+		t.pgfree(n, 0)
+		n.size = 0
+	}
+}
+
+func (t *tmpfs_t) create(path []string, itype int) (*tnode_t, int) {
+	dir, name, err := t.parent(path)
+	if err != 0 {
+		return nil, err
+	}
+	if _, ok := dir.ents[name]; ok {
+		return nil, -EEXIST
+	}
+	n := t.node(itype)
+	dir.ents[name] = n
+	return n, 0
+}
+
+func (t *tmpfs_t) open(path []string, flags int, mode int) (fops_t, int) {
+	t.Lock()
+	defer t.Unlock()
+	if flags & O_CREAT != 0 && len(path) != 0 {
+		n, err := t.create(path, I_FILE)
+		if err != 0 {
+			return nil, err
+		}
+		n.opens++
+		return &tfile_t{t, n}, 0
+	}
+	n, err := t.walk(path)
+	if err != 0 {
+		return nil, err
+	}
+	if n.itype == I_DEV {
+		df, err := devfile_new(n.major, n.minor, n.ino)
+		if err != 0 {
+			return nil, err
+		}
+		return df, 0
+	}
+	n.opens++
+	return &tfile_t{t, n}, 0
+}
+
+func (t *tmpfs_t) mkdir(path []string, mode int) int {
+	t.Lock()
+	defer t.Unlock()
+	_, err := t.create(path, I_DIR)
+	return err
+}
+
+func (t *tmpfs_t) mknod(path []string, major int, minor int) int {
+	t.Lock()
+	defer t.Unlock()
+	n, err := t.create(path, I_DEV)
+	if err != 0 {
+		return err
+	}
+	n.major = major
+	n.minor = minor
+	return 0
+}
+
+func (t *tmpfs_t) link(oldp []string, newp []string) int {
+	t.Lock()
+	defer t.Unlock()
+	n, err := t.walk(oldp)
+	if err != 0 {
+		return err
+	}
+	// no hard links on directories
+	if n.itype == I_DIR {
+		return -EPERM
+	}
+	dir, name, err := t.parent(newp)
+	if err != 0 {
+		return err
+	}
+	if _, ok := dir.ents[name]; ok {
+		return -EEXIST
+	}
+	dir.ents[name] = n
+	n.links++
+	return 0
+}
+
+func (t *tmpfs_t) unlink(path []string) int {
+	t.Lock()
+	defer t.Unlock()
+	dir, name, err := t.parent(path)
+	if err != 0 {
+		return err
+	}
+	n, ok := dir.ents[name]
+	if !ok {
+		return -ENOENT
+	}
+	if n.itype == I_DIR && len(n.ents) != 0 {
+		return -ENOTEMPTY
+	}
+	delete(dir.ents, name)
+	t.unref(n)
+	return 0
+}
+
+// nothing is ever durable
+func (t *tmpfs_t) sync() int {
+	return 0
+}
+
+func (t *tmpfs_t) unmount() int {
+	t.Lock()
+	defer t.Unlock()
+	t.root = nil
+	t.pages = nil
+	t.npgs = 0
+	return 0
+}
+
+// an open file of a tmpfs
+type tfile_t struct {
+	fs	*tmpfs_t
+	n	*tnode_t
+}
+
+func (f *tfile_t) read(dsts [][]uint8, offset int) (int, int) {
+	f.fs.Lock()
+	defer f.fs.Unlock()
+	n := f.n
+	if n.itype == I_DIR {
+		return 0, -EISDIR
+	}
+	c := 0
+	for _, dst := range dsts {
+		for len(dst) != 0 && offset + c < n.size {
+			off := offset + c
+			pg := off/PGSIZE
+			pgoff := off % PGSIZE
+			left := n.size - off
+			if left > PGSIZE - pgoff {
+				left = PGSIZE - pgoff
+			}
+			if left > len(dst) {
+				left = len(dst)
+			}
+			if pg < len(n.data) && n.data[pg] != nil {
+				copy(dst, n.data[pg][pgoff:pgoff + left])
+			} else {
+				for i := 0; i < left; i++ {
+					dst[i] = 0
+				}
+			}
+			dst = dst[left:]
+			c += left
+		}
+	}
+	return c, 0
+}
+
+// the largest size of a file
+func (t *tmpfs_t) maxsize() int {
+	return t.maxpgs*PGSIZE
+}
+
+// returns the data page holding the byte at off, allocating it if necessary,
+// or -ENOSPC if the file system is full
+func (t *tmpfs_t) pgget(n *tnode_t, off int) (*[PGSIZE]uint8, int) {
+	pg := off/PGSIZE
+	if pg >= len(n.data) || n.data[pg] == nil {
+		if t.npgs >= t.maxpgs {
+			return nil, -ENOSPC
+		}
+		for len(n.data) <= pg {
+			n.data = append(n.data, nil)
+			n.pas = append(n.pas, 0)
+		}
+		p, pa := pg_new(t.pages)
+		n.data[pg] = (*[PGSIZE]uint8)(unsafe.Pointer(p))
+		n.pas[pg] = pa
+		t.npgs++
+	}
+	return n.data[pg], 0
+}
+
+// like a write to the on-disk file system, a write that fails part way
+// returns the number of bytes written along with the error
+func (f *tfile_t) write(srcs [][]uint8, offset int, append bool) (int, int) {
+	f.fs.Lock()
+	defer f.fs.Unlock()
+	n := f.n
+	if n.itype == I_DIR {
+		return 0, -EISDIR
+	}
+	if append {
+		offset = n.size
+	}
+	c := 0
+	var err int
+	for _, src := range srcs {
+		for len(src) != 0 {
+			off := offset + c
+			if off >= f.fs.maxsize() {
+				err = -EFBIG
+				break
+			}
+			var pg *[PGSIZE]uint8
+			pg, err = f.fs.pgget(n, off)
+			if err != 0 {
+				break
+			}
+			wrote := copy(pg[off % PGSIZE:], src)
+			src = src[wrote:]
+			c += wrote
+		}
+		if err != 0 {
+			break
+		}
+	}
+	if offset + c > n.size {
+		n.size = offset + c
+	}
+	return c, err
+}
+
+func (f *tfile_t) fsync() int {
+	return 0
+}
+
+func (f *tfile_t) truncate(newlen int) int {
+	f.fs.Lock()
+	defer f.fs.Unlock()
+	n := f.n
+	if n.itype == I_DIR {
+		return -EISDIR
+	}
+	if newlen > f.fs.maxsize() {
+		return -EFBIG
+	}
+	if newlen < n.size {
+		f.fs.pgfree(n, roundup(newlen, PGSIZE)/PGSIZE)
+		// zero the rest of the last page so that growing the file
+		// again reads zeros
+		if pgoff := newlen % PGSIZE; pgoff != 0 {
+			pg := newlen/PGSIZE
+			if pg < len(n.data) && n.data[pg] != nil {
+				d := n.data[pg]
+				for i := pgoff; i < PGSIZE; i++ {
+					d[i] = 0
+				}
+			}
+		}
+	}
+	// growing leaves a hole
+	n.size = newlen
+	return 0
+}
+
+func (f *tfile_t) stat(st *stat_t) int {
+	f.fs.Lock()
+	defer f.fs.Unlock()
+	n := f.n
+	st.ino = n.ino
+	st.mode = S_IFREG
+	if n.itype == I_DIR {
+		st.mode = S_IFDIR
+	}
+	st.nlink = n.links
+	st.size = n.size
+	return 0
+}
+
+// frees the data of an unlinked file with its last open file
+func (f *tfile_t) close() int {
+	f.fs.Lock()
+	defer f.fs.Unlock()
+	f.n.opens--
+	if f.n.opens < 0 {
+		panic("open count is negative")
+	}
+	f.fs.release(f.n)
+	return 0
+}
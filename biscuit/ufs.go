@@ -0,0 +1,543 @@
+package main
+
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+// ufs lets a user process serve a file system. the server opens /dev/ufs,
+// which makes a new connection whose number is the minor number of the open
+// device (see fstat), and mounts it with the "conn=N" option, optionally
+// with "timeout=S" to change how many seconds a request may wait for its
+// reply; 0 waits forever. the server then reads requests from the device and
+// writes their replies to it. a request is one operation of fs_t or fops_t,
+// the operations that the biscuit file system serves with idaemon requests.
+//
+// a request that times out is withdrawn, and if the server has read it, an
+// interrupt naming it is queued; a late reply to it is refused with ENOENT.
+// once the last open file of the connection is closed, the server is dead and
+// waiting and later requests fail with ENOTCONN. closing a file of the mount
+// queues a release request for its file handle. unmounting queues a destroy
+// request, after which reads return end of file.
+//
+// every message starts with a header of its length, an operation or an
+// error, and the unique number of the request; the rest of the message
+// depends on the operation. numbers are little endian, paths are relative to
+// the mount point without a leading slash, and "" is the root.
+//
+//	request			body			reply body
+//	UFS_OPEN		flags:4 mode:4 path	fh:8
+//	UFS_READ		fh:8 off:8 size:4	data
+//	UFS_WRITE		fh:8 off:8 append:4 data	count:4
+//	UFS_MKDIR		mode:4 path
+//	UFS_MKNOD		major:4 minor:4 path
+//	UFS_LINK		old path, 0, new path
+//	UFS_UNLINK		path
+//	UFS_SYNC
+//	UFS_FSYNC		fh:8
+//	UFS_TRUNC		fh:8 len:8
+//	UFS_STAT		fh:8			mode:4 nlink:4 size:8 ino:8
+//	UFS_INTERRUPT		unique:8		no reply
+//	UFS_DESTROY					no reply
+//	UFS_RELEASE		fh:8			no reply
+
+var ufs_type	= fstype_t{name: "ufs", mount: ufs_mount}
+
+const(
+	UFS_OPEN	= 1
+	UFS_READ	= 2
+	UFS_WRITE	= 3
+	UFS_MKDIR	= 4
+	UFS_MKNOD	= 5
+	UFS_LINK	= 6
+	UFS_UNLINK	= 7
+	UFS_SYNC	= 8
+	UFS_FSYNC	= 9
+	UFS_TRUNC	= 10
+	UFS_STAT	= 11
+	UFS_INTERRUPT	= 12
+	UFS_DESTROY	= 13
+	UFS_RELEASE	= 14
+
+	// the header: length:4 op or error:4 unique:8
+	UFS_HDRSZ	= 16
+	// the most data in a read or write request
+	UFS_MAXIO	= 8192
+	// the largest message; a server's reads must be able to hold it
+	UFS_MAXMSG	= UFS_HDRSZ + 20 + UFS_MAXIO
+	// the default request timeout in seconds
+	UFS_TIMEOUT	= 30
+)
+
+type ufsconn_t struct {
+	sync.Mutex
+	id	int
+	// requests the server hasn't read yet
+	queue	[]*ufsreq_t
+	// requests the server has read, awaiting replies, by unique number
+	sent	map[int]*ufsreq_t
+	nextuniq	int
+	// wakes the server when a request is queued
+	cond	*sync.Cond
+	mounted	bool
+	// unmounted; no more requests are made
+	done	bool
+	// the open files of the connection
+	opens	int
+	// the last open file was closed
+	dead	bool
+	timeout	time.Duration
+}
+
+type ufsreq_t struct {
+	uniq	int
+	msg	[]uint8
+	// gets the reply; nil for requests without one
+	ack	chan *ufsresp_t
+}
+
+type ufsresp_t struct {
+	err	int
+	data	[]uint8
+}
+
+var ufsl	sync.Mutex
+var ufsconns	= map[int]*ufsconn_t{}
+var ufsnextid	= 1
+
+func ufs_conn(id int) (*ufsconn_t, bool) {
+	ufsl.Lock()
+	defer ufsl.Unlock()
+	c, ok := ufsconns[id]
+	return c, ok
+}
+
+// opening minor 0 makes a new connection
+func ufs_open(minor int) (int, int) {
+	ufsl.Lock()
+	defer ufsl.Unlock()
+	if minor != 0 {
+		c, ok := ufsconns[minor]
+		if !ok {
+			return 0, -ENXIO
+		}
+		c.Lock()
+		defer c.Unlock()
+		if c.dead {
+			return 0, -ENXIO
+		}
+		c.opens++
+		return minor, 0
+	}
+	c := &ufsconn_t{id: ufsnextid, nextuniq: 1, opens: 1}
+	c.sent = make(map[int]*ufsreq_t)
+	c.cond = sync.NewCond(c)
+	ufsnextid++
+	ufsconns[c.id] = c
+	return c.id, 0
+}
+
+// the server is dead once the last open file of the connection is closed
+func ufs_close(minor int) {
+	c, ok := ufs_conn(minor)
+	if !ok {
+		panic("close of unknown ufs connection")
+	}
+	c.Lock()
+	c.opens--
+	if c.opens < 0 {
+		panic("ufs connection closed too often")
+	}
+	if c.opens == 0 {
+		c.dead = true
+		c.failall(-ENOTCONN)
+	}
+	c.Unlock()
+	ufs_forget(c)
+}
+
+// forgets c once it is dead and unmounted
+func ufs_forget(c *ufsconn_t) {
+	ufsl.Lock()
+	defer ufsl.Unlock()
+	c.Lock()
+	defer c.Unlock()
+	if c.dead && !c.mounted {
+		delete(ufsconns, c.id)
+	}
+}
+
+// appends the n byte number v to b
+func ufs_put(b []uint8, n int, v int) []uint8 {
+	var t [8]uint8
+	writen(t[:], n, 0, v)
+	return append(b, t[:n]...)
+}
+
+// queues a request with body. the connection must be locked.
+func (c *ufsconn_t) enqueue(op int, body []uint8, reply bool) *ufsreq_t {
+	r := &ufsreq_t{uniq: c.nextuniq}
+	c.nextuniq++
+	r.msg = ufs_put(nil, 4, UFS_HDRSZ + len(body))
+	r.msg = ufs_put(r.msg, 4, op)
+	r.msg = ufs_put(r.msg, 8, r.uniq)
+	r.msg = append(r.msg, body...)
+	if reply {
+		// the server never waits for the requester
+		r.ack = make(chan *ufsresp_t, 1)
+	}
+	c.queue = append(c.queue, r)
+	c.cond.Signal()
+	return r
+}
+
+// fails every request that waits for a reply with err. the connection must
+// be locked.
+func (c *ufsconn_t) failall(err int) {
+	for _, r := range c.queue {
+		if r.ack != nil {
+			r.ack <- &ufsresp_t{err: err}
+		}
+	}
+	for _, r := range c.sent {
+		r.ack <- &ufsresp_t{err: err}
+	}
+	c.queue = nil
+	c.sent = make(map[int]*ufsreq_t)
+	c.cond.Broadcast()
+}
+
+// withdraws r, telling the server if it has read r. the connection must be
+// locked.
+func (c *ufsconn_t) interrupt(r *ufsreq_t) {
+	for i, q := range c.queue {
+		if q == r {
+			c.queue = append(c.queue[:i], c.queue[i + 1:]...)
+			return
+		}
+	}
+	if _, ok := c.sent[r.uniq]; ok {
+		delete(c.sent, r.uniq)
+		c.enqueue(UFS_INTERRUPT, ufs_put(nil, 8, r.uniq), false)
+	}
+}
+
+// makes a request and waits for its reply
+func (c *ufsconn_t) call(op int, body []uint8) ([]uint8, int) {
+	if UFS_HDRSZ + len(body) > UFS_MAXMSG {
+		return nil, -ENAMETOOLONG
+	}
+	c.Lock()
+	if c.dead || c.done {
+		c.Unlock()
+		return nil, -ENOTCONN
+	}
+	r := c.enqueue(op, body, true)
+	c.Unlock()
+
+	// the request fails with ENOTCONN if the server dies meanwhile
+	var deadline <-chan time.Time
+	if c.timeout != 0 {
+		deadline = time.After(c.timeout)
+	}
+	select {
+	case resp := <- r.ack:
+		return resp.data, resp.err
+	case <- deadline:
+		c.Lock()
+		// the reply may have come meanwhile
+		select {
+		case resp := <- r.ack:
+			c.Unlock()
+			return resp.data, resp.err
+		default:
+		}
+		c.interrupt(r)
+		c.Unlock()
+		return nil, -ETIMEDOUT
+	}
+}
+
+// makes a request whose reply has no body
+func (c *ufsconn_t) callst(op int, body []uint8) int {
+	_, err := c.call(op, body)
+	return err
+}
+
+// waits for a request and copies it to dsts. returns end of file after the
+// connection is unmounted and its requests are read.
+func ufs_read(minor int, dsts [][]uint8, offset int) (int, int) {
+	c, ok := ufs_conn(minor)
+	if !ok {
+		return 0, -ENXIO
+	}
+	c.Lock()
+	defer c.Unlock()
+	for len(c.queue) == 0 && !c.done && !c.dead {
+		c.cond.Wait()
+	}
+	if len(c.queue) == 0 {
+		return 0, 0
+	}
+	r := c.queue[0]
+	if len(r.msg) > bufs_len(dsts) {
+		return 0, -EINVAL
+	}
+	c.queue = c.queue[1:]
+	if r.ack != nil {
+		c.sent[r.uniq] = r
+	}
+	return bufs_put(dsts, 0, r.msg), 0
+}
+
+// takes a reply, which must be written whole
+func ufs_write(minor int, srcs [][]uint8, offset int) (int, int) {
+	c, ok := ufs_conn(minor)
+	if !ok {
+		return 0, -ENXIO
+	}
+	n := bufs_len(srcs)
+	if n < UFS_HDRSZ || n > UFS_MAXMSG {
+		return 0, -EINVAL
+	}
+	msg := make([]uint8, n)
+	bufs_get(srcs, 0, msg)
+	if readn(msg, 4, 0) != n {
+		return 0, -EINVAL
+	}
+	err := int(int32(readn(msg, 4, 4)))
+	if err > 0 {
+		return 0, -EINVAL
+	}
+	c.Lock()
+	defer c.Unlock()
+	uniq := readn(msg, 8, 8)
+	r, ok := c.sent[uniq]
+	if !ok {
+		// interrupted or never made
+		return 0, -ENOENT
+	}
+	delete(c.sent, uniq)
+	r.ack <- &ufsresp_t{err: err, data: msg[UFS_HDRSZ:]}
+	return n, 0
+}
+
+func ufs_poll(minor int, events int) int {
+	c, ok := ufs_conn(minor)
+	if !ok {
+		return POLLERR
+	}
+	c.Lock()
+	defer c.Unlock()
+	ret := events & POLLOUT
+	if len(c.queue) != 0 || c.done {
+		ret |= events & POLLIN
+	}
+	return ret
+}
+
+var ufs_dev	= devsw_t{name: "ufs", read: ufs_read, write: ufs_write,
+    ioctl: dev_notty, poll: ufs_poll, open: ufs_open, close: ufs_close}
+
+type ufs_t struct {
+	c	*ufsconn_t
+}
+
+func ufs_mount(dev blockdev_t, flags int, data string) (fs_t, int) {
+	id := -1
+	timeout := UFS_TIMEOUT
+	for _, o := range strings.Split(data, ",") {
+		if o == "" {
+			continue
+		}
+		kv := strings.SplitN(o, "=", 2)
+		if len(kv) != 2 {
+			return nil, -EINVAL
+		}
+		n, err := strconv.Atoi(kv[1])
+		if err != nil || n < 0 {
+			return nil, -EINVAL
+		}
+		switch kv[0] {
+		case "conn":
+			id = n
+		case "timeout":
+			timeout = n
+		default:
+			return nil, -EINVAL
+		}
+	}
+	c, ok := ufs_conn(id)
+	if !ok {
+		return nil, -EINVAL
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.mounted || c.done {
+		return nil, -EBUSY
+	}
+	if c.dead {
+		return nil, -ENOTCONN
+	}
+	c.mounted = true
+	c.timeout = time.Duration(timeout)*time.Second
+	return &ufs_t{c}, 0
+}
+
+func ufs_path(path []string) []uint8 {
+	return []uint8(strings.Join(path, "/"))
+}
+
+func (u *ufs_t) open(path []string, flags int, mode int) (fops_t, int) {
+	body := ufs_put(nil, 4, flags)
+	body = ufs_put(body, 4, mode)
+	body = append(body, ufs_path(path)...)
+	resp, err := u.c.call(UFS_OPEN, body)
+	if err != 0 {
+		return nil, err
+	}
+	if len(resp) != 8 {
+		return nil, -EIO
+	}
+	return &ufile_t{c: u.c, fh: readn(resp, 8, 0)}, 0
+}
+
+func (u *ufs_t) mkdir(path []string, mode int) int {
+	body := ufs_put(nil, 4, mode)
+	return u.c.callst(UFS_MKDIR, append(body, ufs_path(path)...))
+}
+
+func (u *ufs_t) mknod(path []string, major int, minor int) int {
+	body := ufs_put(nil, 4, major)
+	body = ufs_put(body, 4, minor)
+	return u.c.callst(UFS_MKNOD, append(body, ufs_path(path)...))
+}
+
+func (u *ufs_t) link(oldp []string, newp []string) int {
+	body := append(ufs_path(oldp), 0)
+	return u.c.callst(UFS_LINK, append(body, ufs_path(newp)...))
+}
+
+func (u *ufs_t) unlink(path []string) int {
+	return u.c.callst(UFS_UNLINK, ufs_path(path))
+}
+
+func (u *ufs_t) sync() int {
+	return u.c.callst(UFS_SYNC, nil)
+}
+
+func (u *ufs_t) unmount() int {
+	c := u.c
+	c.Lock()
+	c.failall(-ENOTCONN)
+	if !c.dead {
+		c.enqueue(UFS_DESTROY, nil, false)
+	}
+	c.mounted = false
+	c.done = true
+	c.Unlock()
+	ufs_forget(c)
+	return 0
+}
+
+// an open file of a user file system, named by the server's file handle
+type ufile_t struct {
+	c	*ufsconn_t
+	fh	int
+}
+
+func (f *ufile_t) read(dsts [][]uint8, offset int) (int, int) {
+	sz := bufs_len(dsts)
+	c := 0
+	for c < sz {
+		n := sz - c
+		if n > UFS_MAXIO {
+			n = UFS_MAXIO
+		}
+		body := ufs_put(nil, 8, f.fh)
+		body = ufs_put(body, 8, offset + c)
+		body = ufs_put(body, 4, n)
+		resp, err := f.c.call(UFS_READ, body)
+		if err != 0 {
+			return c, err
+		}
+		if len(resp) > n {
+			return c, -EIO
+		}
+		c += bufs_put(dsts, c, resp)
+		// end of file
+		if len(resp) < n {
+			break
+		}
+	}
+	return c, 0
+}
+
+func (f *ufile_t) write(srcs [][]uint8, offset int, append bool) (int, int) {
+	sz := bufs_len(srcs)
+	ap := 0
+	if append {
+		ap = 1
+	}
+	c := 0
+	for c < sz {
+		n := sz - c
+		if n > UFS_MAXIO {
+			n = UFS_MAXIO
+		}
+		body := ufs_put(nil, 8, f.fh)
+		body = ufs_put(body, 8, offset + c)
+		body = ufs_put(body, 4, ap)
+		data := make([]uint8, len(body) + n)
+		copy(data, body)
+		bufs_get(srcs, c, data[len(body):])
+		resp, err := f.c.call(UFS_WRITE, data)
+		if err != 0 {
+			return c, err
+		}
+		if len(resp) != 4 || readn(resp, 4, 0) > n {
+			return c, -EIO
+		}
+		wrote := readn(resp, 4, 0)
+		c += wrote
+		if wrote < n {
+			break
+		}
+	}
+	return c, 0
+}
+
+func (f *ufile_t) fsync() int {
+	return f.c.callst(UFS_FSYNC, ufs_put(nil, 8, f.fh))
+}
+
+func (f *ufile_t) truncate(newlen int) int {
+	body := ufs_put(nil, 8, f.fh)
+	return f.c.callst(UFS_TRUNC, ufs_put(body, 8, newlen))
+}
+
+func (f *ufile_t) stat(st *stat_t) int {
+	resp, err := f.c.call(UFS_STAT, ufs_put(nil, 8, f.fh))
+	if err != 0 {
+		return err
+	}
+	if len(resp) != 24 {
+		return -EIO
+	}
+	st.mode = readn(resp, 4, 0)
+	st.nlink = readn(resp, 4, 4)
+	st.size = readn(resp, 8, 8)
+	st.ino = readn(resp, 8, 16)
+	return 0
+}
+
+// the server isn't waited for
+func (f *ufile_t) close() int {
+	c := f.c
+	c.Lock()
+	defer c.Unlock()
+	if !c.dead && !c.done {
+		c.enqueue(UFS_RELEASE, ufs_put(nil, 8, f.fh), false)
+	}
+	return 0
+}
@@ -0,0 +1,80 @@
+#include <litc.h>
+
+static char buf[512];
+
+int main(int argc, char **argv)
+{
+	int fd, ret;
+	if ((fd = open("/dev/null", O_RDWR, 0)) < 0) {
+		printf_red("open null failed %d\n", fd);
+		return -1;
+	}
+	if ((ret = write(fd, buf, sizeof(buf))) != sizeof(buf)) {
+		printf_red("write to null returned %d\n", ret);
+		return -1;
+	}
+	if ((ret = read(fd, buf, sizeof(buf))) != 0) {
+		printf_red("read of null returned %d\n", ret);
+		return -1;
+	}
+	struct stat st;
+	if ((ret = fstat(fd, &st)) < 0) {
+		printf_red("fstat failed %d\n", ret);
+		return -1;
+	}
+	if ((st.st_mode & S_IFMT) != S_IFCHR || major(st.st_rdev) != 1 ||
+	    minor(st.st_rdev) != 3) {
+		printf_red("bad stat of null\n");
+		return -1;
+	}
+
+	if ((fd = open("/dev/zero", O_RDONLY, 0)) < 0) {
+		printf_red("open zero failed %d\n", fd);
+		return -1;
+	}
+	buf[10] = 1;
+	if ((ret = read(fd, buf, sizeof(buf))) != sizeof(buf) || buf[10]) {
+		printf_red("read of zero returned %d\n", ret);
+		return -1;
+	}
+
+	if ((fd = open("/dev/full", O_WRONLY, 0)) < 0) {
+		printf_red("open full failed %d\n", fd);
+		return -1;
+	}
+	if ((ret = write(fd, buf, 1)) != -28) {
+		printf_red("write to full returned %d\n", ret);
+		return -1;
+	}
+	if ((ret = ioctl(fd, DIOC_NSECT, 0)) != -25) {
+		printf_red("ioctl of full returned %d\n", ret);
+		return -1;
+	}
+
+	// a device file on the root file system
+	unlink("/mynull");
+	if ((ret = mknod("/mynull", S_IFCHR, makedev(1, 3))) < 0) {
+		printf_red("mknod failed %d\n", ret);
+		return -1;
+	}
+	if ((fd = open("/mynull", O_WRONLY, 0)) < 0) {
+		printf_red("open of mknod'ed null failed %d\n", fd);
+		return -1;
+	}
+	if ((ret = write(fd, buf, 1)) != 1) {
+		printf_red("write to mknod'ed null returned %d\n", ret);
+		return -1;
+	}
+	if ((ret = unlink("/mynull")) < 0) {
+		printf_red("unlink failed %d\n", ret);
+		return -1;
+	}
+
+	struct pollfd pfd = {.fd = 1, .events = POLLOUT};
+	if ((ret = poll(&pfd, 1, 0)) != 1 || pfd.revents != POLLOUT) {
+		printf_red("poll of stdout returned %d\n", ret);
+		return -1;
+	}
+	printf("fsdev done\n");
+	return 0;
+}
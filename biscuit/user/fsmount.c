@@ -0,0 +1,28 @@
+#include <litc.h>
+
+int main(int argc, char **argv)
+{
+	int ret;
+	if ((ret = umount2("/", 0)) != -16) {
+		printf_red("unmounted root? %d\n", ret);
+		return -1;
+	}
+	if ((ret = umount2("/bin", 0)) != -22) {
+		printf_red("unmounted a non-mount point? %d\n", ret);
+		return -1;
+	}
+	if ((ret = mount("none", "/bin", "nofs", 0, NULL)) != -19) {
+		printf_red("mounted an unknown type? %d\n", ret);
+		return -1;
+	}
+	if ((ret = mount("nodisk", "/bin", "biscuit", 0, NULL)) != -2) {
+		printf_red("mounted a missing disk? %d\n", ret);
+		return -1;
+	}
+	if ((ret = open("/bin/../bin/./fsmount", O_RDONLY, 0)) < 0) {
+		printf_red("dot paths failed %d\n", ret);
+		return -1;
+	}
+	printf("fsmount done\n");
+	return 0;
+}
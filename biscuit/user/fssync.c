@@ -0,0 +1,37 @@
+#include <litc.h>
+
+static char buf[5120];
+
+int main(int argc, char **argv)
+{
+	int fd;
+	if ((fd = open("/synced", O_RDWR | O_CREAT, 0)) < 0) {
+		printf_red("open failed\n");
+		return -1;
+	}
+
+	int i;
+	for (i = 0; i < sizeof(buf); i++)
+		buf[i] = 0x41 + (i / 1000);
+
+	int ret;
+	if ((ret = write(fd, buf, sizeof(buf))) != sizeof(buf)) {
+		printf_red("write failed %d\n", ret);
+		return -1;
+	}
+	if ((ret = fsync(fd)) < 0) {
+		printf_red("fsync failed %d\n", ret);
+		return -1;
+	}
+	if ((ret = fdatasync(fd)) < 0) {
+		printf_red("fdatasync failed %d\n", ret);
+		return -1;
+	}
+	if ((ret = fsync(1)) >= 0) {
+		printf_red("fsync of console should fail\n");
+		return -1;
+	}
+	sync();
+	printf("fssync done\n");
+	return 0;
+}
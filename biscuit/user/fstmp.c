@@ -0,0 +1,114 @@
+#include <litc.h>
+
+static char buf[4096];
+
+int main(int argc, char **argv)
+{
+	int ret;
+	if ((ret = mkdir("/tmp", 0)) < 0 && ret != -17) {
+		printf_red("mkdir failed %d\n", ret);
+		return -1;
+	}
+	if ((ret = mount("tmpfs", "/tmp", "tmpfs", 0, "size=8k")) < 0) {
+		printf_red("mount failed %d\n", ret);
+		return -1;
+	}
+
+	int fd;
+	if ((fd = open("/tmp/a", O_RDWR | O_CREAT, 0)) < 0) {
+		printf_red("create failed %d\n", fd);
+		return -1;
+	}
+	int i;
+	for (i = 0; i < sizeof(buf); i++)
+		buf[i] = 'a' + (i % 26);
+	for (i = 0; i < 2; i++) {
+		if ((ret = write(fd, buf, sizeof(buf))) != sizeof(buf)) {
+			printf_red("write failed %d\n", ret);
+			return -1;
+		}
+	}
+	// the file system holds two pages
+	if ((ret = write(fd, buf, 1)) != -28) {
+		printf_red("write to full tmpfs returned %d\n", ret);
+		return -1;
+	}
+
+	struct stat st;
+	if ((ret = fstat(fd, &st)) < 0) {
+		printf_red("fstat failed %d\n", ret);
+		return -1;
+	}
+	if (st.st_size != 2*sizeof(buf) || !(st.st_mode & S_IFREG) ||
+	    st.st_nlink != 1) {
+		printf_red("bad stat: size %ld, mode %lx, nlink %ld\n",
+		    st.st_size, st.st_mode, st.st_nlink);
+		return -1;
+	}
+	if ((ret = ftruncate(fd, 10)) < 0) {
+		printf_red("ftruncate failed %d\n", ret);
+		return -1;
+	}
+	if ((ret = ftruncate(fd, 100)) < 0) {
+		printf_red("ftruncate failed %d\n", ret);
+		return -1;
+	}
+
+	int fd2;
+	if ((ret = link("/tmp/a", "/tmp/b")) < 0) {
+		printf_red("link failed %d\n", ret);
+		return -1;
+	}
+	if ((ret = link("/tmp/a", "/hi2.txt")) != -18) {
+		printf_red("link across mounts returned %d\n", ret);
+		return -1;
+	}
+	if ((ret = unlink("/tmp/a")) < 0) {
+		printf_red("unlink failed %d\n", ret);
+		return -1;
+	}
+	if ((fd2 = open("/tmp/b", O_RDONLY, 0)) < 0) {
+		printf_red("open failed %d\n", fd2);
+		return -1;
+	}
+	if ((ret = read(fd2, buf, sizeof(buf))) != 100) {
+		printf_red("read returned %d\n", ret);
+		return -1;
+	}
+	for (i = 0; i < 100; i++) {
+		char want = i < 10 ? 'a' + i : 0;
+		if (buf[i] != want) {
+			printf_red("byte %d is %d\n", i, buf[i]);
+			return -1;
+		}
+	}
+
+	if ((ret = mkdir("/tmp/d", 0)) < 0) {
+		printf_red("mkdir failed %d\n", ret);
+		return -1;
+	}
+	if ((fd = open("/tmp/d/f", O_RDWR | O_CREAT, 0)) < 0) {
+		printf_red("create in dir failed %d\n", fd);
+		return -1;
+	}
+	if ((ret = unlink("/tmp/d")) != -39) {
+		printf_red("unlink of full dir returned %d\n", ret);
+		return -1;
+	}
+
+	// files are still open
+	if ((ret = umount2("/tmp", 0)) != -16) {
+		printf_red("umount2 returned %d\n", ret);
+		return -1;
+	}
+	if ((ret = umount2("/tmp", MNT_FORCE)) < 0) {
+		printf_red("forced umount2 failed %d\n", ret);
+		return -1;
+	}
+	if ((ret = read(fd2, buf, sizeof(buf))) != -5) {
+		printf_red("read after umount2 returned %d\n", ret);
+		return -1;
+	}
+	printf("fstmp done\n");
+	return 0;
+}
@@ -0,0 +1,187 @@
+#include <litc.h>
+
+static char msg[UFS_MAXMSG + 1];
+static char rep[UFS_MAXMSG];
+static char buf[64];
+
+static char hello[] = "hello from user space\n";
+
+static int
+streq(char *a, char *b)
+{
+	while (*a && *a == *b)
+		a++, b++;
+	return *a == *b;
+}
+
+static long
+reply(int fd, ulong uniq, int err, char *body, int len)
+{
+	int i;
+	*(uint *)rep = UFS_HDRSZ + len;
+	*(int *)(rep + 4) = err;
+	*(ulong *)(rep + 8) = uniq;
+	for (i = 0; i < len; i++)
+		rep[UFS_HDRSZ + i] = body[i];
+	return write(fd, rep, UFS_HDRSZ + len);
+}
+
+// serves a file system with a root directory holding the file "hello". opens
+// of "slow" are never answered.
+static void
+server(int fd)
+{
+	ulong slow = 0;
+	long n;
+	while ((n = read(fd, msg, UFS_MAXMSG)) > 0) {
+		int op = *(int *)(msg + 4);
+		ulong uniq = *(ulong *)(msg + 8);
+		char *body = msg + UFS_HDRSZ;
+		msg[n] = '\0';
+		char out[24];
+		long ret;
+		switch (op) {
+		case UFS_OPEN: {
+			int flags = *(int *)body;
+			char *path = body + 8;
+			ulong fh;
+			if (streq(path, "slow")) {
+				slow = uniq;
+				continue;
+			}
+			if (flags & (O_WRONLY | O_RDWR | O_CREAT)) {
+				ret = reply(fd, uniq, -30, 0, 0);
+				break;
+			}
+			if (streq(path, ""))
+				fh = 0;
+			else if (streq(path, "hello"))
+				fh = 1;
+			else {
+				ret = reply(fd, uniq, -2, 0, 0);
+				break;
+			}
+			*(ulong *)out = fh;
+			ret = reply(fd, uniq, 0, out, 8);
+			break;
+		}
+		case UFS_READ: {
+			ulong fh = *(ulong *)body;
+			ulong off = *(ulong *)(body + 8);
+			uint sz = *(uint *)(body + 16);
+			char *d = fh == 1 ? hello : "hello\n";
+			size_t len = strlen(d);
+			if (off > len)
+				off = len;
+			if (sz > len - off)
+				sz = len - off;
+			ret = reply(fd, uniq, 0, d + off, sz);
+			break;
+		}
+		case UFS_STAT: {
+			ulong fh = *(ulong *)body;
+			*(uint *)out = fh == 1 ? S_IFREG : S_IFDIR;
+			*(uint *)(out + 4) = 1;
+			*(ulong *)(out + 8) = fh == 1 ? strlen(hello) : 6;
+			*(ulong *)(out + 16) = fh + 1;
+			ret = reply(fd, uniq, 0, out, 24);
+			break;
+		}
+		case UFS_INTERRUPT:
+			if (*(ulong *)body != slow) {
+				printf_red("interrupt of wrong request\n");
+				exit(-1);
+			}
+			// the request is gone
+			if ((ret = reply(fd, slow, 0, out, 8)) != -2) {
+				printf_red("late reply returned %ld\n", ret);
+				exit(-1);
+			}
+			continue;
+		case UFS_DESTROY:
+		case UFS_RELEASE:
+			continue;
+		default:
+			ret = reply(fd, uniq, -30, 0, 0);
+			break;
+		}
+		if (ret < 0) {
+			printf_red("reply failed %ld\n", ret);
+			exit(-1);
+		}
+	}
+	if (n < 0) {
+		printf_red("server read failed %ld\n", n);
+		exit(-1);
+	}
+	exit(0);
+}
+
+int main(int argc, char **argv)
+{
+	int fd, ret;
+	if ((fd = open("/dev/ufs", O_RDWR, 0)) < 0) {
+		printf_red("open of /dev/ufs failed %d\n", fd);
+		return -1;
+	}
+	struct stat st;
+	if ((ret = fstat(fd, &st)) < 0) {
+		printf_red("fstat failed %d\n", ret);
+		return -1;
+	}
+	if ((ret = mkdir("/ufs", 0)) < 0 && ret != -17) {
+		printf_red("mkdir failed %d\n", ret);
+		return -1;
+	}
+	if (!fork())
+		server(fd);
+
+	char opts[32];
+	snprintf(opts, sizeof(opts), "conn=%d,timeout=1", minor(st.st_rdev));
+	if ((ret = mount("ufs", "/ufs", "ufs", 0, opts)) < 0) {
+		printf_red("mount failed %d\n", ret);
+		return -1;
+	}
+	int f;
+	if ((f = open("/ufs/hello", O_RDONLY, 0)) < 0) {
+		printf_red("open failed %d\n", f);
+		return -1;
+	}
+	long n;
+	if ((n = read(f, buf, sizeof(buf))) != strlen(hello) ||
+	    !streq(buf, hello)) {
+		printf_red("read returned %ld\n", n);
+		return -1;
+	}
+	if ((ret = fstat(f, &st)) < 0 || st.st_size != strlen(hello)) {
+		printf_red("fstat returned %d\n", ret);
+		return -1;
+	}
+	if ((ret = open("/ufs/hello", O_WRONLY, 0)) != -30) {
+		printf_red("open for writing returned %d\n", ret);
+		return -1;
+	}
+	if ((ret = open("/ufs/nope", O_RDONLY, 0)) != -2) {
+		printf_red("open of missing file returned %d\n", ret);
+		return -1;
+	}
+	if ((ret = mkdir("/ufs/d", 0)) != -30) {
+		printf_red("mkdir returned %d\n", ret);
+		return -1;
+	}
+	// the server never answers
+	if ((ret = open("/ufs/slow", O_RDONLY, 0)) != -110) {
+		printf_red("open of slow file returned %d\n", ret);
+		return -1;
+	}
+	if ((ret = umount2("/ufs", MNT_FORCE)) < 0) {
+		printf_red("umount failed %d\n", ret);
+		return -1;
+	}
+	if ((ret = open("/ufs/hello", O_RDONLY, 0)) != -2) {
+		printf_red("open after umount returned %d\n", ret);
+		return -1;
+	}
+	printf("fsufs done\n");
+	return 0;
+}
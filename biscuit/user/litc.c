@@ -4,12 +4,24 @@
 #define SYS_READ         0
 #define SYS_WRITE        1
 #define SYS_OPEN         2
+#define SYS_CLOSE        3
+#define SYS_FSTAT        5
+#define SYS_POLL         7
+#define SYS_IOCTL        16
 #define SYS_GETPID       39
 #define SYS_FORK         57
 #define SYS_EXIT         60
+#define SYS_FSYNC        74
+#define SYS_FDATASYNC    75
+#define SYS_FTRUNCATE    77
 #define SYS_MKDIR        83
 #define SYS_LINK         86
 #define SYS_UNLINK       87
+#define SYS_MKNOD        133
+#define SYS_SYNC         162
+#define SYS_MOUNT        165
+#define SYS_UMOUNT2      166
+#define SYS_PCILIST      500
 
 static void pmsg(char *);
 
@@ -31,18 +43,48 @@ syscall(long a1, long a2, long a3, long a4,
 
 #define SA(x)     ((long)x)
 
+int
+close(int fd)
+{
+	return syscall(fd, 0, 0, 0, 0, SYS_CLOSE);
+}
+
 void
 exit(int status)
 {
 	syscall(status, 0, 0, 0, 0, SYS_EXIT);
 }
 
+int
+fdatasync(int fd)
+{
+	return syscall(fd, 0, 0, 0, 0, SYS_FDATASYNC);
+}
+
 int
 fork(void)
 {
 	return syscall(0, 0, 0, 0, 0, SYS_FORK);
 }
 
+int
+fstat(int fd, struct stat *st)
+{
+	return syscall(fd, SA(st), 0, 0, 0, SYS_FSTAT);
+}
+
+int
+fsync(int fd)
+{
+	return syscall(fd, 0, 0, 0, 0, SYS_FSYNC);
+}
+
+int
+ftruncate(int fd, long len)
+{
+	return syscall(fd, len, 0, 0, 0, SYS_FTRUNCATE);
+}
+
 int
 getpid(void)
 {
@@ -55,18 +97,49 @@ link(const char *old, const char *new)
 	return syscall(SA(old), SA(new), 0, 0, 0, SYS_LINK);
 }
 
+int
+ioctl(int fd, long cmd, long arg)
+{
+	return syscall(fd, cmd, arg, 0, 0, SYS_IOCTL);
+}
+
 int
 mkdir(const char *p, long mode)
 {
 	return syscall(SA(p), mode, 0, 0, 0, SYS_MKDIR);
 }
 
+int
+mknod(const char *p, long mode, long dev)
+{
+	return syscall(SA(p), mode, dev, 0, 0, SYS_MKNOD);
+}
+
+int
+mount(const char *src, const char *tgt, const char *type, long flags,
+    const void *data)
+{
+	return syscall(SA(src), SA(tgt), SA(type), flags, SA(data), SYS_MOUNT);
+}
+
 int
 open(const char *path, int flags, int mode)
 {
 	return syscall(SA(path), flags, mode, 0, 0, SYS_OPEN);
 }
 
+int
+poll(struct pollfd *fds, int n, int timeout)
+{
+	return syscall(SA(fds), n, timeout, 0, 0, SYS_POLL);
+}
+
+int
+pcilist(struct pcidev *devs, int n)
+{
+	return syscall(SA(devs), n, 0, 0, 0, SYS_PCILIST);
+}
+
 long
 write(int fd, void *buf, size_t c)
 {
@@ -79,6 +152,18 @@ read(int fd, void *buf, size_t c)
 	return syscall(SA(fd), SA(buf), SA(c), 0, 0, SYS_READ);
 }
 
+void
+sync(void)
+{
+	syscall(0, 0, 0, 0, 0, SYS_SYNC);
+}
+
+int
+umount2(const char *tgt, int flags)
+{
+	return syscall(SA(tgt), flags, 0, 0, 0, SYS_UMOUNT2);
+}
+
 int
 unlink(const char *path)
 {
@@ -7,17 +7,95 @@
 
 #define MAXBUF        4096
 
+int close(int);
 void exit(int);
+int fdatasync(int);
 int fork(void);
+struct stat {
+	ulong st_dev;
+	ulong st_ino;
+	ulong st_mode;
+	ulong st_nlink;
+	ulong st_size;
+	// the device number of device files
+	ulong st_rdev;
+};
+#define    S_IFMT       0xf000
+#define    S_IFCHR      0x2000
+#define    S_IFDIR      0x4000
+#define    S_IFREG      0x8000
+#define    makedev(ma, mi)    ((ma) << 16 | (mi))
+#define    major(dev)         ((dev) >> 16)
+#define    minor(dev)         ((dev) & 0xffff)
+int fstat(int, struct stat *);
+int fsync(int);
+int ftruncate(int, long);
 int getpid(void);
 int link(const char *, const char *);
+int ioctl(int, long, long);
+// ioctls of raw disks
+#define    DIOC_NSECT        1
+#define    DIOC_SECTSZ       2
 int mkdir(const char *, long);
+int mknod(const char *, long, long);
+int mount(const char *, const char *, const char *, long, const void *);
+#define    MS_RDONLY         1
+// the user file system protocol; see ufs.go
+#define    UFS_OPEN          1
+#define    UFS_READ          2
+#define    UFS_WRITE         3
+#define    UFS_MKDIR         4
+#define    UFS_MKNOD         5
+#define    UFS_LINK          6
+#define    UFS_UNLINK        7
+#define    UFS_SYNC          8
+#define    UFS_FSYNC         9
+#define    UFS_TRUNC        10
+#define    UFS_STAT         11
+#define    UFS_INTERRUPT    12
+#define    UFS_DESTROY      13
+#define    UFS_RELEASE      14
+#define    UFS_HDRSZ        16
+#define    UFS_MAXMSG       (UFS_HDRSZ + 20 + 8192)
 int open(const char *, int, int);
 #define    O_RDONLY          0
 #define    O_WRONLY          1
 #define    O_RDWR            2
 #define    O_CREAT        0x80
+#define    O_TRUNC       0x200
+#define    O_APPEND      0x400
+struct pcidev {
+	unsigned char bus, dev, fn;
+	// 0xff if the function has no interrupt line
+	unsigned char irq;
+	ushort vendor, device;
+	unsigned char class, subclass, progif, rev;
+	unsigned char ncaps;
+	unsigned char _pad[3];
+	struct {
+		// bit 0 is set for I/O space
+		ulong addr;
+		ulong size;
+	} bars[6];
+	// the IDs of the first 16 capabilities
+	unsigned char caps[16];
+	char driver[16];
+};
+int pcilist(struct pcidev *, int);
+struct pollfd {
+	int fd;
+	short events;
+	short revents;
+};
+#define    POLLIN          0x1
+#define    POLLOUT         0x4
+#define    POLLERR         0x8
+#define    POLLNVAL       0x20
+int poll(struct pollfd *, int, int);
 long read(int, void*, size_t);
+void sync(void);
+int umount2(const char *, int);
+#define    MNT_FORCE         1
 int unlink(const char *);
 long write(int, void*, size_t);
 
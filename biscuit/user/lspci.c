@@ -0,0 +1,99 @@
+#include <litc.h>
+
+#define NDEVS 64
+
+static struct pcidev devs[NDEVS];
+
+static const struct {
+	int class;
+	char *name;
+} classes[] = {
+	{0x0100, "SCSI storage controller"},
+	{0x0101, "IDE interface"},
+	{0x0106, "SATA controller"},
+	{0x0108, "Non-Volatile memory controller"},
+	{0x0180, "Mass storage controller"},
+	{0x0200, "Ethernet controller"},
+	{0x0300, "VGA compatible controller"},
+	{0x0600, "Host bridge"},
+	{0x0601, "ISA bridge"},
+	{0x0604, "PCI bridge"},
+	{0x0680, "Bridge"},
+	{0x0c03, "USB controller"},
+	{0x0c05, "SMBus"},
+};
+
+static char *
+classname(int class)
+{
+	int i;
+	for (i = 0; i < sizeof(classes)/sizeof(classes[0]); i++)
+		if (classes[i].class == class)
+			return classes[i].name;
+	return "Unknown class";
+}
+
+// formats n in hex with at least w digits
+static char *
+hex(char *buf, ulong n, int w)
+{
+	char tmp[17];
+	int i = 0;
+	do {
+		int d = n & 0xf;
+		tmp[i++] = d < 10 ? '0' + d : 'a' + d - 10;
+		n >>= 4;
+	} while (n);
+	while (i < w)
+		tmp[i++] = '0';
+	int j;
+	for (j = 0; j < i; j++)
+		buf[j] = tmp[i - 1 - j];
+	buf[j] = '\0';
+	return buf;
+}
+
+int
+main(int argc, char **argv)
+{
+	int n = pcilist(devs, NDEVS);
+	if (n < 0)
+		errx(-1, "pcilist failed %d", n);
+	if (n > NDEVS)
+		n = NDEVS;
+
+	int i;
+	for (i = 0; i < n; i++) {
+		struct pcidev *d = &devs[i];
+		char b[4][17];
+		printf("%s:%s.%s ", hex(b[0], d->bus, 2), hex(b[1], d->dev, 2),
+		    hex(b[2], d->fn, 1));
+		printf("%s: ", classname(d->class << 8 | d->subclass));
+		printf("%s:%s (rev %s)\n", hex(b[0], d->vendor, 4),
+		    hex(b[1], d->device, 4), hex(b[2], d->rev, 2));
+		if (d->irq != 0xff)
+			printf("\tIRQ %d\n", d->irq);
+		int j;
+		for (j = 0; j < 6; j++) {
+			if (d->bars[j].size == 0)
+				continue;
+			int io = d->bars[j].addr & 1;
+			printf("\tRegion %d: %s at %s [size=%s]\n", j,
+			    io ? "I/O ports" : "Memory",
+			    hex(b[0], d->bars[j].addr & ~1UL, 1),
+			    hex(b[1], d->bars[j].size, 1));
+		}
+		int nc = d->ncaps;
+		if (nc > 16)
+			nc = 16;
+		if (nc) {
+			printf("\tCapabilities:");
+			for (j = 0; j < nc; j++)
+				printf(" %s", hex(b[0], d->caps[j], 2));
+			printf("\n");
+		}
+		if (d->driver[0])
+			printf("\tKernel driver in use: %s\n", d->driver);
+	}
+	return 0;
+}
@@ -0,0 +1,87 @@
+#include <litc.h>
+
+static char list[4096];
+static char buf[1024];
+
+// reads the whole file at path into b, returning its length or an error
+static long
+readall(char *path, char *b, size_t sz)
+{
+	int fd;
+	if ((fd = open(path, O_RDONLY, 0)) < 0)
+		return fd;
+	long c = 0;
+	long ret = 0;
+	while (c < sz - 1 && (ret = read(fd, b + c, sz - 1 - c)) > 0)
+		c += ret;
+	if (ret < 0)
+		return ret;
+	b[c] = '\0';
+	return c;
+}
+
+// copies the value of the status field name, which ends at a newline, to out
+static char *
+field(char *status, char *name, char *out, size_t sz)
+{
+	size_t n = strlen(name);
+	char *p = status;
+	out[0] = '\0';
+	while (*p) {
+		int i;
+		for (i = 0; i < n && p[i] == name[i]; i++)
+			;
+		if (i == n && p[n] == ':') {
+			p += n + 1;
+			while (*p == '\t')
+				p++;
+			for (i = 0; i < sz - 1 && p[i] && p[i] != '\n'; i++)
+				out[i] = p[i];
+			out[i] = '\0';
+			return out;
+		}
+		while (*p && *p != '\n')
+			p++;
+		if (*p)
+			p++;
+	}
+	return out;
+}
+
+int main(int argc, char **argv)
+{
+	long ret;
+	if ((ret = readall("/proc", list, sizeof(list))) < 0) {
+		printf_red("cannot read /proc: %ld\n", ret);
+		return -1;
+	}
+	printf("PID\tSTATE\tPAGES\tCMD\n");
+	char *p = list;
+	while (*p) {
+		char *e = p;
+		while (*e && *e != '\n')
+			e++;
+		int ispid = e != p;
+		char *q;
+		for (q = p; q < e; q++)
+			if (*q < '0' || *q > '9')
+				ispid = 0;
+		char save = *e;
+		*e = '\0';
+		if (ispid) {
+			char path[64];
+			snprintf(path, sizeof(path), "/proc/%s/status", p);
+			// the process may have exited since /proc was read
+			if (readall(path, buf, sizeof(buf)) >= 0) {
+				char name[64], st[16], pgs[16];
+				field(buf, "Name", name, sizeof(name));
+				field(buf, "State", st, sizeof(st));
+				field(buf, "UserPages", pgs, sizeof(pgs));
+				printf("%s\t%s\t%s\t%s\n", p, st, pgs, name);
+			}
+		}
+		*e = save;
+		p = *e ? e + 1 : e;
+	}
+	return 0;
+}
@@ -0,0 +1,717 @@
+// bfsck checks a Biscuit file system image, such as go.img, for corruption
+// and optionally repairs it. it is built for the host:
+//
+//	go build -o bfsck util/bfsck.go
+//	./bfsck [-r] go.img
+//
+// a committed transaction in the log is replayed first, like the kernel does
+// at boot. then every inode reachable from the root directory is checked: the
+// checksums of the superblock, inode blocks, and directory blocks; inode
+// types, sizes, and block addresses; directory entries; link counts; blocks
+// claimed twice; the free inode list; and the free block bitmap.
+//
+// without -r, nothing is written; the log replay and the repairs are kept in
+// memory so that the checks see the repaired image. with -r, they are
+// written to the image. link counts, the free inode list, the free bitmap,
+// directory entries naming bad inodes, and unreachable inodes are repaired;
+// blocks claimed twice are only reported.
+//
+// the exit status is 0 if the file system is clean, 1 if errors were
+// repaired, 4 if errors remain, and 8 if the image could not be checked.
+package main
+
+import "flag"
+import "fmt"
+import "hash/crc32"
+import "os"
+import "sort"
+
+// the on-disk format; see fs/fs.go
+const(
+	BSIZE		= 512
+	// the offset in block 0 of the block number of the superblock
+	FSOFF		= 506
+	CKSUMOFF	= BSIZE - 4
+
+	I_INVALID	= 0
+	I_FILE		= 1
+	I_DIR		= 2
+	I_DEV		= 3
+
+	NIADDRS		= 9
+	NIWORDS		= 6 + NIADDRS
+	ISPERBLK	= 4
+
+	DNAMELEN	= 14
+	NDBYTES		= 22
+	NDIRENTS	= CKSUMOFF/NDBYTES
+
+	// indirect blocks hold 63 block addresses followed by the address of
+	// the next indirect block
+	INDSLOTS	= 63
+
+	LOG_MAGIC	= 0x6269736375697421
+	LOGDPB		= BSIZE/8 - 1
+)
+
+var crc32c_tab = crc32.MakeTable(crc32.Castagnoli)
+
+type blk_t [BSIZE]uint8
+
+func readn(a []uint8, n int, off int) int {
+	ret := 0
+	for i := 0; i < n; i++ {
+		ret |= int(a[off + i]) << (uint(i)*8)
+	}
+	return ret
+}
+
+func writen(a []uint8, n int, off int, val int) {
+	for i := 0; i < n; i++ {
+		a[off + i] = uint8(val >> (uint(i)*8))
+	}
+}
+
+func fieldr(b *blk_t, f int) int {
+	return readn(b[:], 8, f*8)
+}
+
+func fieldw(b *blk_t, f int, v int) {
+	writen(b[:], 8, f*8, v)
+}
+
+func cksum_ok(b *blk_t) bool {
+	want := crc32.Checksum(b[:CKSUMOFF], crc32c_tab)
+	return uint32(readn(b[:], 4, CKSUMOFF)) == want
+}
+
+func cksum_set(b *blk_t) {
+	writen(b[:], 4, CKSUMOFF, int(crc32.Checksum(b[:CKSUMOFF],
+	    crc32c_tab)))
+}
+
+// an inode number holds the inode's block and its index in the block
+type inum int
+
+func biencode(blk int, iidx int) inum {
+	return inum(blk << 2 | iidx)
+}
+
+func (i inum) blk() int {
+	return int(i) >> 2
+}
+
+func (i inum) idx() int {
+	return int(i) & 3
+}
+
+// the image. changed blocks are kept in memory until flush writes them.
+// blocks past the end of the image read as zeros, since mkbdisk.py does not
+// write the unused blocks at the end of RAM disk images.
+type disk_t struct {
+	f	*os.File
+	nblks	int
+	dirty	map[int]*blk_t
+}
+
+func (d *disk_t) read(bn int) *blk_t {
+	if b, ok := d.dirty[bn]; ok {
+		ret := *b
+		return &ret
+	}
+	ret := &blk_t{}
+	if bn < 0 {
+		fatal("read of block %v", bn)
+	}
+	if bn >= d.nblks {
+		return ret
+	}
+	if _, err := d.f.ReadAt(ret[:], int64(bn)*BSIZE); err != nil {
+		fatal("read of block %v: %v", bn, err)
+	}
+	return ret
+}
+
+// meta blocks get a new checksum
+func (d *disk_t) write(bn int, b *blk_t, meta bool) {
+	c := *b
+	if meta {
+		cksum_set(&c)
+	}
+	d.dirty[bn] = &c
+}
+
+func (d *disk_t) flush() {
+	bns := make([]int, 0, len(d.dirty))
+	for bn := range d.dirty {
+		bns = append(bns, bn)
+	}
+	sort.Ints(bns)
+	for _, bn := range bns {
+		_, err := d.f.WriteAt(d.dirty[bn][:], int64(bn)*BSIZE)
+		if err != nil {
+			fatal("write of block %v: %v", bn, err)
+		}
+	}
+	if err := d.f.Sync(); err != nil {
+		fatal("sync: %v", err)
+	}
+}
+
+func fatal(f string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "bfsck: " + f + "\n", args...)
+	os.Exit(8)
+}
+
+type fsck_t struct {
+	d	*disk_t
+	repair	bool
+	// problems found, and those repaired
+	nerr	int
+	nfixed	int
+
+	sbn	int
+	sb	*blk_t
+	fstart	int
+	flen	int
+	logstart	int
+	loglen	int
+	ustart	int
+	last	int
+
+	// the owner of each block in use
+	owner	map[int]string
+	// inode blocks and the inodes found in them
+	iblks	map[int]bool
+	// directory entries naming each inode
+	refs	map[inum]int
+	// the path of each reachable inode
+	paths	map[inum]string
+	free	map[inum]bool
+}
+
+func (fs *fsck_t) problem(fixed bool, f string, args ...interface{}) {
+	fs.nerr++
+	msg := fmt.Sprintf(f, args...)
+	switch {
+	case fixed && fs.repair:
+		fs.nfixed++
+		msg += "; repaired"
+	case fixed:
+		msg += "; repairable"
+	default:
+		msg += "; not repaired"
+	}
+	fmt.Println(msg)
+}
+
+// reads the superblock and checks that its regions fit in the image
+func (fs *fsck_t) superblock() {
+	b0 := fs.d.read(0)
+	fs.sbn = readn(b0[:], 4, FSOFF)
+	if fs.sbn <= 0 || fs.sbn >= fs.d.nblks {
+		fatal("bad superblock block number %v", fs.sbn)
+	}
+	fs.sb = fs.d.read(fs.sbn)
+	if !cksum_ok(fs.sb) {
+		fatal("bad superblock checksum")
+	}
+	fs.fstart = fieldr(fs.sb, 0)
+	fs.flen = fieldr(fs.sb, 1)
+	fs.loglen = fieldr(fs.sb, 2)
+	fs.last = fieldr(fs.sb, 4)
+	fs.logstart = fs.fstart + fs.flen
+	fs.ustart = fs.logstart + fs.loglen
+	if fs.fstart <= fs.sbn || fs.flen <= 0 || fs.loglen < 2 ||
+	    fs.ustart > fs.last {
+		fatal("bad superblock: free bitmap %v+%v, log %v, last " +
+		    "block %v", fs.fstart, fs.flen, fs.loglen, fs.last)
+	}
+}
+
+// replays a committed transaction like fs_recover in fs/fs.go
+func (fs *fsck_t) replay() {
+	cr := fs.d.read(fs.logstart)
+	if fieldr(cr, 0) != LOG_MAGIC {
+		return
+	}
+	ll := fs.loglen - 1
+	ndesc := (ll + LOGDPB)/(LOGDPB + 1)
+	ll -= ndesc
+	rlen := fieldr(cr, 2)
+	if !cksum_ok(cr) || rlen < 0 || rlen > ll {
+		fmt.Println("log commit record is invalid; ignoring log")
+		return
+	}
+	if rlen == 0 {
+		return
+	}
+	dsum := uint32(0)
+	stale := false
+	for d := 0; d < (rlen + LOGDPB - 1)/LOGDPB; d++ {
+		db := fs.d.read(fs.logstart + 1 + d)
+		dsum = crc32.Update(dsum, crc32c_tab, db[:])
+		if fieldr(db, LOGDPB) != fieldr(cr, 1) {
+			stale = true
+		}
+	}
+	if dsum != uint32(fieldr(cr, 3)) {
+		fmt.Println("bad log descriptor checksum; ignoring log")
+		return
+	}
+	if stale {
+		fmt.Println("log descriptor of another transaction; " +
+		    "ignoring log")
+		return
+	}
+	dests := make([]int, rlen)
+	srcs := make([]*blk_t, rlen)
+	for i := range dests {
+		db := fs.d.read(fs.logstart + 1 + i/LOGDPB)
+		off := 8*(i % LOGDPB)
+		dests[i] = readn(db[:], 4, off)
+		srcs[i] = fs.d.read(fs.logstart + 1 + ndesc + i)
+		sum := uint32(readn(db[:], 4, off + 4))
+		if crc32.Checksum(srcs[i][:], crc32c_tab) != sum {
+			fmt.Printf("bad checksum for log block %v; ignoring " +
+			    "log\n", i)
+			return
+		}
+		if dests[i] <= 0 || dests[i] >= fs.last {
+			fmt.Printf("log block %v has bad destination %v; " +
+			    "ignoring log\n", i, dests[i])
+			return
+		}
+	}
+	for i := range dests {
+		fs.d.write(dests[i], srcs[i], false)
+	}
+	fieldw(cr, 2, 0)
+	fs.d.write(fs.logstart, cr, true)
+	// the superblock may have been logged
+	fs.sb = fs.d.read(fs.sbn)
+	if !cksum_ok(fs.sb) {
+		fatal("bad superblock checksum after log replay")
+	}
+	// the kernel leaves the last transaction in the log after installing
+	// it, so replaying it is not an error
+	fmt.Printf("replayed %v blocks from the log\n", rlen)
+}
+
+// marks bn used by who, reporting blocks outside the data area and blocks
+// used twice
+func (fs *fsck_t) claim(bn int, who string) bool {
+	if bn < fs.ustart || bn >= fs.last {
+		fs.problem(false, "%v: block %v is outside the data area",
+		    who, bn)
+		return false
+	}
+	if o, ok := fs.owner[bn]; ok {
+		fs.problem(false, "block %v is used by both %v and %v", bn,
+		    o, who)
+		return false
+	}
+	fs.owner[bn] = who
+	return true
+}
+
+// returns the inode block of i, checking its checksum when it is first seen
+func (fs *fsck_t) iblk(i inum) (*blk_t, bool) {
+	bn := i.blk()
+	if bn < fs.ustart || bn >= fs.last {
+		return nil, false
+	}
+	b := fs.d.read(bn)
+	if !fs.iblks[bn] {
+		if !cksum_ok(b) {
+			return nil, false
+		}
+		if !fs.claim(bn, fmt.Sprintf("inode block %v", bn)) {
+			return nil, false
+		}
+		fs.iblks[bn] = true
+	}
+	return b, true
+}
+
+func ifield(i inum, f int) int {
+	return i.idx()*NIWORDS + f
+}
+
+// the fields of an inode
+type inode_t struct {
+	itype	int
+	links	int
+	size	int
+	indir	int
+	addrs	[NIADDRS]int
+}
+
+func (fs *fsck_t) iget(i inum) (*inode_t, bool) {
+	b, ok := fs.iblk(i)
+	if !ok {
+		return nil, false
+	}
+	in := &inode_t{}
+	in.itype = fieldr(b, ifield(i, 0))
+	in.links = fieldr(b, ifield(i, 1))
+	in.size = fieldr(b, ifield(i, 2))
+	in.indir = fieldr(b, ifield(i, 5))
+	for j := range in.addrs {
+		in.addrs[j] = fieldr(b, ifield(i, 6 + j))
+	}
+	return in, true
+}
+
+// sets field f of inode i
+func (fs *fsck_t) iset(i inum, f int, v int) {
+	b := fs.d.read(i.blk())
+	fieldw(b, ifield(i, f), v)
+	fs.d.write(i.blk(), b, true)
+}
+
+// returns the blocks of in in file order, claiming them and its indirect
+// blocks. holes are zero.
+func (fs *fsck_t) blocks(i inum, in *inode_t) []int {
+	who := fs.paths[i]
+	nb := (in.size + BSIZE - 1)/BSIZE
+	var ret []int
+	for j, a := range in.addrs {
+		if a == 0 {
+			ret = append(ret, 0)
+			continue
+		}
+		if j >= nb {
+			fs.problem(false, "%v: block %v is past the end of " +
+			    "the file", who, a)
+		}
+		if !fs.claim(a, who) {
+			a = 0
+		}
+		ret = append(ret, a)
+	}
+	for ind := in.indir; ind != 0; {
+		if !fs.claim(ind, who + " (indirect)") {
+			break
+		}
+		b := fs.d.read(ind)
+		for j := 0; j < INDSLOTS; j++ {
+			a := readn(b[:], 8, 8*j)
+			if a != 0 {
+				if len(ret) >= nb {
+					fs.problem(false, "%v: block %v is " +
+					    "past the end of the file", who, a)
+				}
+				if !fs.claim(a, who) {
+					a = 0
+				}
+			}
+			ret = append(ret, a)
+		}
+		ind = readn(b[:], 8, 8*INDSLOTS)
+	}
+	return ret
+}
+
+// checks the inode i named by path and, for a directory, everything in it
+func (fs *fsck_t) walk(i inum, path string) {
+	fs.paths[i] = path
+	in, _ := fs.iget(i)
+	blks := fs.blocks(i, in)
+	switch in.itype {
+	case I_FILE:
+		return
+	case I_DEV:
+		if in.size != 0 || len(blks) != NIADDRS || in.indir != 0 {
+			fs.problem(false, "%v: device file has blocks", path)
+		}
+		return
+	}
+	if in.size % BSIZE != 0 {
+		fs.problem(false, "%v: directory size %v is not a multiple " +
+		    "of the block size", path, in.size)
+	}
+	names := make(map[string]bool)
+	var subdirs []inum
+	var subpaths []string
+	for j := 0; j < in.size/BSIZE && j < len(blks); j++ {
+		bn := blks[j]
+		if bn == 0 {
+			fs.problem(false, "%v: directory has a hole", path)
+			continue
+		}
+		b := fs.d.read(bn)
+		if !cksum_ok(b) {
+			fs.problem(false, "%v: bad checksum of directory " +
+			    "block %v", path, bn)
+			continue
+		}
+		changed := false
+		for k := 0; k < NDIRENTS; k++ {
+			off := NDBYTES*k
+			n := 0
+			for n < DNAMELEN && b[off + n] != 0 {
+				n++
+			}
+			if n == 0 {
+				continue
+			}
+			name := string(b[off:off + n])
+			ci := inum(readn(b[:], 8, off + DNAMELEN))
+			cpath := path + name
+			if path != "/" {
+				cpath = path + "/" + name
+			}
+			bad := ""
+			cin, ok := fs.iget(ci)
+			switch {
+			case !ok:
+				bad = fmt.Sprintf("bad inode %#x", int(ci))
+			case cin.itype == I_INVALID || cin.itype > I_DEV:
+				bad = fmt.Sprintf("inode %#x of type %v",
+				    int(ci), cin.itype)
+			case names[name]:
+				bad = "a duplicate name"
+			case cin.itype == I_DIR && fs.refs[ci] != 0:
+				bad = "a second link to a directory"
+			}
+			if bad != "" {
+				fs.problem(true, "%v: entry names %v", cpath,
+				    bad)
+				for x := 0; x < NDBYTES; x++ {
+					b[off + x] = 0
+				}
+				changed = true
+				continue
+			}
+			names[name] = true
+			fs.refs[ci]++
+			if fs.refs[ci] > 1 {
+				continue
+			}
+			if cin.itype == I_DIR {
+				subdirs = append(subdirs, ci)
+				subpaths = append(subpaths, cpath)
+			} else {
+				fs.walk(ci, cpath)
+			}
+		}
+		if changed {
+			fs.d.write(bn, b, true)
+		}
+	}
+	for j, ci := range subdirs {
+		fs.walk(ci, subpaths[j])
+	}
+}
+
+// checks the free inode list
+func (fs *fsck_t) freelist() {
+	for i := inum(fieldr(fs.sb, 5)); i != 0; {
+		in, ok := fs.iget(i)
+		bad := ""
+		switch {
+		case !ok:
+			bad = "is a bad inode"
+		case fs.free[i]:
+			bad = "is listed twice"
+		case in.itype != I_INVALID || fs.paths[i] != "":
+			bad = "is in use"
+		}
+		if bad != "" {
+			// the list is rebuilt from the free inodes found
+			fs.problem(true, "free inode list entry %#x %v",
+			    int(i), bad)
+			fs.relist()
+			return
+		}
+		fs.free[i] = true
+		i = inum(in.links)
+	}
+}
+
+// rebuilds the free inode list from the free inodes of the known inode
+// blocks
+func (fs *fsck_t) relist() {
+	fs.free = make(map[inum]bool)
+	bns := make([]int, 0, len(fs.iblks))
+	for bn := range fs.iblks {
+		bns = append(bns, bn)
+	}
+	sort.Ints(bns)
+	head := 0
+	for j := len(bns) - 1; j >= 0; j-- {
+		for k := ISPERBLK - 1; k >= 0; k-- {
+			i := biencode(bns[j], k)
+			in, _ := fs.iget(i)
+			if in.itype != I_INVALID {
+				continue
+			}
+			fs.iset(i, 1, head)
+			fs.free[i] = true
+			head = int(i)
+		}
+	}
+	fieldw(fs.sb, 5, head)
+	fs.d.write(fs.sbn, fs.sb, true)
+}
+
+// finds inodes of the known inode blocks that are neither reachable nor free
+func (fs *fsck_t) orphans() {
+	bns := make([]int, 0, len(fs.iblks))
+	for bn := range fs.iblks {
+		bns = append(bns, bn)
+	}
+	sort.Ints(bns)
+	lost := false
+	for _, bn := range bns {
+		for k := 0; k < ISPERBLK; k++ {
+			i := biencode(bn, k)
+			if fs.paths[i] != "" || fs.free[i] {
+				continue
+			}
+			in, _ := fs.iget(i)
+			if in.itype == I_INVALID {
+				fs.problem(true, "free inode %#x is not on " +
+				    "the free inode list", int(i))
+			} else {
+				// its blocks are unclaimed and thus freed by
+				// the bitmap check
+				fs.problem(true, "inode %#x of type %v is " +
+				    "unreachable", int(i), in.itype)
+				for f := 0; f < NIWORDS; f++ {
+					fs.iset(i, f, 0)
+				}
+			}
+			lost = true
+		}
+	}
+	if lost {
+		fs.relist()
+	}
+}
+
+func (fs *fsck_t) links() {
+	is := make([]int, 0, len(fs.paths))
+	for i := range fs.paths {
+		is = append(is, int(i))
+	}
+	sort.Ints(is)
+	root := inum(fieldr(fs.sb, 3))
+	for _, n := range is {
+		i := inum(n)
+		want := fs.refs[i]
+		// the superblock refers to the root
+		if i == root {
+			want++
+		}
+		in, _ := fs.iget(i)
+		if in.links != want {
+			fs.problem(true, "%v: link count is %v, should be %v",
+			    fs.paths[i], in.links, want)
+			fs.iset(i, 1, want)
+		}
+	}
+}
+
+// compares the free bitmap with the blocks in use
+func (fs *fsck_t) bitmap() int {
+	bitsperblk := BSIZE*8
+	nbits := fs.last - fs.ustart
+	if nbits > fs.flen*bitsperblk {
+		nbits = fs.flen*bitsperblk
+	}
+	for bn := range fs.owner {
+		if bn - fs.ustart >= nbits {
+			fs.problem(false, "block %v of %v is not covered by " +
+			    "the free bitmap", bn, fs.owner[bn])
+		}
+	}
+	nfree := 0
+	for g := 0; g < fs.flen; g++ {
+		b := fs.d.read(fs.fstart + g)
+		changed := false
+		for j := 0; j < bitsperblk && g*bitsperblk + j < nbits; j++ {
+			bn := fs.ustart + g*bitsperblk + j
+			_, used := fs.owner[bn]
+			m := uint8(1 << uint(j % 8))
+			marked := b[j/8] & m != 0
+			switch {
+			case used && !marked:
+				fs.problem(true, "block %v of %v is marked " +
+				    "free", bn, fs.owner[bn])
+				b[j/8] |= m
+				changed = true
+			case !used && marked:
+				fs.problem(true, "block %v is marked used " +
+				    "but unused", bn)
+				b[j/8] &^= m
+				changed = true
+			}
+			if !used {
+				nfree++
+			}
+		}
+		if changed {
+			fs.d.write(fs.fstart + g, b, false)
+		}
+	}
+	return nfree
+}
+
+func main() {
+	repair := flag.Bool("r", false, "repair the image")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %v [-r] <image>\n", os.Args[0])
+		os.Exit(8)
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+	}
+	mode := os.O_RDONLY
+	if *repair {
+		mode = os.O_RDWR
+	}
+	f, err := os.OpenFile(flag.Arg(0), mode, 0)
+	if err != nil {
+		fatal("%v", err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		fatal("%v", err)
+	}
+	d := &disk_t{f: f, nblks: int(st.Size()/BSIZE),
+	    dirty: make(map[int]*blk_t)}
+	fs := &fsck_t{d: d, repair: *repair}
+	fs.owner = make(map[int]string)
+	fs.iblks = make(map[int]bool)
+	fs.refs = make(map[inum]int)
+	fs.paths = make(map[inum]string)
+	fs.free = make(map[inum]bool)
+
+	fs.superblock()
+	fs.replay()
+	root := inum(fieldr(fs.sb, 3))
+	if in, ok := fs.iget(root); !ok || in.itype != I_DIR {
+		fatal("bad root inode %#x", int(root))
+	}
+	fs.walk(root, "/")
+	fs.freelist()
+	fs.orphans()
+	fs.links()
+	nfree := fs.bitmap()
+
+	fmt.Printf("%v inodes, %v free inodes, %v blocks used, %v free\n",
+	    len(fs.paths), len(fs.free), len(fs.owner), nfree)
+	if *repair {
+		d.flush()
+	}
+	switch {
+	case fs.nerr == 0:
+		os.Exit(0)
+	case fs.nerr == fs.nfixed:
+		os.Exit(1)
+	}
+	os.Exit(4)
+}
@@ -0,0 +1,571 @@
+package main
+
+import "strings"
+import "sync"
+import "sync/atomic"
+
+// the virtual file system: file systems of any type are mounted on
+// directories of other file systems, and a path is resolved by the mounted
+// file system holding it. file systems see paths relative to their root.
+
+const(
+	// mount flags
+	MS_RDONLY	= 1
+	// umount2 flags: unmount even if files are open; they fail with EIO
+	// afterwards
+	MNT_FORCE	= 1
+
+	// file types in stat_t.mode
+	S_IFMT		= 0xf000
+	S_IFCHR		= 0x2000
+	S_IFDIR		= 0x4000
+	S_IFREG		= 0x8000
+)
+
+// the attributes of a file
+type stat_t struct {
+	// the mount holding the file
+	dev	int
+	ino	int
+	mode	int
+	nlink	int
+	size	int
+	// the device number of device files
+	rdev	int
+}
+
+// the size of the record copied to user space by fstat
+const STAT_SIZE = 6*8
+
+func mkdev(major int, minor int) int {
+	return major << 16 | minor
+}
+
+func unmkdev(dev int) (int, int) {
+	return dev >> 16, dev & 0xffff
+}
+
+func (st *stat_t) record(buf []uint8) {
+	writen(buf, 8, 0, st.dev)
+	writen(buf, 8, 8, st.ino)
+	writen(buf, 8, 16, st.mode)
+	writen(buf, 8, 24, st.nlink)
+	writen(buf, 8, 32, st.size)
+	writen(buf, 8, 40, st.rdev)
+}
+
+// a mounted file system, the superblock object of a mount
+type fs_t interface {
+	// opens the file at path, creating it if flags has O_CREAT
+	open(path []string, flags int, mode int) (fops_t, int)
+	mkdir(path []string, mode int) int
+	// makes a device file for the character device major, minor
+	mknod(path []string, major int, minor int) int
+	link(oldp []string, newp []string) int
+	unlink(path []string) int
+	// makes all changes durable
+	sync() int
+	// called once the file system is no longer reachable; returns an
+	// error if the file system cannot be detached
+	unmount() int
+}
+
+// the operations on an open file
+type fops_t interface {
+	read(dsts [][]uint8, offset int) (int, int)
+	write(srcs [][]uint8, offset int, append bool) (int, int)
+	// makes the file's changes durable
+	fsync() int
+	// sets the file's size, filling with zeros when it grows
+	truncate(newlen int) int
+	// fills in all of st but st.dev
+	stat(st *stat_t) int
+	// called once the file is no longer used
+	close() int
+}
+
+// a type of file system that can be mounted
+type fstype_t struct {
+	name	string
+	// true if the source of a mount names a block device
+	needdev	bool
+	// dev is nil unless needdev is set. data holds options specific to
+	// the type.
+	mount	func(dev blockdev_t, flags int, data string) (fs_t, int)
+}
+
+var fstypes	[]*fstype_t
+
+// file system types must be registered before they are mounted
+func fstype_register(t *fstype_t) {
+	fstypes = append(fstypes, t)
+}
+
+func fstype_find(name string) *fstype_t {
+	for _, t := range fstypes {
+		if t.name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+type mount_t struct {
+	// the path of the mount point; empty for the root
+	path	[]string
+	fs	fs_t
+	typ	*fstype_t
+	// the source, for messages
+	src	string
+	// the block device holding the file system; nil for types that need
+	// none
+	dev	blockdev_t
+	flags	int
+	// distinguishes the files of different mounts in stat_t.dev
+	id	int
+	// set once the mount is forcibly unmounted
+	gone	bool
+	// set while the file system is being mounted or unmounted; fs is nil
+	// until it is mounted. paths below the mount point fail with -EBUSY
+	// meanwhile.
+	busy	bool
+}
+
+// the mounts, in the order they were made; the root is first. a path is
+// resolved by the last mount whose mount point is a prefix of the path, so a
+// mount hides those below it. protected by mountl.
+var mounts	[]*mount_t
+var mountl	= sync.Mutex{}
+var mountid	int
+
+// returns true if pre is a prefix of path
+func path_prefix(pre []string, path []string) bool {
+	if len(pre) > len(path) {
+		return false
+	}
+	for i := range pre {
+		if pre[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func path_equal(a []string, b []string) bool {
+	return len(a) == len(b) && path_prefix(a, b)
+}
+
+// returns the mount holding path and the path relative to the mount's root
+func vfs_lookup(path []string) (*mount_t, []string, int) {
+	mountl.Lock()
+	defer mountl.Unlock()
+	for i := len(mounts) - 1; i >= 0; i-- {
+		m := mounts[i]
+		if path_prefix(m.path, path) {
+			if m.busy {
+				return nil, nil, -EBUSY
+			}
+			return m, path[len(m.path):], 0
+		}
+	}
+	panic("no root file system")
+}
+
+// removes m from mounts. the caller holds mountl.
+func mount_remove(m *mount_t) {
+	for i := range mounts {
+		if mounts[i] == m {
+			copy(mounts[i:], mounts[i + 1:])
+			mounts = mounts[:len(mounts) - 1]
+			return
+		}
+	}
+	panic("no such mount")
+}
+
+// returns -EROFS if files of m cannot be modified
+func (m *mount_t) rdonly() int {
+	if m.flags & MS_RDONLY != 0 {
+		return -EROFS
+	}
+	return 0
+}
+
+// an open file of a mounted file system. device files opened by the kernel
+// itself may have no mount.
+type file_t struct {
+	mnt	*mount_t
+	fops	fops_t
+	// the fds referring to the file; a forked child shares its parent's
+	// files
+	refs	int32
+}
+
+// adds a reference to the file for a new fd
+func (f *file_t) dup() {
+	atomic.AddInt32(&f.refs, 1)
+}
+
+// returns true if the file's file system was forcibly unmounted
+func (f *file_t) gone() bool {
+	return f.mnt != nil && f.mnt.gone
+}
+
+func (f *file_t) read(dsts [][]uint8, offset int) (int, int) {
+	if f.gone() {
+		return 0, -EIO
+	}
+	return f.fops.read(dsts, offset)
+}
+
+func (f *file_t) write(srcs [][]uint8, offset int, append bool) (int, int) {
+	if f.gone() {
+		return 0, -EIO
+	}
+	return f.fops.write(srcs, offset, append)
+}
+
+func (f *file_t) fsync() int {
+	if f.gone() {
+		return -EIO
+	}
+	return f.fops.fsync()
+}
+
+func (f *file_t) truncate(newlen int) int {
+	if f.gone() {
+		return -EIO
+	}
+	if f.mnt != nil {
+		if err := f.mnt.rdonly(); err != 0 {
+			return err
+		}
+	}
+	return f.fops.truncate(newlen)
+}
+
+func (f *file_t) stat(st *stat_t) int {
+	if f.gone() {
+		return -EIO
+	}
+	if err := f.fops.stat(st); err != 0 {
+		return err
+	}
+	if f.mnt != nil {
+		st.dev = f.mnt.id
+	}
+	return 0
+}
+
+// drops a reference, closing the file with the last one. the files of a
+// forcibly unmounted file system are not closed since the file system is
+// gone, but devices are; their drivers outlive the mount.
+func (f *file_t) close() int {
+	if atomic.AddInt32(&f.refs, -1) > 0 {
+		return 0
+	}
+	if _, ok := f.fops.(*devfile_t); !ok && f.gone() {
+		return 0
+	}
+	return f.fops.close()
+}
+
+// only devices have ioctls
+func (f *file_t) ioctl(cmd int, arg int) int {
+	if f.gone() {
+		return -EIO
+	}
+	df, ok := f.fops.(*devfile_t)
+	if !ok {
+		return -ENOTTY
+	}
+	return df.ioctl(cmd, arg)
+}
+
+// files other than devices never block
+func (f *file_t) poll(events int) int {
+	if f.gone() {
+		return POLLERR
+	}
+	df, ok := f.fops.(*devfile_t)
+	if !ok {
+		return events & (POLLIN | POLLOUT)
+	}
+	return df.poll(events)
+}
+
+// mounts the root file system; dev must hold a file system of type typ.
+func vfs_mountroot(typ string, dev blockdev_t) {
+	t := fstype_find(typ)
+	if t == nil {
+		panic("no root file system type")
+	}
+	fs, err := t.mount(dev, 0, "")
+	if err != 0 {
+		panic("cannot mount root")
+	}
+	mountl.Lock()
+	mountid++
+	m := &mount_t{fs: fs, typ: t, src: "root", dev: dev, id: mountid}
+	mounts = append(mounts, m)
+	mountl.Unlock()
+}
+
+func vfs_open(path []string, flags int, mode int) (*file_t, int) {
+	m, rel, err := vfs_lookup(path)
+	if err != 0 {
+		return nil, err
+	}
+	acc := flags & (O_RDONLY | O_WRONLY | O_RDWR)
+	if flags & O_CREAT != 0 || acc != O_RDONLY {
+		if err := m.rdonly(); err != 0 {
+			return nil, err
+		}
+	}
+	fops, err := m.fs.open(rel, flags, mode)
+	if err != 0 {
+		return nil, err
+	}
+	if flags & O_TRUNC != 0 && acc != O_RDONLY {
+		if err := fops.truncate(0); err != 0 {
+			fops.close()
+			return nil, err
+		}
+	}
+	return &file_t{mnt: m, fops: fops, refs: 1}, 0
+}
+
+func vfs_mkdir(path []string, mode int) int {
+	m, rel, err := vfs_lookup(path)
+	if err != 0 {
+		return err
+	}
+	if len(rel) == 0 {
+		return -EEXIST
+	}
+	if err := m.rdonly(); err != 0 {
+		return err
+	}
+	return m.fs.mkdir(rel, mode)
+}
+
+func vfs_mknod(path []string, major int, minor int) int {
+	m, rel, err := vfs_lookup(path)
+	if err != 0 {
+		return err
+	}
+	if len(rel) == 0 {
+		return -EEXIST
+	}
+	if err := m.rdonly(); err != 0 {
+		return err
+	}
+	return m.fs.mknod(rel, major, minor)
+}
+
+func vfs_link(oldp []string, newp []string) int {
+	om, orel, err := vfs_lookup(oldp)
+	if err != 0 {
+		return err
+	}
+	nm, nrel, err := vfs_lookup(newp)
+	if err != 0 {
+		return err
+	}
+	if len(nrel) == 0 {
+		return -EEXIST
+	}
+	// the root of a file system is a directory
+	if len(orel) == 0 {
+		return -EPERM
+	}
+	if om != nm {
+		return -EXDEV
+	}
+	if err := nm.rdonly(); err != 0 {
+		return err
+	}
+	return nm.fs.link(orel, nrel)
+}
+
+func vfs_unlink(path []string) int {
+	m, rel, err := vfs_lookup(path)
+	if err != 0 {
+		return err
+	}
+	if len(rel) == 0 {
+		return -EBUSY
+	}
+	if err := m.rdonly(); err != 0 {
+		return err
+	}
+	return m.fs.unlink(rel)
+}
+
+// syncs every mounted file system, returning the first error
+func vfs_sync() int {
+	// a file system being unmounted is synced by vfs_umount()
+	mountl.Lock()
+	ms := make([]*mount_t, 0, len(mounts))
+	for _, m := range mounts {
+		if !m.busy && m.flags & MS_RDONLY == 0 {
+			ms = append(ms, m)
+		}
+	}
+	mountl.Unlock()
+	ret := 0
+	for _, m := range ms {
+		if err := m.fs.sync(); err != 0 && ret == 0 {
+			ret = err
+		}
+	}
+	return ret
+}
+
+// mounts a file system of type typ from src on the directory at path. src
+// names a block device for types that need one, with or without a leading
+// "/dev/", and is ignored otherwise.
+func vfs_mount(src string, path []string, typ string, flags int,
+    data string) int {
+	if flags &^ MS_RDONLY != 0 {
+		return -EINVAL
+	}
+	t := fstype_find(typ)
+	if t == nil {
+		return -ENODEV
+	}
+	var dev blockdev_t
+	if t.needdev {
+		dev = bdev_lookup(strings.TrimPrefix(src, "/dev/"))
+		if dev == nil {
+			return -ENOENT
+		}
+	}
+	// the mount point must be a directory and not be a mount point
+	// already
+	pm, rel, err := vfs_lookup(path)
+	if err != 0 {
+		return err
+	}
+	if len(rel) == 0 {
+		return -EBUSY
+	}
+	mp, err := pm.fs.open(rel, O_RDONLY, 0)
+	if err != 0 {
+		return err
+	}
+	st := &stat_t{}
+	err = mp.stat(st)
+	mp.close()
+	if err != 0 {
+		return err
+	}
+	if st.mode & S_IFMT != S_IFDIR {
+		return -ENOTDIR
+	}
+
+	// reserve the mount point and the device until the file system is
+	// mounted. a device holds one mounted file system, whatever its name.
+	m := &mount_t{path: path, typ: t, src: src, dev: dev, flags: flags,
+	    busy: true}
+	mountl.Lock()
+	for _, o := range mounts {
+		if path_equal(o.path, path) || dev != nil && o.dev == dev {
+			mountl.Unlock()
+			return -EBUSY
+		}
+	}
+	mountid++
+	m.id = mountid
+	mounts = append(mounts, m)
+	mountl.Unlock()
+
+	fs, err := t.mount(dev, flags, data)
+	mountl.Lock()
+	defer mountl.Unlock()
+	if err != 0 {
+		mount_remove(m)
+		return err
+	}
+	m.fs = fs
+	m.busy = false
+	return 0
+}
+
+// returns true if a process has a file of m open
+func mount_busy(m *mount_t) bool {
+	proclock.Lock()
+	defer proclock.Unlock()
+	for _, p := range allprocs {
+		p.fdl.Lock()
+		for _, fd := range p.fds {
+			if fd.file.mnt == m {
+				p.fdl.Unlock()
+				return true
+			}
+		}
+		p.fdl.Unlock()
+	}
+	return false
+}
+
+// unmounts the file system mounted at path
+func vfs_umount(path []string, flags int) int {
+	if flags &^ MNT_FORCE != 0 {
+		return -EINVAL
+	}
+	mountl.Lock()
+	idx := -1
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if path_equal(mounts[i].path, path) {
+			idx = i
+			break
+		}
+	}
+	if idx == -1 {
+		mountl.Unlock()
+		return -EINVAL
+	}
+	m := mounts[idx]
+	// the root can't be unmounted, and neither can a file system that is
+	// being mounted or unmounted
+	if idx == 0 || m.busy {
+		mountl.Unlock()
+		return -EBUSY
+	}
+	// file systems mounted below m keep it busy
+	for _, o := range mounts[idx + 1:] {
+		if path_prefix(m.path, o.path) {
+			mountl.Unlock()
+			return -EBUSY
+		}
+	}
+	if flags & MNT_FORCE == 0 && mount_busy(m) {
+		mountl.Unlock()
+		return -EBUSY
+	}
+	// the file system may take a while to sync and its server may use
+	// other mounts meanwhile, so mountl isn't held
+	m.busy = true
+	mountl.Unlock()
+
+	err := 0
+	if m.flags & MS_RDONLY == 0 {
+		err = m.fs.sync()
+		if flags & MNT_FORCE != 0 {
+			err = 0
+		}
+	}
+	if err == 0 {
+		err = m.fs.unmount()
+	}
+	mountl.Lock()
+	defer mountl.Unlock()
+	if err != 0 {
+		m.busy = false
+		return err
+	}
+	m.gone = true
+	mount_remove(m)
+	return 0
+}
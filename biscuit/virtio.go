@@ -0,0 +1,715 @@
+package main
+
+import "fmt"
+import "runtime"
+import "sync/atomic"
+import "unsafe"
+
+// virtio-blk driver for legacy and modern virtio PCI devices. each disk has a
+// single split virtqueue shared by the disk's daemon and the device; the
+// daemon keeps as many requests outstanding as the queue's descriptors allow.
+// trapstub reads each device's ISR status register, which deasserts the
+// level-triggered interrupt line; the daemon then collects finished requests
+// from the used ring.
+
+const(
+	vio_vendor = 0x1af4
+	// transitional devices also speak the legacy interface
+	vio_dev_blk_legacy = 0x1001
+	vio_dev_blk = 0x1042
+
+	// device status
+	vio_st_ack = 1
+	vio_st_driver = 2
+	vio_st_driver_ok = 4
+	vio_st_features_ok = 8
+	vio_st_failed = 0x80
+
+	// feature bits
+	vio_blk_f_flush = 1 << 9
+	vio_f_version_1 = 1 << 32
+
+	// legacy registers, relative to the I/O BAR
+	viol_hostf = 0x00
+	viol_guestf = 0x04
+	viol_qpfn = 0x08
+	viol_qsize = 0x0c
+	viol_qsel = 0x0e
+	viol_qnotify = 0x10
+	viol_status = 0x12
+	viol_isr = 0x13
+	viol_config = 0x14
+
+	// modern common configuration registers
+	viom_dfsel = 0x00
+	viom_df = 0x04
+	viom_gfsel = 0x08
+	viom_gf = 0x0c
+	viom_status = 0x14
+	viom_qsel = 0x16
+	viom_qsize = 0x18
+	viom_qenable = 0x1c
+	viom_qnotoff = 0x1e
+	viom_qdesc = 0x20
+	viom_qavail = 0x28
+	viom_qused = 0x30
+	viom_commonsz = 0x38
+
+	// the types of the vendor capabilities locating the modern registers
+	vio_cap_common = 1
+	vio_cap_notify = 2
+	vio_cap_isr = 3
+	vio_cap_device = 4
+
+	// device configuration: the capacity in 512 byte sectors
+	vio_blk_capacity = 0
+
+	vio_blk_t_in = 0
+	vio_blk_t_out = 1
+	vio_blk_t_flush = 4
+	vio_blk_s_ok = 0
+	vio_blk_hdrsz = 16
+
+	vring_desc_next = 1
+	vring_desc_write = 2
+	// legacy devices require the used ring to be page aligned
+	vring_align = PGSIZE
+
+	vio_maxq = 1024
+	vio_maxdevs = 8
+	// the most sectors moved by one request
+	vio_maxsect = 64
+)
+
+type vring_desc_t struct {
+	addr	uint64
+	len	uint32
+	flags	uint16
+	next	uint16
+}
+
+type vring_avail_t struct {
+	flags	uint16
+	idx	uint16
+	ring	[vio_maxq]uint16
+}
+
+type vring_elem_t struct {
+	id	uint32
+	len	uint32
+}
+
+type vring_used_t struct {
+	flags	uint16
+	idx	uint16
+	ring	[vio_maxq]vring_elem_t
+}
+
+// the registers of a virtio PCI device, which are reached through I/O ports
+// on legacy devices and through memory on modern ones
+type vio_trans_t interface {
+	features() int
+	setfeatures(f int)
+	status() int
+	setstatus(st int)
+	// selects queue q and returns its size, or 0 if there is no such queue
+	qsize(q int) int
+	// sets the selected queue's size and the physical addresses of its
+	// descriptor table, available ring, and used ring, and enables it.
+	// returns false if the device can't use the queue.
+	qsetup(size, desc, avail, used int) bool
+	notify(q int)
+	// reads n bytes of device configuration at off
+	cfg(off int, n int) int
+}
+
+type vio_legacy_t struct {
+	base	int32
+}
+
+func (l *vio_legacy_t) features() int {
+	return runtime.Inl(l.base + viol_hostf)
+}
+
+func (l *vio_legacy_t) setfeatures(f int) {
+	runtime.Outl(l.base + viol_guestf, int32(f))
+}
+
+func (l *vio_legacy_t) status() int {
+	return runtime.Inb(l.base + viol_status)
+}
+
+func (l *vio_legacy_t) setstatus(st int) {
+	runtime.Outb(l.base + viol_status, int32(st))
+}
+
+func (l *vio_legacy_t) qsize(q int) int {
+	runtime.Outw(l.base + viol_qsel, int32(q))
+	return runtime.Inw(l.base + viol_qsize)
+}
+
+func (l *vio_legacy_t) qsetup(size, desc, avail, used int) bool {
+	// legacy queues have a fixed size and layout; only the descriptor
+	// table's page is given to the device
+	if size != runtime.Inw(l.base + viol_qsize) ||
+	    avail != desc + size*16 ||
+	    used != roundup(avail + 6 + 2*size, vring_align) {
+		return false
+	}
+	runtime.Outl(l.base + viol_qpfn, int32(desc/PGSIZE))
+	return true
+}
+
+func (l *vio_legacy_t) notify(q int) {
+	runtime.Outw(l.base + viol_qnotify, int32(q))
+}
+
+func (l *vio_legacy_t) cfg(off int, n int) int {
+	port := l.base + viol_config + int32(off)
+	switch n {
+	case 1:
+		return runtime.Inb(port)
+	case 2:
+		return runtime.Inw(port)
+	case 4:
+		return runtime.Inl(port)
+	}
+	panic("bad config width")
+}
+
+type vio_modern_t struct {
+	common	[]uint8
+	isr	[]uint8
+	dev	[]uint8
+	// the notification region and the multiplier of queue notify offsets
+	ntfy	[]uint8
+	ntfymul	int
+	// where the selected queue's notifications are written
+	qntfy	[]uint8
+}
+
+// reads or writes a n byte memory-mapped register
+func mmio_rd(r []uint8, off int, n int) int {
+	p := unsafe.Pointer(&r[off])
+	switch n {
+	case 1:
+		return int(*(*uint8)(p))
+	case 2:
+		return int(*(*uint16)(p))
+	case 4:
+		return int(atomic.LoadUint32((*uint32)(p)))
+	}
+	panic("bad register width")
+}
+
+func mmio_wr(r []uint8, off int, n int, v int) {
+	p := unsafe.Pointer(&r[off])
+	switch n {
+	case 1:
+		*(*uint8)(p) = uint8(v)
+	case 2:
+		*(*uint16)(p) = uint16(v)
+	case 4:
+		*(*uint32)(p) = uint32(v)
+	default:
+		panic("bad register width")
+	}
+}
+
+func (m *vio_modern_t) features() int {
+	mmio_wr(m.common, viom_dfsel, 4, 0)
+	ret := mmio_rd(m.common, viom_df, 4)
+	mmio_wr(m.common, viom_dfsel, 4, 1)
+	return ret | mmio_rd(m.common, viom_df, 4) << 32
+}
+
+func (m *vio_modern_t) setfeatures(f int) {
+	mmio_wr(m.common, viom_gfsel, 4, 0)
+	mmio_wr(m.common, viom_gf, 4, f)
+	mmio_wr(m.common, viom_gfsel, 4, 1)
+	mmio_wr(m.common, viom_gf, 4, f >> 32)
+}
+
+func (m *vio_modern_t) status() int {
+	return mmio_rd(m.common, viom_status, 1)
+}
+
+func (m *vio_modern_t) setstatus(st int) {
+	mmio_wr(m.common, viom_status, 1, st)
+}
+
+func (m *vio_modern_t) qsize(q int) int {
+	mmio_wr(m.common, viom_qsel, 2, q)
+	return mmio_rd(m.common, viom_qsize, 2)
+}
+
+func (m *vio_modern_t) qsetup(size, desc, avail, used int) bool {
+	off := mmio_rd(m.common, viom_qnotoff, 2)*m.ntfymul
+	if off + 2 > len(m.ntfy) {
+		return false
+	}
+	m.qntfy = m.ntfy[off:]
+	mmio_wr(m.common, viom_qsize, 2, size)
+	regs := []int{viom_qdesc, desc, viom_qavail, avail, viom_qused, used}
+	for i := 0; i < len(regs); i += 2 {
+		mmio_wr(m.common, regs[i], 4, regs[i+1])
+		mmio_wr(m.common, regs[i] + 4, 4, regs[i+1] >> 32)
+	}
+	mmio_wr(m.common, viom_qenable, 2, 1)
+	return true
+}
+
+func (m *vio_modern_t) notify(q int) {
+	mmio_wr(m.qntfy, 0, 2, q)
+}
+
+func (m *vio_modern_t) cfg(off int, n int) int {
+	return mmio_rd(m.dev, off, n)
+}
+
+// reads a 64-bit device configuration field, which the device may change
+// between the reads of its halves
+func vio_cfg64(tr vio_trans_t, off int) int {
+	for {
+		hi := tr.cfg(off + 4, 4)
+		lo := tr.cfg(off, 4)
+		if tr.cfg(off + 4, 4) == hi {
+			return hi << 32 | lo
+		}
+	}
+}
+
+// how trapstub reads the ISR status register of a device, which clears it
+type vio_intr_t struct {
+	vec	int
+	// the register's I/O port on legacy devices
+	port	int32
+	// the register on modern devices
+	isr	*uint8
+	// the last status read, which would tell configuration changes apart
+	// from used ring updates
+	st	uint8
+}
+
+var vio_intrs	[vio_maxdevs]vio_intr_t
+var vio_nintrs	int
+
+// clears the interrupts of the virtio devices on the vector from trapstub.
+// returns false if no virtio device uses the vector.
+//go:nosplit
+func vio_intr_clear(trapno int) bool {
+	ret := false
+	for i := 0; i < vio_nintrs; i++ {
+		vi := &vio_intrs[i]
+		if vi.vec != trapno {
+			continue
+		}
+		if vi.isr != nil {
+			vi.st = *vi.isr
+		} else {
+			vi.st = uint8(runtime.Inb_intr(vi.port))
+		}
+		ret = true
+	}
+	return ret
+}
+
+func trap_vio(ts *trapstore_t) {
+	for _, d := range vio_disks {
+		if d.vec != ts.trapno {
+			continue
+		}
+		select {
+		case d.intr <- true:
+		default:
+		}
+	}
+}
+
+// a virtio-blk disk
+type vio_blk_t struct {
+	num	int
+	tr	vio_trans_t
+	vec	int
+	nsect	int
+	flush	bool
+	// the virtqueue
+	qsize	int
+	// the most sectors moved by one request; each sector takes at most
+	// two descriptors since a sector may straddle two pages
+	maxsect	int
+	desc	*[vio_maxq]vring_desc_t
+	avail	*vring_avail_t
+	used	*vring_used_t
+	ring	[]uint8
+	// the used ring index up to which requests have been collected
+	lastused	uint16
+	// free descriptors
+	free	[]int
+	// the request header and status byte of each request, indexed by
+	// the request's first descriptor
+	hdrs	[]uint8
+	stats	[]uint8
+	issued	[]*bdevcmd_t
+	req	chan *bdevreq_t
+	intr	chan bool
+}
+
+var vio_disks	[]*vio_blk_t
+
+func (d *vio_blk_t) start(req *bdevreq_t) {
+	d.req <- req
+}
+
+func (d *vio_blk_t) capacity() int {
+	return d.nsect
+}
+
+func (d *vio_blk_t) sectsize() int {
+	return 512
+}
+
+// virtio-blk has flushes but no forced unit access writes
+func (d *vio_blk_t) fua() bool {
+	return false
+}
+
+// finds the virtio capabilities of a modern device and maps the registers
+// they locate. returns nil if a capability is missing.
+func vio_modern_new(d *pci_dev_t) *vio_modern_t {
+	ret := &vio_modern_t{}
+	found := 0
+	for _, c := range d.caps {
+		if c.id != pci_cap_vendor {
+			continue
+		}
+		typ := (d.rd(c.off) >> 24) & 0xff
+		bar := d.rd(c.off + 4) & 0xff
+		off := d.rd(c.off + 8)
+		l := d.rd(c.off + 12)
+		if bar >= pci_nbars || d.bars[bar].io || d.bars[bar].addr == 0 {
+			continue
+		}
+		// the registers must lie within a page
+		r := dmap8(d.bars[bar].addr + off)
+		if l < len(r) {
+			r = r[:l]
+		}
+		switch typ {
+		case vio_cap_common:
+			if len(r) < viom_commonsz {
+				return nil
+			}
+			ret.common = r
+			found |= 1 << vio_cap_common
+		case vio_cap_notify:
+			ret.ntfy = r
+			ret.ntfymul = d.rd(c.off + 16)
+			found |= 1 << vio_cap_notify
+		case vio_cap_isr:
+			ret.isr = r
+			found |= 1 << vio_cap_isr
+		case vio_cap_device:
+			if len(r) < 8 {
+				return nil
+			}
+			ret.dev = r
+			found |= 1 << vio_cap_device
+		}
+	}
+	if found != 1 << vio_cap_common | 1 << vio_cap_notify |
+	    1 << vio_cap_isr | 1 << vio_cap_device {
+		return nil
+	}
+	return ret
+}
+
+// allocates the disk's virtqueue and gives it to the device. returns false
+// if the device has no usable queue.
+func (d *vio_blk_t) qinit() bool {
+	n := d.tr.qsize(0)
+	// modern devices accept smaller queues; legacy devices refuse them
+	// in qsetup()
+	if n > vio_maxq {
+		n = vio_maxq
+	}
+	if n < 4 || n & (n - 1) != 0 {
+		return false
+	}
+	d.qsize = n
+	d.maxsect = (n - 2)/2
+	if d.maxsect > vio_maxsect {
+		d.maxsect = vio_maxsect
+	}
+	availoff := n*16
+	usedoff := roundup(availoff + 6 + 2*n, vring_align)
+	sz := usedoff + 6 + 8*n
+	ring, pa := dma_contig(roundup(sz, PGSIZE)/PGSIZE)
+	d.ring = ring
+	d.desc = (*[vio_maxq]vring_desc_t)(unsafe.Pointer(&ring[0]))
+	d.avail = (*vring_avail_t)(unsafe.Pointer(&ring[availoff]))
+	d.used = (*vring_used_t)(unsafe.Pointer(&ring[usedoff]))
+	if !d.tr.qsetup(n, pa, pa + availoff, pa + usedoff) {
+		return false
+	}
+	d.free = make([]int, n)
+	for i := range d.free {
+		d.free[i] = i
+	}
+	d.hdrs = make([]uint8, n*vio_blk_hdrsz)
+	d.stats = make([]uint8, n)
+	d.issued = make([]*bdevcmd_t, n)
+	return true
+}
+
+// resets the device and negotiates features. returns false if the device
+// is unusable.
+func (d *vio_blk_t) init(modern bool) bool {
+	tr := d.tr
+	tr.setstatus(0)
+	for tr.status() != 0 {
+	}
+	tr.setstatus(vio_st_ack)
+	tr.setstatus(vio_st_ack | vio_st_driver)
+	f := tr.features()
+	want := vio_blk_f_flush
+	if modern {
+		// modern devices refuse drivers that don't accept
+		// VIRTIO_F_VERSION_1
+		if f & vio_f_version_1 == 0 {
+			return false
+		}
+		want |= vio_f_version_1
+	}
+	f &= want
+	tr.setfeatures(f)
+	st := vio_st_ack | vio_st_driver
+	if modern {
+		st |= vio_st_features_ok
+		tr.setstatus(st)
+		if tr.status() & vio_st_features_ok == 0 {
+			return false
+		}
+	}
+	d.flush = f & vio_blk_f_flush != 0
+	d.nsect = vio_cfg64(tr, vio_blk_capacity)
+	if !d.qinit() {
+		tr.setstatus(st | vio_st_failed)
+		return false
+	}
+	tr.setstatus(st | vio_st_driver_ok)
+	d.req = make(chan *bdevreq_t)
+	d.intr = make(chan bool, 1)
+	return true
+}
+
+// allocates a descriptor and fills it in
+func (d *vio_blk_t) dalloc(pa int, l int, flags int) int {
+	n := len(d.free) - 1
+	i := d.free[n]
+	d.free = d.free[:n]
+	desc := &d.desc[i]
+	desc.addr = uint64(pa)
+	desc.len = uint32(l)
+	desc.flags = uint16(flags)
+	desc.next = 0
+	return i
+}
+
+func (d *vio_blk_t) dlink(prev int, next int) {
+	d.desc[prev].flags |= vring_desc_next
+	d.desc[prev].next = uint16(next)
+}
+
+// makes the descriptor chain for c available to the device without
+// notifying it. returns false if there are not enough free descriptors.
+func (d *vio_blk_t) issue(c *bdevcmd_t) bool {
+	need := 2
+	for _, b := range c.bufs {
+		dma_regions(b.data[:], func(int, int) {
+			need++
+		})
+	}
+	if need > len(d.free) {
+		return false
+	}
+	typ := vio_blk_t_in
+	dflags := vring_desc_write
+	switch c.cmd() {
+	case BDEV_WRITE:
+		typ = vio_blk_t_out
+		dflags = 0
+	case BDEV_FLUSH:
+		typ = vio_blk_t_flush
+	}
+	sector := 0
+	if len(c.bufs) != 0 {
+		sector = int(c.bufs[0].block)
+	}
+
+	// the head's index is only known once it is allocated
+	h := d.dalloc(0, vio_blk_hdrsz, 0)
+	hdr := d.hdrs[h*vio_blk_hdrsz:(h + 1)*vio_blk_hdrsz]
+	writen(hdr, 4, 0, typ)
+	writen(hdr, 4, 4, 0)
+	writen(hdr, 8, 8, sector)
+	d.desc[h].addr = uint64(dma_pa(hdr))
+	prev := h
+	for _, b := range c.bufs {
+		dma_regions(b.data[:], func(pa int, l int) {
+			i := d.dalloc(pa, l, dflags)
+			d.dlink(prev, i)
+			prev = i
+		})
+	}
+	d.stats[h] = 0xff
+	i := d.dalloc(dma_pa(d.stats[h:h + 1]), 1, vring_desc_write)
+	d.dlink(prev, i)
+
+	d.issued[h] = c
+	d.avail.ring[int(d.avail.idx) % d.qsize] = uint16(h)
+	// the descriptors must be visible before the index; x86 doesn't
+	// reorder stores
+	d.avail.idx++
+	return true
+}
+
+// the device writes the used ring's index after its elements
+func (d *vio_blk_t) usedidx() uint16 {
+	fi := atomic.LoadUint32((*uint32)(unsafe.Pointer(&d.used.flags)))
+	return uint16(fi >> 16)
+}
+
+// finishes the requests the device has put in the used ring, returning
+// their descriptors to the free list. returns the number of finished
+// requests.
+func (d *vio_blk_t) collect() int {
+	ret := 0
+	for idx := d.usedidx(); d.lastused != idx; d.lastused++ {
+		h := int(d.used.ring[int(d.lastused) % d.qsize].id)
+		c := d.issued[h]
+		if c == nil {
+			panic("virtio: unknown request finished")
+		}
+		d.issued[h] = nil
+		for i := h; ; {
+			d.free = append(d.free, i)
+			desc := &d.desc[i]
+			if desc.flags & vring_desc_next == 0 {
+				break
+			}
+			i = int(desc.next)
+		}
+		if d.stats[h] == vio_blk_s_ok {
+			c.done(0)
+		} else {
+			fmt.Printf("virtio%v: I/O error %v\n", d.num, d.stats[h])
+			c.done(-EIO)
+		}
+		ret++
+	}
+	return ret
+}
+
+func (d *vio_blk_t) daemon() {
+	nissued := 0
+	// true while a flush is outstanding. flushes are issued while no
+	// other request is outstanding, and nothing is issued until they
+	// finish, so that a flush covers exactly the writes finished before
+	// it began.
+	excl := false
+	queue := make([]*bdevcmd_t, 0)
+	for {
+		select {
+		case req := <- d.req:
+			queue = append(queue, bdev_split(req, d.maxsect)...)
+		case <- d.intr:
+			n := d.collect()
+			nissued -= n
+			if n != 0 {
+				excl = false
+			}
+		}
+
+		notify := false
+		for len(queue) != 0 && !excl {
+			c := queue[0]
+			fl := c.cmd() == BDEV_FLUSH
+			if fl && !d.flush {
+				// the device has no volatile write cache
+				c.done(0)
+				queue = queue[1:]
+				continue
+			}
+			if fl && nissued != 0 || !d.issue(c) {
+				break
+			}
+			nissued++
+			excl = fl
+			notify = true
+			queue = queue[1:]
+		}
+		if notify {
+			d.tr.notify(0)
+		}
+	}
+}
+
+var vio_driver = pci_driver_t{
+	name: "virtio-blk",
+	ids: []pci_id_t{{vio_vendor, vio_dev_blk, -1},
+	    {vio_vendor, vio_dev_blk_legacy, -1}},
+	attach: vio_attach,
+}
+
+// initializes a virtio-blk device. the device's interrupt stays masked until
+// vio_start().
+func vio_attach(pd *pci_dev_t) bool {
+	num := len(vio_disks)
+	if num == vio_maxdevs {
+		return false
+	}
+	if pd.irq == -1 {
+		fmt.Printf("virtio%v: no legacy IRQ\n", num)
+		return false
+	}
+	pd.command(pci_cmd_io | pci_cmd_mem | pci_cmd_bm, pci_cmd_intxdis)
+
+	d := &vio_blk_t{num: num, vec: IRQ_BASE + pd.irq}
+	vi := vio_intr_t{vec: d.vec}
+	// prefer the modern interface of transitional devices
+	m := vio_modern_new(pd)
+	if m != nil {
+		d.tr = m
+		vi.isr = &m.isr[0]
+	} else if pd.device == vio_dev_blk_legacy && pd.bars[0].io {
+		base := int32(pd.bars[0].addr)
+		d.tr = &vio_legacy_t{base: base}
+		vi.port = base + viol_isr
+	} else {
+		return false
+	}
+	if !d.init(m != nil) {
+		fmt.Printf("virtio%v: failed to initialize\n", num)
+		return false
+	}
+	kind := "legacy"
+	if m != nil {
+		kind = "modern"
+	}
+	fmt.Printf("virtio%v: %v sectors, %v queue of %v\n", num, d.nsect,
+	    kind, d.qsize)
+	vio_disks = append(vio_disks, d)
+	vio_intrs[vio_nintrs] = vi
+	vio_nintrs++
+	return true
+}
+
+// starts the disk daemons and unmasks the disks' interrupts once their
+// handlers are installed.
+func vio_start() {
+	for _, d := range vio_disks {
+		go d.daemon()
+		irq_unmask(d.vec - IRQ_BASE)
+	}
+}
@@ -453,6 +453,47 @@ TEXT runtime·Insl(SB), NOSPLIT, $0-24
 	BYTE	$0x6d
 	RET
 
+TEXT runtime·Inl(SB), NOSPLIT, $0-16
+	MOVL	reg+0(FP), DX
+	// inl	(%dx), %eax
+	BYTE	$0xed
+	MOVQ	AX, ret+8(FP)
+	RET
+
+TEXT runtime·Outl(SB), NOSPLIT, $0-8
+	MOVL	reg+0(FP), DX
+	MOVL	val+4(FP), AX
+	// outl	%eax, (%dx)
+	BYTE	$0xef
+	RET
+
+TEXT runtime·Inw(SB), NOSPLIT, $0-16
+	MOVL	reg+0(FP), DX
+	// inw	(%dx), %ax
+	BYTE	$0x66
+	BYTE	$0xed
+	MOVWQZX	AX, AX
+	MOVQ	AX, ret+8(FP)
+	RET
+
+TEXT runtime·Outw(SB), NOSPLIT, $0-8
+	MOVL	reg+0(FP), DX
+	MOVL	val+4(FP), AX
+	// outw	%ax, (%dx)
+	BYTE	$0x66
+	BYTE	$0xef
+	RET
+
+// like Inb, but without a stack check so that it may be called from the
+// interrupt stack
+TEXT runtime·Inb_intr(SB), NOSPLIT, $0-16
+	MOVL	reg+0(FP), DX
+	// inb	(%dx), %al
+	BYTE	$0xec
+	MOVBQZX	AX, AX
+	MOVQ	AX, ret+8(FP)
+	RET
+
 TEXT runtime·inb(SB), NOSPLIT, $0-0
 	JMP	inb(SB)
 
@@ -2331,6 +2331,16 @@ runtime·Kpmap_p(void)
 	return kpmap;
 }
 
+// number of physical pages that have not yet been handed out
+#pragma textflag NOSPLIT
+uint64
+runtime·Pgsavail(void)
+{
+	if (!runtime·Pglast)
+		init_pgfirst();
+	return (runtime·Pglast - runtime·Pgfirst)/PGSIZE;
+}
+
 #pragma textflag NOSPLIT
 void
 runtime·Lcr3(uint64 pmap)
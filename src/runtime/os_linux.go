@@ -25,9 +25,15 @@ func Kpmap_p() int
 func Lcr3(int)
 func Memmove(unsafe.Pointer, unsafe.Pointer, int)
 func Inb(int32) int
+func Inb_intr(int32) int
+func Inl(int32) int
+func Inw(int32) int
 func Insl(int32, unsafe.Pointer, int)
 func Outb(int32, int32)
+func Outl(int32, int32)
+func Outw(int32, int32)
 func Outsl(int32, unsafe.Pointer, int)
+func Pgsavail() int
 func Pnum(int)
 func Procadd(tf *[23]int, uc int, p_pmap int)
 func Proccontinue()